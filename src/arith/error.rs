@@ -0,0 +1,64 @@
+use std::error::Error;
+use std::fmt;
+
+use arith::Number;
+
+/// A type alias for results with possible `EvalError`s.
+pub type Result<T> = ::std::result::Result<T, EvalError>;
+
+/// The ways in which evaluating an arithmetic expression may fail.
+///
+/// These correspond to the ISO error terms raised by `is/2` and the
+/// arithmetic comparison predicates.
+#[derive(Debug)]
+#[derive(Clone)]
+#[derive(PartialEq)]
+pub enum EvalError {
+    /// The expression contains an unbound variable.
+    Instantiation,
+
+    /// The expression contains a term which is not an evaluable functor,
+    /// given by name and arity.
+    NotEvaluable(String, usize),
+
+    /// An integer was required but some other number was given.
+    NotInteger(Number),
+
+    /// Division by zero.
+    ZeroDivisor,
+
+    /// The arguments are outside the domain of the function.
+    Undefined,
+
+    /// The result is too large to be represented as an integer.
+    IntOverflow,
+
+    /// The result is too large to be represented as a float.
+    FloatOverflow,
+}
+
+impl Error for EvalError {
+    fn description(&self) -> &str {
+        match *self {
+            EvalError::Instantiation => "arguments are not sufficiently instantiated",
+            EvalError::NotEvaluable(..) => "not an evaluable functor",
+            EvalError::NotInteger(..) => "expected an integer",
+            EvalError::ZeroDivisor => "division by zero",
+            EvalError::Undefined => "undefined arithmetic result",
+            EvalError::IntOverflow => "integer overflow",
+            EvalError::FloatOverflow => "float overflow",
+        }
+    }
+}
+
+impl fmt::Display for EvalError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match *self {
+            EvalError::NotEvaluable(ref name, arity) => {
+                write!(f, "not an evaluable functor: {}/{}", name, arity)
+            },
+            EvalError::NotInteger(n) => write!(f, "expected an integer, found {}", n),
+            _ => write!(f, "{}", self.description()),
+        }
+    }
+}
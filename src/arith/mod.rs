@@ -0,0 +1,328 @@
+//! Evaluation of arithmetic expressions.
+//!
+//! Arithmetic expressions are ordinary structures whose leaves are numbers
+//! and whose inner nodes are evaluable functors, e.g. `+/2` or `gcd/2`. The
+//! [`eval`] function reduces such a structure to a [`Number`], as done by
+//! `is/2` and the arithmetic comparison predicates.
+//!
+//! Integer arithmetic is exact: integer operations produce integer results,
+//! and overflow is reported as an error rather than silently wrapping or
+//! being promoted to a float. Mixed integer and float operations are
+//! performed on floats.
+//!
+//! [`eval`]: ./fn.eval.html
+//! [`Number`]: ./enum.Number.html
+
+use std::cmp::Ordering;
+
+use syntax::{Structure, Symbol};
+
+mod error;
+mod number;
+
+pub use self::error::{EvalError, Result};
+pub use self::number::Number;
+
+/// Evaluates an arithmetic expression.
+///
+/// The expression must be fully instantiated; variables cause an
+/// instantiation error. The structure is evaluated iteratively, so deeply
+/// nested expressions do not overflow the stack.
+pub fn eval(expr: &Structure) -> Result<Number> {
+    let mut stack = Vec::with_capacity(expr.len());
+    for &sym in expr.iter() {
+        let val = match sym {
+            Symbol::Int(i) => Number::Int(i),
+            Symbol::Float(f) => Number::Float(f.into_inner()),
+            Symbol::Var(_) => return Err(EvalError::Instantiation),
+            Symbol::Str(s) => return Err(EvalError::NotEvaluable(s.to_string(), 0)),
+            Symbol::List(true, 0) => return Err(EvalError::NotEvaluable("[]".to_string(), 0)),
+            Symbol::List(..) => return Err(EvalError::NotEvaluable(".".to_string(), 2)),
+            Symbol::Funct(n, name) => {
+                let at = stack.len() - n as usize;
+                let val = apply(name.as_str(), &stack[at..])?;
+                stack.truncate(at);
+                val
+            },
+        };
+        stack.push(val);
+    }
+    Ok(stack.pop().unwrap())
+}
+
+// Evaluable Functors
+// --------------------------------------------------
+
+/// Applies the evaluable functor with the given name to some arguments.
+fn apply(name: &str, args: &[Number]) -> Result<Number> {
+    match args.len() {
+        0 => nullary(name),
+        1 => unary(name, args[0]),
+        2 => binary(name, args[0], args[1]),
+        n => Err(EvalError::NotEvaluable(name.to_string(), n)),
+    }
+}
+
+fn nullary(name: &str) -> Result<Number> {
+    use std::f64::consts;
+    match name {
+        "pi" => Ok(Number::Float(consts::PI)),
+        "e" => Ok(Number::Float(consts::E)),
+        _ => Err(EvalError::NotEvaluable(name.to_string(), 0)),
+    }
+}
+
+fn unary(name: &str, x: Number) -> Result<Number> {
+    use self::Number::*;
+    match (name, x) {
+        ("+", x) => Ok(x),
+        ("-", Int(a)) => a.checked_neg().map(Int).ok_or(EvalError::IntOverflow),
+        ("-", Float(a)) => Ok(Float(-a)),
+        ("abs", x) => x.abs().ok_or(EvalError::IntOverflow),
+        ("sign", Int(a)) => Ok(Int(a.signum())),
+        ("sign", x) => Ok(Float(x.sign() as f64)),
+
+        ("truncate", x) => to_int(x, f64::trunc),
+        ("round", x) | ("integer", x) => to_int(x, f64::round),
+        ("ceiling", x) => to_int(x, f64::ceil),
+        ("floor", x) => to_int(x, f64::floor),
+
+        ("float", x) => Ok(Float(x.to_float())),
+        ("float_integer_part", x) => Ok(Float(x.to_float().trunc())),
+        ("float_fractional_part", x) => Ok(Float(x.to_float().fract())),
+
+        // The transcendental functions are computed on floats. Integer
+        // arguments are converted first, which may lose precision.
+        ("sqrt", x) if x.to_float() < 0.0 => Err(EvalError::Undefined),
+        ("sqrt", x) => to_float(x.to_float().sqrt()),
+        ("sin", x) => to_float(x.to_float().sin()),
+        ("cos", x) => to_float(x.to_float().cos()),
+        ("tan", x) => to_float(x.to_float().tan()),
+        ("asin", x) => to_float(x.to_float().asin()),
+        ("acos", x) => to_float(x.to_float().acos()),
+        ("atan", x) => to_float(x.to_float().atan()),
+        ("exp", x) => to_float(x.to_float().exp()),
+        ("log", x) if x.to_float() <= 0.0 => Err(EvalError::Undefined),
+        ("log", x) => to_float(x.to_float().ln()),
+
+        _ => Err(EvalError::NotEvaluable(name.to_string(), 1)),
+    }
+}
+
+fn binary(name: &str, x: Number, y: Number) -> Result<Number> {
+    use self::Number::*;
+    match (name, x, y) {
+        ("+", Int(a), Int(b)) => a.checked_add(b).map(Int).ok_or(EvalError::IntOverflow),
+        ("-", Int(a), Int(b)) => a.checked_sub(b).map(Int).ok_or(EvalError::IntOverflow),
+        ("*", Int(a), Int(b)) => a.checked_mul(b).map(Int).ok_or(EvalError::IntOverflow),
+        ("+", x, y) => to_float(x.to_float() + y.to_float()),
+        ("-", x, y) => to_float(x.to_float() - y.to_float()),
+        ("*", x, y) => to_float(x.to_float() * y.to_float()),
+
+        // Integer division is exact when possible. The remainder overflows
+        // only for `min_int / -1`, whose quotient overflows too.
+        ("/", Int(_), Int(0)) => Err(EvalError::ZeroDivisor),
+        ("/", Int(a), Int(b)) if a.checked_rem(b).map_or(true, |r| r == 0) => {
+            a.checked_div(b).map(Int).ok_or(EvalError::IntOverflow)
+        },
+        ("/", x, y) => {
+            if y.to_float() == 0.0 {
+                return Err(EvalError::ZeroDivisor);
+            }
+            to_float(x.to_float() / y.to_float())
+        },
+
+        // Integer division truncates toward zero, and `div` floors. The
+        // result of `rem` takes the sign of the dividend, and `mod` the sign
+        // of the divisor.
+        ("//", x, y) | ("div", x, y) | ("rem", x, y) | ("mod", x, y) => {
+            let (a, b) = (to_i64(x)?, to_i64(y)?);
+            if b == 0 {
+                return Err(EvalError::ZeroDivisor);
+            }
+            let rem = a.wrapping_rem(b);
+            let floored = rem != 0 && (rem < 0) != (b < 0);
+            match name {
+                "//" => a.checked_div(b).map(Int).ok_or(EvalError::IntOverflow),
+                "div" => {
+                    let q = a.checked_div(b).ok_or(EvalError::IntOverflow)?;
+                    Ok(Int(if floored { q - 1 } else { q }))
+                },
+                "rem" => Ok(Int(rem)),
+                _ => Ok(Int(if floored { rem + b } else { rem })),
+            }
+        },
+
+        ("min", x, y) => {
+            let ord = x.compare(y).ok_or(EvalError::Undefined)?;
+            Ok(if ord == Ordering::Greater { y } else { x })
+        },
+        ("max", x, y) => {
+            let ord = x.compare(y).ok_or(EvalError::Undefined)?;
+            Ok(if ord == Ordering::Less { y } else { x })
+        },
+
+        ("gcd", x, y) => gcd(to_i64(x)?, to_i64(y)?),
+
+        ("atan2", x, y) | ("atan", x, y) => {
+            let (a, b) = (x.to_float(), y.to_float());
+            if a == 0.0 && b == 0.0 {
+                return Err(EvalError::Undefined);
+            }
+            to_float(a.atan2(b))
+        },
+
+        // The logarithm of `y` in base `x`.
+        ("log", x, y) => {
+            let (base, a) = (x.to_float(), y.to_float());
+            if base <= 0.0 || base == 1.0 || a <= 0.0 {
+                return Err(EvalError::Undefined);
+            }
+            to_float(a.ln() / base.ln())
+        },
+
+        _ => Err(EvalError::NotEvaluable(name.to_string(), 2)),
+    }
+}
+
+// Helpers
+// --------------------------------------------------
+
+/// Requires a number to be an integer.
+fn to_i64(x: Number) -> Result<i64> {
+    match x {
+        Number::Int(a) => Ok(a),
+        x => Err(EvalError::NotInteger(x)),
+    }
+}
+
+/// Rounds a number to an integer with the given rounding function.
+fn to_int<F: Fn(f64) -> f64>(x: Number, round: F) -> Result<Number> {
+    match x {
+        Number::Int(a) => Ok(Number::Int(a)),
+        Number::Float(a) => {
+            let a = round(a);
+            if a.is_nan() {
+                Err(EvalError::Undefined)
+            } else if a < -9223372036854775808.0 || 9223372036854775808.0 <= a {
+                Err(EvalError::IntOverflow)
+            } else {
+                Ok(Number::Int(a as i64))
+            }
+        },
+    }
+}
+
+/// Checks that the result of a float operation is finite.
+fn to_float(a: f64) -> Result<Number> {
+    if a.is_nan() {
+        Err(EvalError::Undefined)
+    } else if a.is_infinite() {
+        Err(EvalError::FloatOverflow)
+    } else {
+        Ok(Number::Float(a))
+    }
+}
+
+/// Computes the greatest common divisor of two integers.
+///
+/// The result is always non-negative.
+fn gcd(a: i64, b: i64) -> Result<Number> {
+    // Work with magnitudes so that `i64::MIN` is handled correctly.
+    let mut a = a.wrapping_abs() as u64;
+    let mut b = b.wrapping_abs() as u64;
+    while b != 0 {
+        let t = a % b;
+        a = b;
+        b = t;
+    }
+    if a > i64::max_value() as u64 {
+        Err(EvalError::IntOverflow)
+    } else {
+        Ok(Number::Int(a as i64))
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use syntax::namespace::NameSpace;
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+
+    fn eval_str(expr: &str) -> Result<Number> {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let mut parser = Parser::new(expr.as_bytes(), &ns, &ops);
+        let st = parser.next().unwrap().unwrap();
+        eval(&st)
+    }
+
+    #[test]
+    fn basic() {
+        assert_eq!(eval_str("1 + 2 * 3."), Ok(Number::Int(7)));
+        assert_eq!(eval_str("7 / 2."), Ok(Number::Float(3.5)));
+        assert_eq!(eval_str("6 / 2."), Ok(Number::Int(3)));
+        assert_eq!(eval_str("7 // 2."), Ok(Number::Int(3)));
+        assert_eq!(eval_str("1 / 0."), Err(EvalError::ZeroDivisor));
+        assert_eq!(eval_str("X + 1."), Err(EvalError::Instantiation));
+        assert_eq!(eval_str("foo + 1."), Err(EvalError::NotEvaluable("foo".to_string(), 0)));
+        assert_eq!(eval_str("9223372036854775807 + 1."), Err(EvalError::IntOverflow));
+    }
+
+    #[test]
+    fn functions() {
+        assert_eq!(eval_str("gcd(12, 18)."), Ok(Number::Int(6)));
+        assert_eq!(eval_str("gcd(1.0, 2)."), Err(EvalError::NotInteger(Number::Float(1.0))));
+        assert_eq!(eval_str("round(2.5)."), Ok(Number::Int(3)));
+        assert_eq!(eval_str("floor(-1.5)."), Ok(Number::Int(-2)));
+        assert_eq!(eval_str("ceiling(1.5)."), Ok(Number::Int(2)));
+        assert_eq!(eval_str("truncate(-1.5)."), Ok(Number::Int(-1)));
+        assert_eq!(eval_str("integer(7)."), Ok(Number::Int(7)));
+        assert_eq!(eval_str("float(7)."), Ok(Number::Float(7.0)));
+        assert_eq!(eval_str("min(2, 1.5)."), Ok(Number::Float(1.5)));
+        assert_eq!(eval_str("max(2, 1.5)."), Ok(Number::Int(2)));
+        assert_eq!(eval_str("float_integer_part(-2.5)."), Ok(Number::Float(-2.0)));
+        assert_eq!(eval_str("float_fractional_part(-2.5)."), Ok(Number::Float(-0.5)));
+        assert_eq!(eval_str("abs(-3)."), Ok(Number::Int(3)));
+        assert_eq!(eval_str("abs(-2.5)."), Ok(Number::Float(2.5)));
+        assert_eq!(eval_str("sign(-3)."), Ok(Number::Int(-1)));
+        assert_eq!(eval_str("sign(2.5)."), Ok(Number::Float(1.0)));
+        assert_eq!(eval_str("abs(-9223372036854775807 - 1)."), Err(EvalError::IntOverflow));
+    }
+
+    #[test]
+    fn integer_division() {
+        assert_eq!(eval_str("-7 // 2."), Ok(Number::Int(-3)));
+        assert_eq!(eval_str("-7 div 2."), Ok(Number::Int(-4)));
+        assert_eq!(eval_str("-7 mod 2."), Ok(Number::Int(1)));
+        assert_eq!(eval_str("-7 rem 2."), Ok(Number::Int(-1)));
+        assert_eq!(eval_str("7 div -2."), Ok(Number::Int(-4)));
+        assert_eq!(eval_str("7 mod -2."), Ok(Number::Int(-1)));
+        assert_eq!(eval_str("6 div -2."), Ok(Number::Int(-3)));
+        assert_eq!(eval_str("6 mod -2."), Ok(Number::Int(0)));
+        assert_eq!(eval_str("7 mod 0."), Err(EvalError::ZeroDivisor));
+        assert_eq!(eval_str("7.0 rem 2."), Err(EvalError::NotInteger(Number::Float(7.0))));
+
+        let min = "(-9223372036854775807 - 1)";
+        assert_eq!(eval_str(&format!("{} / -1.", min)), Err(EvalError::IntOverflow));
+        assert_eq!(eval_str(&format!("{} // -1.", min)), Err(EvalError::IntOverflow));
+        assert_eq!(eval_str(&format!("{} rem -1.", min)), Ok(Number::Int(0)));
+        assert_eq!(eval_str(&format!("{} / 2.", min)), Ok(Number::Int(-4611686018427387904)));
+    }
+
+    #[test]
+    fn transcendental() {
+        assert_eq!(eval_str("sqrt(2)."), Ok(Number::Float(2f64.sqrt())));
+        assert_eq!(eval_str("cos(pi)."), Ok(Number::Float(-1.0)));
+        assert_eq!(eval_str("log(e)."), Ok(Number::Float(1.0)));
+        assert_eq!(eval_str("log(2, 8)."), Ok(Number::Float(3.0)));
+        assert_eq!(eval_str("atan2(1, 1) * 4."), Ok(Number::Float(::std::f64::consts::PI)));
+        assert_eq!(eval_str("sqrt(-1)."), Err(EvalError::Undefined));
+        assert_eq!(eval_str("log(0)."), Err(EvalError::Undefined));
+        assert_eq!(eval_str("asin(2)."), Err(EvalError::Undefined));
+    }
+}
@@ -0,0 +1,90 @@
+use std::cmp::Ordering;
+use std::fmt;
+
+use ordered_float::OrderedFloat;
+
+use syntax::Symbol;
+
+/// The result of evaluating an arithmetic expression.
+///
+/// Integers are machine integers. Operations which overflow are evaluation
+/// errors rather than being promoted to floats.
+#[derive(Debug)]
+#[derive(Clone, Copy)]
+#[derive(PartialEq)]
+pub enum Number {
+    Int(i64),
+    Float(f64),
+}
+
+impl Number {
+    /// Converts a symbol to a number, if it is numeric.
+    pub fn from_symbol(sym: Symbol) -> Option<Number> {
+        match sym {
+            Symbol::Int(i) => Some(Number::Int(i)),
+            Symbol::Float(f) => Some(Number::Float(f.into_inner())),
+            _ => None,
+        }
+    }
+
+    /// Converts the number to a symbol.
+    pub fn to_symbol<'ns>(self) -> Symbol<'ns> {
+        match self {
+            Number::Int(i) => Symbol::Int(i),
+            Number::Float(f) => Symbol::Float(OrderedFloat(f)),
+        }
+    }
+
+    /// Converts the number to a float.
+    ///
+    /// Integers with a magnitude greater than 2^53 may lose precision.
+    pub fn to_float(self) -> f64 {
+        match self {
+            Number::Int(i) => i as f64,
+            Number::Float(f) => f,
+        }
+    }
+
+    /// Returns -1, 0, or 1 according to the sign of the number.
+    ///
+    /// Both positive and negative zero have sign 0.
+    pub fn sign(self) -> i64 {
+        match self {
+            Number::Int(i) => i.signum(),
+            Number::Float(f) if f > 0.0 => 1,
+            Number::Float(f) if f < 0.0 => -1,
+            Number::Float(_) => 0,
+        }
+    }
+
+    /// Returns the magnitude of the number.
+    ///
+    /// Returns `None` if the magnitude cannot be represented, i.e. for the
+    /// most negative integer.
+    pub fn abs(self) -> Option<Number> {
+        match self {
+            Number::Int(i) => i.checked_abs().map(Number::Int),
+            Number::Float(f) => Some(Number::Float(f.abs())),
+        }
+    }
+
+    /// Compares two numbers by value.
+    ///
+    /// Mixed comparisons are performed on floats. Returns `None` if either
+    /// number is NaN.
+    pub fn compare(self, other: Number) -> Option<Ordering> {
+        match (self, other) {
+            (Number::Int(a), Number::Int(b)) => Some(a.cmp(&b)),
+            (a, b) => a.to_float().partial_cmp(&b.to_float()),
+        }
+    }
+}
+
+impl fmt::Display for Number {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match *self {
+            Number::Int(i) => write!(f, "{}", i),
+            Number::Float(x) => write!(f, "{:?}", x),
+        }
+    }
+}
@@ -0,0 +1,305 @@
+//! Translation of definite clause grammars.
+//!
+//! A grammar rule `Head --> Body` is translated into an ordinary clause by
+//! threading a pair of arguments through each nonterminal: the list to parse,
+//! and the list remaining after the nonterminal is parsed. Thus the rule
+//! `greeting --> [hello], name.` becomes
+//! `greeting(S0, S) :- S0 = [hello|S1], name(S1, S).`
+
+use syntax::{Structure, Symbol};
+use syntax::namespace::NameSpace;
+
+/// Translates a grammar rule `Head --> Body` into a clause.
+///
+/// The head may be followed by a pushback list, as in `Head, [a] --> Body`.
+/// Returns `None` if the structure is not a grammar rule, its head is not
+/// callable, or its pushback or any list of terminals is not a proper list.
+pub fn translate_rule<'ns>(
+    rule: &Structure<'ns>,
+    ns: &'ns NameSpace,
+) -> Option<Box<Structure<'ns>>> {
+    match rule.functor() {
+        Symbol::Funct(2, name) if name.as_str() == "-->" => (),
+        _ => return None,
+    }
+    let args = rule.args();
+    let (head, pushback) = match args[0].functor() {
+        Symbol::Funct(2, name) if name.as_str() == "," => {
+            let parts = args[0].args();
+            (parts[0], Some(parts[1]))
+        },
+        _ => (args[0], None),
+    };
+    match head.functor() {
+        Symbol::Funct(..) => (),
+        _ => return None,
+    }
+    match pushback.map(|list| list.functor()) {
+        None | Some(Symbol::List(..)) | Some(Symbol::Str(_)) => (),
+        _ => return None,
+    }
+
+    let mut t = Translator::new(rule, ns);
+    let (s0, s) = (t.fresh(), t.fresh());
+    t.nonterminal(head, s0, s);
+    let ok = match pushback {
+        None => t.body(args[1], s0, s),
+        Some(list) => {
+            // The pushback list is put back on the input after the body.
+            let mid = t.fresh();
+            let ok = t.body(args[1], s0, mid) && t.terminals(list, s, mid);
+            t.funct(2, ",");
+            ok
+        },
+    };
+    if !ok {
+        return None;
+    }
+    t.funct(2, ":-");
+    Some(unsafe { Structure::from_vec(t.buf) })
+}
+
+/// Translates a grammar body into a goal.
+///
+/// The variables `Var(s0)` and `Var(s)` of the goal stand for the list to
+/// parse and the list remaining. Variables introduced by the translation are
+/// numbered from `next`, which is advanced past them. Returns `None` if a list
+/// of terminals is not a proper list.
+pub fn translate_body<'ns>(
+    body: &Structure<'ns>,
+    s0: usize,
+    s: usize,
+    next: &mut usize,
+    ns: &'ns NameSpace,
+) -> Option<Box<Structure<'ns>>> {
+    let mut t = Translator {
+        ns: ns,
+        next: *next,
+        buf: Vec::new(),
+    };
+    if !t.body(body, s0, s) {
+        return None;
+    }
+    *next = t.next;
+    Some(unsafe { Structure::from_vec(t.buf) })
+}
+
+/// Emits the postfix symbols of a translated rule or body.
+struct Translator<'ns> {
+    ns: &'ns NameSpace,
+    next: usize,
+    buf: Vec<Symbol<'ns>>,
+}
+
+impl<'ns> Translator<'ns> {
+    /// Constructs a translator whose new variables follow those of a rule.
+    fn new(rule: &Structure<'ns>, ns: &'ns NameSpace) -> Translator<'ns> {
+        let next = rule.iter()
+            .filter_map(|sym| match *sym {
+                Symbol::Var(n) => Some(n + 1),
+                _ => None,
+            })
+            .max()
+            .unwrap_or(0);
+        Translator {
+            ns: ns,
+            next: next,
+            buf: Vec::new(),
+        }
+    }
+
+    /// Allocates a new variable.
+    fn fresh(&mut self) -> usize {
+        self.next += 1;
+        self.next - 1
+    }
+
+    fn funct(&mut self, arity: u32, name: &str) {
+        self.buf.push(Symbol::Funct(arity, self.ns.name(name)));
+    }
+
+    fn var(&mut self, n: usize) {
+        self.buf.push(Symbol::Var(n));
+    }
+
+    fn copy(&mut self, st: &Structure<'ns>) {
+        self.buf.extend_from_slice(st.as_slice());
+    }
+
+    /// Emits the goal `S0 = S`.
+    fn unify(&mut self, s0: usize, s: usize) {
+        self.var(s0);
+        self.var(s);
+        self.funct(2, "=");
+    }
+
+    /// Emits a goal which parses the body from `s0`, leaving `s`.
+    ///
+    /// Returns false if a list of terminals is not a proper list.
+    fn body(&mut self, body: &Structure<'ns>, s0: usize, s: usize) -> bool {
+        let name = match body.functor() {
+            Symbol::Funct(_, name) => name.as_str(),
+            Symbol::Var(_) => {
+                self.copy(body);
+                self.var(s0);
+                self.var(s);
+                self.funct(3, "phrase");
+                return true;
+            },
+            Symbol::List(..) | Symbol::Str(_) => return self.terminals(body, s0, s),
+            _ => {
+                // Not callable. Calling it raises a type error.
+                self.copy(body);
+                self.var(s0);
+                self.var(s);
+                self.funct(3, "call");
+                return true;
+            },
+        };
+        let args = body.args();
+        match (name, args.len()) {
+            (",", 2) | ("->", 2) => {
+                let mid = self.fresh();
+                if !self.body(args[0], s0, mid) || !self.body(args[1], mid, s) {
+                    return false;
+                }
+                self.funct(2, name);
+            },
+            (";", 2) | ("|", 2) => {
+                if !self.body(args[0], s0, s) || !self.body(args[1], s0, s) {
+                    return false;
+                }
+                self.funct(2, ";");
+            },
+            ("\\+", 1) => {
+                let rest = self.fresh();
+                if !self.body(args[0], s0, rest) {
+                    return false;
+                }
+                self.funct(1, "\\+");
+                self.unify(s0, s);
+                self.funct(2, ",");
+            },
+            ("!", 0) => {
+                self.funct(0, "!");
+                self.unify(s0, s);
+                self.funct(2, ",");
+            },
+            ("{}", 1) => {
+                self.copy(args[0]);
+                self.unify(s0, s);
+                self.funct(2, ",");
+            },
+            ("call", n) if 1 <= n => {
+                for arg in args {
+                    self.copy(arg);
+                }
+                self.var(s0);
+                self.var(s);
+                self.funct(n as u32 + 2, "call");
+            },
+            _ => self.nonterminal(body, s0, s),
+        }
+        true
+    }
+
+    /// Emits a call to a nonterminal with two more arguments.
+    fn nonterminal(&mut self, nt: &Structure<'ns>, s0: usize, s: usize) {
+        let (arity, name) = match nt.functor() {
+            Symbol::Funct(arity, name) => (arity, name),
+            _ => unreachable!("nonterminals must be callable"),
+        };
+        for arg in nt.args() {
+            self.copy(arg);
+        }
+        self.var(s0);
+        self.var(s);
+        self.buf.push(Symbol::Funct(arity + 2, name));
+    }
+
+    /// Emits `S0 = [T1, ..., Tn|S]` for a list of terminals.
+    ///
+    /// A string is a list of character codes. Returns false if the list is not
+    /// a proper list.
+    fn terminals(&mut self, list: &Structure<'ns>, s0: usize, s: usize) -> bool {
+        self.var(s0);
+        let n = match list.functor() {
+            Symbol::Str(text) => {
+                for ch in text.chars() {
+                    self.buf.push(Symbol::Int(ch as i64));
+                }
+                text.chars().count()
+            },
+            _ => {
+                let (elems, tail) = list.list_elements();
+                if tail.functor() != Symbol::List(true, 0) {
+                    return false;
+                }
+                for elem in elems.iter() {
+                    self.copy(elem);
+                }
+                elems.len()
+            },
+        };
+        self.var(s);
+        for _ in 0..n {
+            self.buf.push(Symbol::List(false, 2));
+        }
+        self.funct(2, "=");
+        true
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+    use syntax::writer::{Spacing, Writer};
+    use super::*;
+
+    #[test]
+    fn translate() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops).spacing(Spacing::Pretty);
+        let cases = vec![
+            ("a --> [].", "a(_0, _1) :- _0 = _1"),
+            (
+                "a(X) --> b, [x, X], c(X).",
+                "a(_0, _1, _2) :- b(_1, _3), _3 = [x, _0|_4], c(_0, _4, _2)",
+            ),
+            (
+                "a --> b, !, {write(x)}.",
+                "a(_0, _1) :- b(_0, _2), (!, _2 = _3), write(x), _3 = _1",
+            ),
+            (
+                "a --> (b -> c ; \\+ d), X.",
+                "a(_1, _2) :- (b(_1, _4) -> c(_4, _3) ; \\+d(_1, _5), _1 = _3), phrase(_0, _3, _2)",
+            ),
+            ("a, [p] --> call(g, 1).", "a(_0, _1) :- call(g, 1, _0, _2), _1 = [p|_2]"),
+        ];
+        for (pl, expected) in cases {
+            let rule = Parser::new(pl.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+            let clause = translate_rule(&rule, &ns).unwrap();
+            assert!(clause.is_valid());
+            assert_eq!(writer.to_string(&clause), expected);
+        }
+
+        let cases = vec![
+            "a :- b.",
+            "1 --> a.",
+            "X --> a.",
+            "a, b --> c.",
+            "a --> [x|T].",
+            "a, [p|T] --> b.",
+            "a --> b, ([x|T] ; c).",
+        ];
+        for pl in cases {
+            let st = Parser::new(pl.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+            assert_eq!(translate_rule(&st, &ns), None);
+        }
+    }
+}
@@ -1,7 +1,12 @@
 use std::collections::HashMap;
+use std::io::BufRead;
 use std::sync::Arc;
 
-use syntax::{Structure, Symbol};
+use syntax::{Indicator, Structure, Symbol, SyntaxError};
+use syntax::namespace::NameSpace;
+use syntax::parser::Parser;
+
+pub mod dcg;
 
 pub struct DataBase<'ns> {
     preds: HashMap<Symbol<'ns>, Vec<Rule<'ns>>>,
@@ -11,6 +16,7 @@ pub struct DataBase<'ns> {
 pub struct Rule<'ns> {
     head: Arc<Structure<'ns>>,
     body: Option<Arc<Structure<'ns>>>,
+    key: Option<Symbol<'ns>>,
 }
 
 impl<'ns> DataBase<'ns> {
@@ -24,6 +30,136 @@ impl<'ns> DataBase<'ns> {
         rules.push(Rule::new(head, body));
     }
 
+    /// Adds a rule to the start of its predicate.
+    pub fn asserta(&mut self, head: Arc<Structure<'ns>>, body: Option<Arc<Structure<'ns>>>) {
+        let functor = head.functor();
+        let rules = self.preds.entry(functor).or_insert(vec![]);
+        rules.insert(0, Rule::new(head, body));
+    }
+
+    /// Adds a clause to the end of its predicate.
+    ///
+    /// Clauses of the form `Head :- Body` are split into a head and a body.
+    /// Anything else is a fact.
+    pub fn assert_clause(&mut self, clause: &Structure<'ns>) {
+        let (head, body) = split(clause);
+        self.assert(head, body);
+    }
+
+    /// Adds a clause to the start of its predicate.
+    ///
+    /// Clauses are split as in `assert_clause`.
+    pub fn asserta_clause(&mut self, clause: &Structure<'ns>) {
+        let (head, body) = split(clause);
+        self.asserta(head, body);
+    }
+
+    /// Removes a rule from the database. Returns false if the rule was
+    /// already removed.
+    ///
+    /// Rules are identified by their head, not compared by value.
+    pub fn retract(&mut self, rule: &Rule<'ns>) -> bool {
+        let rules = match self.preds.get_mut(&rule.head.functor()) {
+            Some(rules) => rules,
+            None => return false,
+        };
+        match rules.iter().position(|r| Arc::ptr_eq(&r.head, &rule.head)) {
+            Some(i) => {
+                rules.remove(i);
+                true
+            },
+            None => false,
+        }
+    }
+
+    /// Defines a predicate with no clauses, as by `dynamic/1`, so that
+    /// calling it fails rather than raising an existence error.
+    pub fn declare(&mut self, functor: Symbol<'ns>) {
+        self.preds.entry(functor).or_insert(vec![]);
+    }
+
+    /// Loads the clauses read by a parser, as by `consult/1`.
+    ///
+    /// Clauses are asserted as they are read, and grammar rules are first
+    /// translated into clauses. The parser applies `op/3` and
+    /// `set_prolog_flag/2` directives as it reads them, so they affect the
+    /// clauses which follow, and the parser's operators and flags reflect them
+    /// afterwards. A `dynamic/1` directive declares the predicates it names.
+    /// Other directives are not run.
+    ///
+    /// Returns the syntax errors, including clauses which cannot be asserted
+    /// and grammar rules which cannot be translated. The parser resumes after
+    /// each error, so every well-formed clause is loaded.
+    pub fn consult<B: BufRead>(&mut self, parser: &mut Parser<'ns, B>) -> Vec<SyntaxError> {
+        let ns = parser.ns();
+        let mut errors = Vec::new();
+        while let Some(clause) = parser.next() {
+            let clause = match clause {
+                Ok(clause) => clause,
+                Err(err) => {
+                    errors.push(err);
+                    continue;
+                },
+            };
+            match clause.functor() {
+                Symbol::Funct(1, name) if name.as_str() == ":-" => {
+                    let goal = clause.args()[0];
+                    match goal.functor() {
+                        Symbol::Funct(1, name) if name.as_str() == "dynamic" => {
+                            for pi in indicators(goal.args()[0]) {
+                                self.declare(pi.functor());
+                            }
+                        },
+                        _ => (),
+                    }
+                },
+                Symbol::Funct(2, name) if name.as_str() == "-->" => {
+                    let (line, col) = parser.span().start;
+                    match dcg::translate_rule(&clause, ns) {
+                        Some(clause) => self.assert_checked(&clause, line, col, &mut errors),
+                        None => errors.push(SyntaxError::malformed(line, col, "grammar rule")),
+                    }
+                },
+                _ => {
+                    let (line, col) = parser.span().start;
+                    self.assert_checked(&clause, line, col, &mut errors);
+                },
+            }
+        }
+        errors
+    }
+
+    /// Asserts a consulted clause, or records an error if it cannot be
+    /// asserted.
+    fn assert_checked(
+        &mut self,
+        clause: &Structure<'ns>,
+        line: usize,
+        col: usize,
+        errors: &mut Vec<SyntaxError>,
+    ) {
+        match check_clause(clause) {
+            Ok(()) => self.assert_clause(clause),
+            Err(_) => errors.push(SyntaxError::malformed(line, col, "clause")),
+        }
+    }
+
+    /// Returns true if the predicate has been defined, even if all of its
+    /// clauses have since been retracted.
+    pub fn is_defined(&self, functor: Symbol<'ns>) -> bool {
+        self.preds.contains_key(&functor)
+    }
+
+    /// Gets the rules of a predicate in order, e.g. to implement `listing/1`.
+    ///
+    /// Returns an empty vector if there is no such predicate.
+    pub fn listing(&self, pred: Indicator<'ns>) -> Vec<Rule<'ns>> {
+        match self.preds.get(&pred.functor()) {
+            Some(rules) => rules.clone(),
+            None => vec![],
+        }
+    }
+
     pub fn query(&self, head: Arc<Structure<'ns>>) -> Vec<Rule<'ns>> {
         let functor = head.functor();
         match self.preds.get(&functor) {
@@ -31,14 +167,244 @@ impl<'ns> DataBase<'ns> {
             None => vec![],
         }
     }
+
+    /// Gets the rules which may match a goal, in order.
+    ///
+    /// Rules are indexed by the functor of the goal and by the functor of its
+    /// first argument, if known. Rules whose first argument is a variable are
+    /// always candidates.
+    pub fn candidates(&self, functor: Symbol<'ns>, first: Option<Symbol<'ns>>) -> Vec<Rule<'ns>> {
+        let rules = match self.preds.get(&functor) {
+            Some(rules) => rules,
+            None => return vec![],
+        };
+        match first {
+            None => rules.clone(),
+            Some(first) => {
+                rules.iter()
+                    .filter(|rule| rule.key.map(|key| key == first).unwrap_or(true))
+                    .cloned()
+                    .collect()
+            },
+        }
+    }
+}
+
+/// The reasons a clause cannot be asserted.
+#[derive(Debug)]
+#[derive(PartialEq)]
+pub enum ClauseError<'a, 'ns: 'a> {
+    /// The clause, its head, or its body is a variable.
+    Unbound,
+
+    /// The head, or a goal of the body, is not callable. The culprit is the
+    /// head or the whole body.
+    NotCallable(&'a Structure<'ns>),
+}
+
+/// Checks that a clause can be asserted, as by `assertz/1`.
+///
+/// The head must be callable. Each goal of the body must be callable or a
+/// variable, except that the body itself may not be a variable.
+pub fn check_clause<'a, 'ns>(clause: &'a Structure<'ns>) -> Result<(), ClauseError<'a, 'ns>> {
+    let (head, body) = match clause.functor() {
+        Symbol::Funct(2, name) if name.as_str() == ":-" => {
+            let args = clause.args();
+            (args[0], Some(args[1]))
+        },
+        _ => (clause, None),
+    };
+    match head.functor() {
+        Symbol::Funct(..) => (),
+        Symbol::Var(_) => return Err(ClauseError::Unbound),
+        _ => return Err(ClauseError::NotCallable(head)),
+    }
+    let body = match body {
+        Some(body) => body,
+        None => return Ok(()),
+    };
+    match body.functor() {
+        Symbol::Var(_) => Err(ClauseError::Unbound),
+        _ if is_body(body) => Ok(()),
+        _ => Err(ClauseError::NotCallable(body)),
+    }
 }
 
+/// Returns true if every goal of a body is callable or a variable.
+fn is_body(body: &Structure) -> bool {
+    match body.functor() {
+        Symbol::Funct(2, name) => {
+            match name.as_str() {
+                "," | ";" | "->" | "*->" => body.args().into_iter().all(is_body),
+                _ => true,
+            }
+        },
+        Symbol::Funct(..) | Symbol::Var(_) => true,
+        _ => false,
+    }
+}
+
+/// Splits a clause into a head and an optional body.
+fn split<'ns>(clause: &Structure<'ns>) -> (Arc<Structure<'ns>>, Option<Arc<Structure<'ns>>>) {
+    match clause.functor() {
+        Symbol::Funct(2, name) if name.as_str() == ":-" => {
+            let args = clause.args();
+            (Arc::from(args[0].to_owned()), Some(Arc::from(args[1].to_owned())))
+        },
+        _ => (Arc::from(clause.to_owned()), None),
+    }
+}
+
+/// Gets the predicate indicators in a sequence or list, as in the argument
+/// of `dynamic/1`. Terms which are not indicators are skipped.
+fn indicators<'ns>(st: &Structure<'ns>) -> Vec<Indicator<'ns>> {
+    match st.functor() {
+        Symbol::Funct(2, name) if name.as_str() == "," => {
+            let args = st.args();
+            let mut pis = indicators(args[0]);
+            pis.extend(indicators(args[1]));
+            pis
+        },
+        Symbol::List(..) => {
+            st.list_elements()
+                .0
+                .into_iter()
+                .filter_map(Indicator::from_structure)
+                .collect()
+        },
+        _ => Indicator::from_structure(st).into_iter().collect(),
+    }
+}
 
 impl<'ns> Rule<'ns> {
     fn new(head: Arc<Structure<'ns>>, body: Option<Arc<Structure<'ns>>>) -> Rule<'ns> {
+        let key = match head.args().first().map(|arg| arg.functor()) {
+            Some(Symbol::Var(_)) | None => None,
+            Some(sym) => Some(sym),
+        };
         Rule {
             head: head,
             body: body,
+            key: key,
         }
     }
+
+    /// Gets the head of the rule.
+    pub fn head(&self) -> &Arc<Structure<'ns>> {
+        &self.head
+    }
+
+    /// Gets the body of the rule, or `None` if the rule is a fact.
+    ///
+    /// The variables of the body are numbered consistently with the head.
+    pub fn body(&self) -> Option<&Arc<Structure<'ns>>> {
+        self.body.as_ref()
+    }
+
+    /// Converts the rule back to a clause, `Head :- Body` or a fact.
+    pub fn to_clause(&self, ns: &'ns NameSpace) -> Box<Structure<'ns>> {
+        let mut syms = self.head.to_vec();
+        if let Some(ref body) = self.body {
+            syms.extend_from_slice(body);
+            syms.push(Symbol::Funct(2, ns.name(":-")));
+        }
+        unsafe { Structure::from_vec(syms) }
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+    use syntax::writer::Writer;
+    use super::*;
+
+    #[test]
+    fn listing() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "foo(1). bar(a). foo(X) :- bar(X), X \\= b. foo(2, 3). foo(3).";
+        let mut db = DataBase::new();
+        for clause in Parser::new(pl.as_bytes(), &ns, &ops) {
+            db.assert_clause(&clause.unwrap());
+        }
+
+        let clauses: Vec<_> = db.listing(Indicator::parse("foo/1", &ns).unwrap())
+            .iter()
+            .map(|rule| rule.to_clause(&ns))
+            .collect();
+        let mut buf = Vec::new();
+        Writer::new(&ops).write_program(&mut buf, clauses.iter().map(|c| &**c)).unwrap();
+        assert_eq!(String::from_utf8(buf).unwrap(), "foo(1).\n\
+                                                     foo(_0) :- bar(_0),_0\\=b.\n\
+                                                     foo(3).\n");
+
+        assert_eq!(db.listing(Indicator::new(ns.name("foo"), 3)).len(), 0);
+        assert_eq!(db.listing(Indicator::new(ns.name("baz"), 0)).len(), 0);
+    }
+
+    #[test]
+    fn check_clause() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "p(X). p :- X, (q ; r -> X). X. 1. p :- X. 1 :- p.\n\
+                  p :- q, (r ; 1). p :- \"s\".";
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops)
+            .map(|c| c.unwrap())
+            .collect();
+        let errs: Vec<_> = clauses.iter()
+            .map(|c| match super::check_clause(c) {
+                Ok(()) => "ok".to_string(),
+                Err(ClauseError::Unbound) => "unbound".to_string(),
+                Err(ClauseError::NotCallable(st)) => format!("{}", Writer::new(&ops).to_string(st)),
+            })
+            .collect();
+        assert_eq!(errs, vec!["ok", "ok", "unbound", "1", "unbound", "1", "q,(r;1)", "\"s\""]);
+    }
+
+    #[test]
+    fn consult() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = ":- op(700, xfx, ===>).\n\
+                  :- dynamic([seen/1]).\n\
+                  :- dynamic counter/1, visited/2.\n\
+                  rule(a ===> b).\n\
+                  rule(b ===> c) :- true.\n\
+                  oops(.\n\
+                  rule(c ===> d).\n\
+                  1 --> a.\n\
+                  g, x --> a.\n\
+                  bad :- rule(a ===> b), 1.\n";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        let mut db = DataBase::new();
+        let errors = db.consult(&mut parser);
+        assert_eq!(errors.len(), 4);
+        assert_eq!(errors[0].line(), 6);
+        assert_eq!(errors[1].to_string(), "8:1: malformed input: grammar rule");
+        assert_eq!(errors[2].line(), 9);
+        assert_eq!(errors[3].to_string(), "10:1: malformed input: clause");
+
+        // The operator is in effect for the clauses which follow it.
+        let ops = parser.ops();
+        let clauses: Vec<_> = db.listing(Indicator::new(ns.name("rule"), 1))
+            .iter()
+            .map(|rule| rule.to_clause(&ns))
+            .collect();
+        let mut buf = Vec::new();
+        Writer::new(ops).write_program(&mut buf, clauses.iter().map(|c| &**c)).unwrap();
+        assert_eq!(String::from_utf8(buf).unwrap(), "rule(a===>b).\n\
+                                                     rule(b===>c) :- true.\n\
+                                                     rule(c===>d).\n");
+
+        // Dynamic predicates are defined, and directives are not asserted.
+        assert!(db.is_defined(Symbol::Funct(1, ns.name("seen"))));
+        assert!(db.is_defined(Symbol::Funct(1, ns.name("counter"))));
+        assert!(db.is_defined(Symbol::Funct(2, ns.name("visited"))));
+        assert!(!db.is_defined(Symbol::Funct(1, ns.name(":-"))));
+        assert!(!db.is_defined(Symbol::Funct(2, ns.name("-->"))));
+    }
 }
@@ -0,0 +1,380 @@
+use std::collections::{HashMap, HashSet};
+use std::mem;
+use std::sync::Arc;
+
+use engine::term::{self, Term};
+use syntax::{Structure, Symbol};
+
+/// A store of variable bindings supporting backtracking.
+///
+/// Each variable is identified by its number within the `Bindings`. Variables
+/// are allocated in frames, one per use of a structure; see `rename`.
+///
+/// Every change to a binding is recorded on a trail. A `Mark` saves the length
+/// of the trail and the number of variables, and `undo` reverts every change
+/// made after a mark and frees the variables allocated after it. This is how a
+/// solver returns to a choice point.
+///
+/// Unification does not perform the occurs check, so a variable may be bound
+/// to a term containing itself, as in `X = f(X)`. Such cyclic terms can be
+/// detected with `is_cyclic`.
+#[derive(Debug)]
+pub struct Bindings<'ns> {
+    vals: Vec<Option<Term<'ns>>>,
+    trail: Vec<(usize, Option<Term<'ns>>)>,
+}
+
+/// A position on the trail of a `Bindings`, along with the number of variables
+/// allocated at that point.
+#[derive(Debug)]
+#[derive(Clone, Copy)]
+#[derive(PartialEq, Eq)]
+pub struct Mark {
+    trail: usize,
+    vars: usize,
+}
+
+impl<'ns> Bindings<'ns> {
+    /// Constructs an empty `Bindings`.
+    pub fn new() -> Bindings<'ns> {
+        Bindings {
+            vals: Vec::new(),
+            trail: Vec::new(),
+        }
+    }
+
+    /// Places a structure in a fresh frame of unbound variables.
+    pub fn rename(&mut self, st: Arc<Structure<'ns>>) -> Term<'ns> {
+        let n = term::var_count(&st);
+        let frame = self.alloc(n);
+        Term::new(st, frame)
+    }
+
+    /// Allocates a frame of `n` unbound variables, returning its offset.
+    ///
+    /// This is useful when several structures share a frame, like the head
+    /// and body of a rule.
+    pub fn alloc(&mut self, n: usize) -> usize {
+        let frame = self.vals.len();
+        self.vals.extend((0..n).map(|_| None));
+        frame
+    }
+
+    /// Binds a variable to a term.
+    ///
+    /// The variable should be unbound.
+    pub fn bind(&mut self, var: usize, val: Term<'ns>) {
+        debug_assert!(self.vals[var].is_none());
+        self.set(var, Some(val));
+    }
+
+    /// Gets the value of a variable, or `None` if the variable is unbound.
+    ///
+    /// Like `deref`, the value is never a bound variable.
+    pub fn lookup(&mut self, var: usize) -> Option<Term<'ns>> {
+        let val = match self.vals[var] {
+            Some(ref val) => val.clone(),
+            None => return None,
+        };
+        Some(self.deref(&val))
+    }
+
+    /// Follows the bindings of a term until reaching either an unbound
+    /// variable or a term whose root is not a variable.
+    ///
+    /// Each variable along a chain of two or more bindings is rebound directly
+    /// to the end of the chain, so that later lookups are short.
+    pub fn deref(&mut self, term: &Term<'ns>) -> Term<'ns> {
+        let mut chain = Vec::new();
+        let end = self.walk(term, &mut chain);
+        if chain.len() >= 2 {
+            chain.pop();
+            for var in chain {
+                self.set(var, Some(end.clone()));
+            }
+        }
+        end
+    }
+
+    /// Builds a term from a structure whose variable `Var(i)` is bound to the
+    /// `i`th value. The structure must have a variable for each value.
+    pub fn build(&mut self, st: Box<Structure<'ns>>, vals: &[Term<'ns>]) -> Term<'ns> {
+        let frame = self.alloc(vals.len());
+        for (i, val) in vals.iter().enumerate() {
+            self.bind(frame + i, val.clone());
+        }
+        Term::new(Arc::from(st), frame)
+    }
+
+    /// Builds a proper list of terms.
+    pub fn list(&mut self, items: &[Term<'ns>]) -> Term<'ns> {
+        self.build(term::list_of_vars(items.len()), items)
+    }
+
+    /// Gets the unbound variables of a term, in order of first appearance.
+    pub fn vars(&self, term: &Term<'ns>) -> Vec<usize> {
+        let mut map = HashMap::new();
+        self.resolve_into(term, &mut map, &mut Vec::new());
+        let mut vars: Vec<_> = map.into_iter().collect();
+        vars.sort_by_key(|&(_, i)| i);
+        vars.into_iter().map(|(var, _)| var).collect()
+    }
+
+    /// Marks the current position of the trail.
+    pub fn mark(&self) -> Mark {
+        Mark {
+            trail: self.trail.len(),
+            vars: self.vals.len(),
+        }
+    }
+
+    /// Reverts every change to the bindings made since the mark, and frees
+    /// the variables allocated since.
+    ///
+    /// Terms in the freed frames must not be used after this.
+    pub fn undo(&mut self, mark: Mark) {
+        while self.trail.len() > mark.trail {
+            let (var, old) = self.trail.pop().unwrap();
+            self.vals[var] = old;
+        }
+        self.vals.truncate(mark.vars);
+    }
+
+    /// Returns true if a term contains itself through its bindings.
+    pub fn is_cyclic(&self, term: &Term<'ns>) -> bool {
+        let mut active = HashSet::new();
+        let mut stack = vec![(term.clone(), None)];
+        while let Some((term, done)) = stack.pop() {
+            if let Some(chain) = done {
+                for var in chain {
+                    active.remove(&var);
+                }
+                continue;
+            }
+            let mut chain = Vec::new();
+            let term = self.walk(&term, &mut chain);
+            if chain.iter().any(|var| active.contains(var)) {
+                return true;
+            }
+            if term.arity() != 0 {
+                let args = term.args();
+                active.extend(chain.iter().cloned());
+                stack.push((term, Some(chain)));
+                stack.extend(args.into_iter().rev().map(|arg| (arg, None)));
+            }
+        }
+        false
+    }
+
+    /// Substitutes the bindings into a term, producing a new `Structure`.
+    ///
+    /// Unbound variables are renumbered in order of their first appearance.
+    ///
+    /// A cyclic term is cut where it first reenters itself. The variable
+    /// through which it reenters is left in its place, as if it were unbound.
+    /// Thus `X = f(X)` resolves to `f(_0) = f(f(_0))`.
+    pub fn resolve(&self, term: &Term<'ns>) -> Box<Structure<'ns>> {
+        let mut buf = Vec::new();
+        self.resolve_into(term, &mut HashMap::new(), &mut buf);
+        unsafe { Structure::from_vec(buf) }
+    }
+
+    /// Substitutes the bindings into a term, numbering each unbound variable
+    /// by its age, i.e. the order in which it was allocated.
+    ///
+    /// Unlike `resolve`, the numbering does not depend on the term, so the
+    /// results for different terms may be compared by the standard order. The
+    /// numbers may be large, so the result is not meant to be renamed.
+    pub fn resolve_by_age(&self, term: &Term<'ns>) -> Box<Structure<'ns>> {
+        let mut vars = HashMap::new();
+        let mut buf = Vec::new();
+        self.resolve_into(term, &mut vars, &mut buf);
+        let ages: HashMap<_, _> = vars.into_iter().map(|(var, n)| (n, var)).collect();
+        for sym in buf.iter_mut() {
+            if let Symbol::Var(n) = *sym {
+                *sym = Symbol::Var(ages[&n]);
+            }
+        }
+        unsafe { Structure::from_vec(buf) }
+    }
+
+    /// Appends the postfix symbols of a resolved term to a buffer.
+    ///
+    /// Unbound variables are numbered according to `vars`, which maps the
+    /// variables of the bindings to those of the buffer. New variables are
+    /// added to the map as they are found.
+    pub fn resolve_into(
+        &self,
+        term: &Term<'ns>,
+        vars: &mut HashMap<usize, usize>,
+        buf: &mut Vec<Symbol<'ns>>,
+    ) {
+        // The bound variables through which the compound terms on the path
+        // to the current term were reached. Reaching one of these again
+        // closes a cycle.
+        let mut active = HashSet::new();
+
+        let mut stack = vec![(term.clone(), None)];
+        while let Some((term, done)) = stack.pop() {
+            if let Some(chain) = done {
+                for var in chain {
+                    active.remove(&var);
+                }
+                buf.push(term.functor());
+                continue;
+            }
+            let mut chain = Vec::new();
+            let term = self.walk(&term, &mut chain);
+            let cycle = chain.iter().cloned().find(|var| active.contains(var));
+            match (cycle, term.functor()) {
+                (Some(n), _) | (None, Symbol::Var(n)) => {
+                    let next = vars.len();
+                    buf.push(Symbol::Var(*vars.entry(n).or_insert(next)));
+                },
+                (None, sym) if sym.arity() == 0 => buf.push(sym),
+                (None, _) => {
+                    let args = term.args();
+                    active.extend(chain.iter().cloned());
+                    stack.push((term, Some(chain)));
+                    stack.extend(args.into_iter().rev().map(|arg| (arg, None)));
+                },
+            }
+        }
+    }
+}
+
+// Private helpers
+// --------------------------------------------------
+
+impl<'ns> Bindings<'ns> {
+    /// Changes the value of a variable, recording the old value on the trail.
+    fn set(&mut self, var: usize, val: Option<Term<'ns>>) {
+        let old = mem::replace(&mut self.vals[var], val);
+        self.trail.push((var, old));
+    }
+
+    /// Follows the bindings of a term without compressing the path. The bound
+    /// variables along the way are pushed onto `chain`.
+    fn walk(&self, term: &Term<'ns>, chain: &mut Vec<usize>) -> Term<'ns> {
+        let mut term = term.clone();
+        while let Symbol::Var(n) = term.functor() {
+            match self.vals[n] {
+                Some(ref val) => {
+                    chain.push(n);
+                    term = val.clone();
+                },
+                None => break,
+            }
+        }
+        term
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use engine::unify::unify;
+    use syntax::namespace::NameSpace;
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+    use super::*;
+
+    #[test]
+    fn undo() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "f(A, B, C, D). a. b. c. d.";
+        let parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        let mut bindings = Bindings::new();
+        let mut terms = Vec::new();
+        for clause in parser {
+            terms.push(bindings.rename(Arc::from(clause.unwrap())));
+        }
+        let vars = terms[0].args();
+        let var = |i: usize| match vars[i].functor() {
+            Symbol::Var(n) => n,
+            _ => unreachable!(),
+        };
+
+        bindings.bind(var(0), terms[1].clone());
+        bindings.bind(var(1), vars[0].clone());
+        let mark = bindings.mark();
+        bindings.bind(var(2), terms[3].clone());
+        bindings.bind(var(3), vars[1].clone());
+
+        // The chain D = B = A = a is followed to the end.
+        let a = Symbol::Funct(0, ns.name("a"));
+        let c = Symbol::Funct(0, ns.name("c"));
+        assert_eq!(bindings.lookup(var(3)).unwrap().functor(), a);
+        assert_eq!(bindings.lookup(var(2)).unwrap().functor(), c);
+        assert_eq!(bindings.resolve(&terms[0]).as_slice(), &[
+            a,
+            a,
+            c,
+            a,
+            Symbol::Funct(4, ns.name("f")),
+        ]);
+
+        // Only the bindings made after the mark are removed.
+        bindings.undo(mark);
+        assert_eq!(bindings.lookup(var(1)).unwrap().functor(), a);
+        assert!(bindings.lookup(var(2)).is_none());
+        assert!(bindings.lookup(var(3)).is_none());
+        assert_eq!(bindings.resolve(&terms[0]).as_slice(), &[
+            a,
+            a,
+            Symbol::Var(0),
+            Symbol::Var(1),
+            Symbol::Funct(4, ns.name("f")),
+        ]);
+
+        // Variables allocated after the mark are freed, so repeatedly
+        // allocating and undoing does not grow the bindings.
+        for _ in 0..3 {
+            let term = bindings.rename(Arc::from(terms[0].structure().to_owned()));
+            assert!(unify(&term, &terms[0], &mut bindings));
+            bindings.undo(mark);
+            assert_eq!(bindings.mark(), mark);
+        }
+    }
+
+    #[test]
+    fn cyclic() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "X = f(X, Y, g(Y)). a.";
+        let parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        let mut bindings = Bindings::new();
+        let mut terms = Vec::new();
+        for clause in parser {
+            terms.push(bindings.rename(Arc::from(clause.unwrap())));
+        }
+        let args = terms[0].args();
+        let (x, fx) = (&args[0], &args[1]);
+        let y = match fx.args()[1].functor() {
+            Symbol::Var(n) => n,
+            _ => unreachable!(),
+        };
+
+        // Shared subterms are not cycles.
+        bindings.bind(y, terms[1].clone());
+        assert!(!bindings.is_cyclic(&terms[0]));
+
+        // Binding X to a term containing X closes a cycle.
+        let var = match x.functor() {
+            Symbol::Var(n) => n,
+            _ => unreachable!(),
+        };
+        bindings.bind(var, fx.clone());
+        assert!(bindings.is_cyclic(x));
+        assert!(bindings.is_cyclic(&terms[0]));
+
+        // Resolving the term ends where the cycle reenters.
+        let a = Symbol::Funct(0, ns.name("a"));
+        let f = Symbol::Funct(3, ns.name("f"));
+        let g = Symbol::Funct(1, ns.name("g"));
+        assert_eq!(bindings.resolve(x).as_slice(), &[Symbol::Var(0), a, a, g, f]);
+    }
+}
@@ -0,0 +1,1092 @@
+use std::cmp::Ordering;
+use std::char;
+use std::collections::HashMap;
+use std::i64;
+use std::sync::Arc;
+
+use ordered_float::OrderedFloat;
+
+use arith::{self, Number};
+use engine::error::{self, Result};
+use engine::order;
+use engine::solver::Solver;
+use engine::term::{self, Term};
+use engine::unify::unify;
+use syntax::{Structure, Symbol};
+use syntax::flags::Dialect;
+use syntax::lexer::{Lexer, Token};
+use syntax::namespace::NameSpace;
+use syntax::parser::Parser;
+use syntax::writer::{format_float, Writer};
+
+/// A built-in predicate.
+///
+/// A built-in receives the arguments of a goal and returns false on failure.
+/// Any bindings made by a failing built-in are undone by the solver. Errors
+/// are thrown as error terms. Nondeterministic built-ins leave their other
+/// solutions with `Solver::alternatives`.
+pub type Builtin = for<'a, 'ns> fn(&mut Solver<'a, 'ns>, &[Term<'ns>]) -> Result<'ns, bool>;
+
+/// Gets the built-in predicate with the given name and arity, if any.
+pub fn get(name: &str, arity: usize) -> Option<Builtin> {
+    let builtin: Builtin = match (name, arity) {
+        ("=", 2) => unify_2,
+        ("\\=", 2) => not_unify_2,
+        ("==", 2) => equal_2,
+        ("\\==", 2) => not_equal_2,
+        ("@<", 2) => term_lt_2,
+        ("@=<", 2) => term_le_2,
+        ("@>", 2) => term_gt_2,
+        ("@>=", 2) => term_ge_2,
+        ("compare", 3) => compare_3,
+        ("=@=", 2) => variant_2,
+        ("\\=@=", 2) => not_variant_2,
+        ("is", 2) => is_2,
+        ("=:=", 2) => arith_eq_2,
+        ("=\\=", 2) => arith_ne_2,
+        ("<", 2) => arith_lt_2,
+        ("=<", 2) => arith_le_2,
+        (">", 2) => arith_gt_2,
+        (">=", 2) => arith_ge_2,
+        ("between", 3) => between_3,
+        ("succ", 2) => succ_2,
+        ("length", 2) => length_2,
+        ("msort", 2) => msort_2,
+        ("keysort", 2) => keysort_2,
+        ("atom_chars", 2) => atom_chars_2,
+        ("atom_codes", 2) => atom_codes_2,
+        ("char_code", 2) => char_code_2,
+        ("number_codes", 2) => number_codes_2,
+        ("atom_number", 2) => atom_number_2,
+        ("atom_concat", 3) => atom_concat_3,
+        ("sub_atom", 5) => sub_atom_5,
+        ("atomic_list_concat", 2) => atomic_list_concat_2,
+        ("atomic_list_concat", 3) => atomic_list_concat_3,
+        ("write", 1) => write_1,
+        ("print", 1) | ("writeq", 1) => writeq_1,
+        ("writeln", 1) => writeln_1,
+        ("write_canonical", 1) => write_canonical_1,
+        ("write_term", 2) => write_term_2,
+        ("nl", 0) => nl_0,
+        ("term_to_atom", 2) => term_to_atom_2,
+        ("read_term_from_atom", 3) => read_term_from_atom_3,
+        ("format", 1) => format_1,
+        ("format", 2) => format_2,
+        _ => return None,
+    };
+    Some(builtin)
+}
+
+// Unification
+// --------------------------------------------------
+
+fn unify_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(unify(&args[0], &args[1], solver.bindings()))
+}
+
+fn not_unify_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    let bindings = solver.bindings();
+    let mark = bindings.mark();
+    let ok = unify(&args[0], &args[1], bindings);
+    bindings.undo(mark);
+    Ok(!ok)
+}
+
+// Term Comparison
+// --------------------------------------------------
+
+fn equal_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(compare_terms(solver, &args[0], &args[1]) == Ordering::Equal)
+}
+
+fn not_equal_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(compare_terms(solver, &args[0], &args[1]) != Ordering::Equal)
+}
+
+fn term_lt_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(compare_terms(solver, &args[0], &args[1]) == Ordering::Less)
+}
+
+fn term_le_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(compare_terms(solver, &args[0], &args[1]) != Ordering::Greater)
+}
+
+fn term_gt_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(compare_terms(solver, &args[0], &args[1]) == Ordering::Greater)
+}
+
+fn term_ge_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(compare_terms(solver, &args[0], &args[1]) != Ordering::Less)
+}
+
+fn compare_3<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    let order = solver.bindings().deref(&args[0]);
+    match order.functor() {
+        Symbol::Var(_) => (),
+        Symbol::Funct(0, name) if ["<", "=", ">"].contains(&name.as_str()) => (),
+        Symbol::Funct(0, _) => {
+            return Err(error::domain_error(solver.ns(), "order", order.structure()));
+        },
+        _ => return Err(error::type_error(solver.ns(), "atom", order.structure())),
+    }
+    let name = match compare_terms(solver, &args[1], &args[2]) {
+        Ordering::Less => "<",
+        Ordering::Equal => "=",
+        Ordering::Greater => ">",
+    };
+    let name = Term::atomic(Symbol::Funct(0, solver.ns().name(name)));
+    Ok(unify(&order, &name, solver.bindings()))
+}
+
+fn variant_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(is_variant(solver, &args[0], &args[1]))
+}
+
+fn not_variant_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(!is_variant(solver, &args[0], &args[1]))
+}
+
+/// Compares two terms by the standard order.
+///
+/// Unbound variables are ordered by age, i.e. the order in which they were
+/// allocated by the bindings, so that the order is consistent between calls.
+fn compare_terms<'a, 'ns>(solver: &mut Solver<'a, 'ns>, a: &Term<'ns>, b: &Term<'ns>) -> Ordering {
+    let bindings = solver.bindings();
+    order::compare(&bindings.resolve_by_age(a), &bindings.resolve_by_age(b))
+}
+
+/// Returns true if two terms are equal up to a renaming of their variables.
+fn is_variant<'a, 'ns>(solver: &mut Solver<'a, 'ns>, a: &Term<'ns>, b: &Term<'ns>) -> bool {
+    let x = solver.bindings().resolve(a);
+    let y = solver.bindings().resolve(b);
+    // Variables are numbered by first appearance within each term, so two
+    // variants resolve to identical structures.
+    x == y
+}
+
+// Arithmetic
+// --------------------------------------------------
+
+fn is_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    let val = eval(solver, &args[1])?;
+    Ok(unify(&args[0], &Term::atomic(val.to_symbol()), solver.bindings()))
+}
+
+fn arith_eq_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(compare(solver, args)? == Some(Ordering::Equal))
+}
+
+fn arith_ne_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    match compare(solver, args)? {
+        Some(Ordering::Equal) | None => Ok(false),
+        _ => Ok(true),
+    }
+}
+
+fn arith_lt_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(compare(solver, args)? == Some(Ordering::Less))
+}
+
+fn arith_le_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    match compare(solver, args)? {
+        Some(Ordering::Less) | Some(Ordering::Equal) => Ok(true),
+        _ => Ok(false),
+    }
+}
+
+fn arith_gt_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    Ok(compare(solver, args)? == Some(Ordering::Greater))
+}
+
+fn arith_ge_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    match compare(solver, args)? {
+        Some(Ordering::Greater) | Some(Ordering::Equal) => Ok(true),
+        _ => Ok(false),
+    }
+}
+
+// Integer Relations
+// --------------------------------------------------
+
+fn between_3<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    let low = int_arg(solver, &args[0])?;
+    let high = match solver.bindings().deref(&args[1]).functor() {
+        Symbol::Funct(0, name) if name.as_str() == "inf" || name.as_str() == "infinite" => {
+            Some(i64::MAX)
+        },
+        _ => int_arg(solver, &args[1])?,
+    };
+    let (low, high) = match (low, high) {
+        (Some(low), Some(high)) => (low, high),
+        _ => return Err(error::instantiation_error(solver.ns())),
+    };
+    match int_arg(solver, &args[2])? {
+        Some(x) => Ok(low <= x && x <= high),
+        None if high < low => Ok(false),
+        None => {
+            // The range stops at `high` without stepping past it, which would
+            // overflow when `high` is the largest integer.
+            let x = args[2].clone();
+            let alts = (low..high)
+                .chain(Some(high))
+                .map(move |i| vec![(x.clone(), term::atomic(Symbol::Int(i)))]);
+            Ok(solver.alternatives(alts))
+        },
+    }
+}
+
+fn succ_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    let x = nat_arg(solver, &args[0])?;
+    let y = nat_arg(solver, &args[1])?;
+    let (term, val) = match (x, y) {
+        (Some(i64::MAX), _) => return Err(error::representation_error(solver.ns(), "max_integer")),
+        (Some(x), _) => (&args[1], x + 1),
+        (None, Some(0)) => return Ok(false),
+        (None, Some(y)) => (&args[0], y - 1),
+        (None, None) => return Err(error::instantiation_error(solver.ns())),
+    };
+    Ok(unify(term, &Term::atomic(Symbol::Int(val)), solver.bindings()))
+}
+
+// Lists
+// --------------------------------------------------
+
+fn length_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    let n = match int_arg(solver, &args[1])? {
+        Some(n) if n < 0 => {
+            let culprit = term::atomic(Symbol::Int(n));
+            return Err(error::domain_error(solver.ns(), "not_less_than_zero", &culprit));
+        },
+        n => n,
+    };
+
+    // Count the cells of the list up to its tail.
+    let mut count = 0;
+    let mut tail = solver.bindings().deref(&args[0]);
+    loop {
+        match tail.functor() {
+            Symbol::List(true, 0) => {
+                let len = Term::atomic(Symbol::Int(count));
+                return Ok(unify(&args[1], &len, solver.bindings()));
+            },
+            Symbol::List(false, 2) => {
+                tail = solver.bindings().deref(&tail.args()[1]);
+                count += 1;
+            },
+            Symbol::Var(_) => break,
+            _ => return Ok(false),
+        }
+    }
+
+    // The list is partial. Extend it to the given length, or to every length
+    // on backtracking.
+    match n {
+        Some(n) if n < count => Ok(false),
+        Some(n) => {
+            let vars = term::list_of_vars((n - count) as usize);
+            let vars = solver.bindings().rename(Arc::from(vars));
+            Ok(unify(&tail, &vars, solver.bindings()))
+        },
+        None => {
+            let len = args[1].clone();
+            let alts = (0..).map(move |i| {
+                vec![
+                    (tail.clone(), term::list_of_vars(i)),
+                    (len.clone(), term::atomic(Symbol::Int(count + i as i64))),
+                ]
+            });
+            Ok(solver.alternatives(alts))
+        },
+    }
+}
+
+fn msort_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    sort_list(solver, args, false)
+}
+
+fn keysort_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    sort_list(solver, args, true)
+}
+
+/// Sorts a list by the standard order of terms, or a list of `Key-Value`
+/// pairs by their keys. The sort is stable, so equal elements keep their
+/// relative order, and duplicates are retained.
+fn sort_list<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    args: &[Term<'ns>],
+    by_key: bool,
+) -> Result<'ns, bool> {
+    let items = solver.list_items(&args[0])?;
+    // Variables are ordered by age, as by `compare/3`.
+    let resolved: Vec<_> = items.iter()
+        .map(|item| solver.bindings().resolve_by_age(item))
+        .collect();
+    let mut keys: Vec<&Structure<'ns>> = resolved.iter().map(|st| &**st).collect();
+    if by_key {
+        for (i, key) in keys.iter_mut().enumerate() {
+            match key.functor() {
+                Symbol::Funct(2, name) if name.as_str() == "-" => *key = key.args()[0],
+                Symbol::Var(_) => return Err(error::instantiation_error(solver.ns())),
+                _ => {
+                    let culprit = solver.bindings().resolve(&items[i]);
+                    return Err(error::type_error(solver.ns(), "pair", &culprit));
+                },
+            }
+        }
+    }
+    let mut indices: Vec<_> = (0..items.len()).collect();
+    indices.sort_by(|&i, &j| order::compare(keys[i], keys[j]));
+    let sorted: Vec<_> = indices.into_iter().map(|i| items[i].clone()).collect();
+    let sorted = solver.bindings().list(&sorted);
+    Ok(unify(&args[1], &sorted, solver.bindings()))
+}
+
+// Atoms and Text
+// --------------------------------------------------
+
+fn atom_chars_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    atom_text(solver, args, false)
+}
+
+fn atom_codes_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    atom_text(solver, args, true)
+}
+
+/// Converts between an atom and a list of its characters or codes.
+fn atom_text<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    args: &[Term<'ns>],
+    codes: bool,
+) -> Result<'ns, bool> {
+    if let Some(name) = atom_arg(solver, &args[0])? {
+        let list = text_list(solver, name, codes);
+        return Ok(unify(&args[1], &Term::new(Arc::from(list), 0), solver.bindings()));
+    }
+    match list_text(solver, &args[1], codes)? {
+        Some(text) => {
+            let atom = Term::atomic(Symbol::Funct(0, solver.ns().name(text)));
+            Ok(unify(&args[0], &atom, solver.bindings()))
+        },
+        None => Err(error::instantiation_error(solver.ns())),
+    }
+}
+
+fn char_code_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    if let Some(ch) = char_arg(solver, &args[0])? {
+        let code = Term::atomic(Symbol::Int(ch as i64));
+        return Ok(unify(&args[1], &code, solver.bindings()));
+    }
+    match int_arg(solver, &args[1])? {
+        Some(code) => {
+            let ch = code_to_char(solver, code)?;
+            let ch = Term::atomic(Symbol::Funct(0, solver.ns().name(ch.to_string())));
+            Ok(unify(&args[0], &ch, solver.bindings()))
+        },
+        None => Err(error::instantiation_error(solver.ns())),
+    }
+}
+
+fn number_codes_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    // The list takes priority when both arguments are bound.
+    if let Some(text) = list_text(solver, &args[1], true)? {
+        return match parse_number(&text, solver.ns()) {
+            Some(sym) => Ok(unify(&args[0], &Term::atomic(sym), solver.bindings())),
+            None => Err(error::syntax_error(solver.ns(), "illegal_number")),
+        };
+    }
+    let text = number_text(solver, &args[0])?;
+    let list = text_list(solver, &text, true);
+    Ok(unify(&args[1], &Term::new(Arc::from(list), 0), solver.bindings()))
+}
+
+fn atom_number_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    if let Some(name) = atom_arg(solver, &args[0])? {
+        return match parse_number(name, solver.ns()) {
+            Some(sym) => Ok(unify(&args[1], &Term::atomic(sym), solver.bindings())),
+            None => Ok(false),
+        };
+    }
+    let text = number_text(solver, &args[1])?;
+    let atom = Term::atomic(Symbol::Funct(0, solver.ns().name(text)));
+    Ok(unify(&args[0], &atom, solver.bindings()))
+}
+
+fn atom_concat_3<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    let a = text_arg(solver, &args[0])?;
+    let b = text_arg(solver, &args[1])?;
+    if let (Some(a), Some(b)) = (a, b) {
+        let atom = Term::atomic(Symbol::Funct(0, solver.ns().name(a + &b)));
+        return Ok(unify(&args[2], &atom, solver.bindings()));
+    }
+
+    // Split the whole atom at every character boundary.
+    let whole = match text_arg(solver, &args[2])? {
+        Some(whole) => whole,
+        None => return Err(error::instantiation_error(solver.ns())),
+    };
+    let ns = solver.ns();
+    let (x, y) = (args[0].clone(), args[1].clone());
+    let mut bounds: Vec<_> = whole.char_indices().map(|(i, _)| i).collect();
+    bounds.push(whole.len());
+    let alts = bounds.into_iter().map(move |i| {
+        vec![
+            (x.clone(), term::atomic(Symbol::Funct(0, ns.name(&whole[..i])))),
+            (y.clone(), term::atomic(Symbol::Funct(0, ns.name(&whole[i..])))),
+        ]
+    });
+    Ok(solver.alternatives(alts))
+}
+
+fn sub_atom_5<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    let chars: Vec<char> = match text_arg(solver, &args[0])? {
+        Some(text) => text.chars().collect(),
+        None => return Err(error::instantiation_error(solver.ns())),
+    };
+    let before = nat_arg(solver, &args[1])?;
+    let len = nat_arg(solver, &args[2])?;
+    let after = nat_arg(solver, &args[3])?;
+    let sub: Option<Vec<char>> = text_arg(solver, &args[4])?.map(|sub| sub.chars().collect());
+
+    // Enumerate the substrings consistent with the bound arguments.
+    let n = chars.len();
+    let ns = solver.ns();
+    let args = args.to_vec();
+    let alts = (0..n + 1)
+        .flat_map(move |b| (0..n - b + 1).map(move |l| (b, l)))
+        .filter(move |&(b, l)| {
+            let a = n - b - l;
+            before.map(|x| x == b as i64).unwrap_or(true) &&
+                len.map(|x| x == l as i64).unwrap_or(true) &&
+                after.map(|x| x == a as i64).unwrap_or(true)
+        })
+        .filter_map(move |(b, l)| {
+            if let Some(ref sub) = sub {
+                if &chars[b..b + l] != &sub[..] {
+                    return None;
+                }
+            }
+            let text: String = chars[b..b + l].iter().cloned().collect();
+            Some(vec![
+                (args[1].clone(), term::atomic(Symbol::Int(b as i64))),
+                (args[2].clone(), term::atomic(Symbol::Int(l as i64))),
+                (args[3].clone(), term::atomic(Symbol::Int((n - b - l) as i64))),
+                (args[4].clone(), term::atomic(Symbol::Funct(0, ns.name(text)))),
+            ])
+        });
+    Ok(solver.alternatives(alts))
+}
+
+fn atomic_list_concat_2<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    args: &[Term<'ns>],
+) -> Result<'ns, bool> {
+    match join_text(solver, &args[0], "")? {
+        Some(text) => {
+            let atom = Term::atomic(Symbol::Funct(0, solver.ns().name(text)));
+            Ok(unify(&args[1], &atom, solver.bindings()))
+        },
+        None => Err(error::instantiation_error(solver.ns())),
+    }
+}
+
+/// Joins a list of atomic terms with a separator or, if the list is not
+/// ground, splits an atom on the separator into a list of atoms.
+fn atomic_list_concat_3<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    args: &[Term<'ns>],
+) -> Result<'ns, bool> {
+    let sep = match text_arg(solver, &args[1])? {
+        Some(sep) => sep,
+        None => return Err(error::instantiation_error(solver.ns())),
+    };
+    if let Some(text) = join_text(solver, &args[0], &sep)? {
+        let atom = Term::atomic(Symbol::Funct(0, solver.ns().name(text)));
+        return Ok(unify(&args[2], &atom, solver.bindings()));
+    }
+
+    let whole = match text_arg(solver, &args[2])? {
+        Some(whole) => whole,
+        None => return Err(error::instantiation_error(solver.ns())),
+    };
+    if sep.is_empty() {
+        let culprit = term::atomic(Symbol::Funct(0, solver.ns().name(sep)));
+        return Err(error::domain_error(solver.ns(), "non_empty_atom", &culprit));
+    }
+    let ns = solver.ns();
+    let parts = whole.split(sep.as_str()).map(|part| Symbol::Funct(0, ns.name(part))).collect();
+    let list = term::list_of_atomics(parts);
+    Ok(unify(&args[0], &Term::new(Arc::from(list), 0), solver.bindings()))
+}
+
+/// Joins the text of a list of atomic terms with a separator. Returns `None`
+/// if the list is partial or any of its elements are unbound.
+fn join_text<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    list: &Term<'ns>,
+    sep: &str,
+) -> Result<'ns, Option<String>> {
+    let list = solver.bindings().resolve(list);
+    let (elems, tail) = list.list_elements();
+    match tail.functor() {
+        Symbol::List(true, 0) => (),
+        Symbol::Var(_) => return Ok(None),
+        _ => return Err(error::type_error(solver.ns(), "list", &list)),
+    }
+    let mut text = String::new();
+    for (i, elem) in elems.into_iter().enumerate() {
+        if i > 0 {
+            text.push_str(sep);
+        }
+        match elem.functor() {
+            Symbol::Funct(0, name) => text.push_str(name.as_str()),
+            Symbol::List(true, 0) => text.push_str("[]"),
+            Symbol::Str(s) => text.push_str(s),
+            Symbol::Int(i) => text.push_str(&i.to_string()),
+            Symbol::Float(f) => text.push_str(&format_float(f.0)),
+            Symbol::Var(_) => return Ok(None),
+            _ => return Err(error::type_error(solver.ns(), "atomic", elem)),
+        }
+    }
+    Ok(Some(text))
+}
+
+/// Gets the text of an atomic argument, or `None` if it is unbound.
+///
+/// In the ISO dialect, the argument must be an atom. Otherwise, numbers and
+/// strings are taken as the atoms of their text.
+fn text_arg<'a, 'ns>(solver: &mut Solver<'a, 'ns>, arg: &Term<'ns>) -> Result<'ns, Option<String>> {
+    let arg = solver.bindings().deref(arg);
+    let iso = solver.flags().dialect == Dialect::Iso;
+    match arg.functor() {
+        Symbol::Funct(0, name) => Ok(Some(name.as_str().to_string())),
+        Symbol::List(true, 0) => Ok(Some("[]".to_string())),
+        Symbol::Var(_) => Ok(None),
+        Symbol::Int(_) | Symbol::Float(_) if !iso => number_text(solver, &arg).map(Some),
+        Symbol::Str(text) if !iso => Ok(Some(text.to_string())),
+        _ => {
+            let kind = if iso { "atom" } else { "atomic" };
+            Err(error::type_error(solver.ns(), kind, &solver.bindings().resolve(&arg)))
+        },
+    }
+}
+
+/// Gets the name of an atom argument, or `None` if it is unbound.
+fn atom_arg<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    arg: &Term<'ns>,
+) -> Result<'ns, Option<&'ns str>> {
+    let arg = solver.bindings().deref(arg);
+    match arg.functor() {
+        Symbol::Funct(0, name) => Ok(Some(name.as_str())),
+        Symbol::List(true, 0) => Ok(Some("[]")),
+        Symbol::Var(_) => Ok(None),
+        _ => Err(error::type_error(solver.ns(), "atom", &solver.bindings().resolve(&arg))),
+    }
+}
+
+/// Gets the character of a one-character atom argument, or `None` if it is
+/// unbound.
+fn char_arg<'a, 'ns>(solver: &mut Solver<'a, 'ns>, arg: &Term<'ns>) -> Result<'ns, Option<char>> {
+    let arg = solver.bindings().deref(arg);
+    if let Symbol::Funct(0, name) = arg.functor() {
+        let mut chars = name.as_str().chars();
+        if let (Some(ch), None) = (chars.next(), chars.next()) {
+            return Ok(Some(ch));
+        }
+    }
+    match arg.functor() {
+        Symbol::Var(_) => Ok(None),
+        _ => Err(error::type_error(solver.ns(), "character", &solver.bindings().resolve(&arg))),
+    }
+}
+
+/// Gets the text of a number argument, as it would be written.
+fn number_text<'a, 'ns>(solver: &mut Solver<'a, 'ns>, arg: &Term<'ns>) -> Result<'ns, String> {
+    let arg = solver.bindings().deref(arg);
+    match arg.functor() {
+        Symbol::Int(i) => Ok(i.to_string()),
+        Symbol::Float(f) => Ok(format_float(f.0)),
+        Symbol::Var(_) => Err(error::instantiation_error(solver.ns())),
+        _ => Err(error::type_error(solver.ns(), "number", &solver.bindings().resolve(&arg))),
+    }
+}
+
+/// Converts a character code to a character.
+fn code_to_char<'a, 'ns>(solver: &mut Solver<'a, 'ns>, code: i64) -> Result<'ns, char> {
+    if 0 <= code && code <= u32::max_value() as i64 {
+        if let Some(ch) = char::from_u32(code as u32) {
+            return Ok(ch);
+        }
+    }
+    Err(error::representation_error(solver.ns(), "character_code"))
+}
+
+/// Returns the list of the characters or character codes of some text.
+fn text_list<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    text: &str,
+    codes: bool,
+) -> Box<Structure<'ns>> {
+    let ns = solver.ns();
+    let syms = text.chars()
+        .map(|ch| if codes {
+            Symbol::Int(ch as i64)
+        } else {
+            Symbol::Funct(0, ns.name(ch.to_string()))
+        })
+        .collect();
+    term::list_of_atomics(syms)
+}
+
+/// Gets the text of a list of characters or character codes, or `None` if the
+/// list is partial or any of its elements are unbound. A string is accepted in
+/// place of the list.
+fn list_text<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    list: &Term<'ns>,
+    codes: bool,
+) -> Result<'ns, Option<String>> {
+    let list = solver.bindings().resolve(list);
+    if let Symbol::Str(text) = list.functor() {
+        return Ok(Some(text.to_string()));
+    }
+    let (elems, tail) = list.list_elements();
+    match tail.functor() {
+        Symbol::List(true, 0) => (),
+        Symbol::Var(_) => return Ok(None),
+        _ => return Err(error::type_error(solver.ns(), "list", &list)),
+    }
+    let mut text = String::new();
+    for elem in elems {
+        match (elem.functor(), codes) {
+            (Symbol::Var(_), _) => return Ok(None),
+            (Symbol::Int(code), true) => text.push(code_to_char(solver, code)?),
+            (Symbol::Funct(0, name), false) if name.as_str().chars().count() == 1 => {
+                text.push_str(name.as_str())
+            },
+            (_, true) => return Err(error::representation_error(solver.ns(), "character_code")),
+            (_, false) => return Err(error::type_error(solver.ns(), "character", elem)),
+        }
+    }
+    Ok(Some(text))
+}
+
+/// Reads text as a number, as it would be written in a program. A leading
+/// minus sign is allowed. Returns `None` if the text is not a number.
+fn parse_number<'ns>(text: &str, ns: &'ns NameSpace) -> Option<Symbol<'ns>> {
+    let mut lexer = Lexer::new(text.as_bytes(), ns);
+    let (neg, tok) = match lexer.next() {
+        Some(Token::Funct(_, _, name)) if name.as_str() == "-" => (true, lexer.next()),
+        tok => (false, tok),
+    };
+    let sym = match (neg, tok) {
+        (false, Some(Token::Int(_, _, i))) => Symbol::Int(i),
+        (true, Some(Token::Int(_, _, i))) => Symbol::Int(-i),
+        (false, Some(Token::Float(_, _, f))) => Symbol::Float(OrderedFloat(f)),
+        (true, Some(Token::Float(_, _, f))) => Symbol::Float(OrderedFloat(-f)),
+        _ => return None,
+    };
+    match lexer.next() {
+        None => Some(sym),
+        Some(_) => None,
+    }
+}
+
+// Output
+// --------------------------------------------------
+
+/// Options for writing a term, as given to `write_term/2`.
+#[derive(Default)]
+struct WriteOpts {
+    quoted: bool,
+    ignore_ops: bool,
+    max_depth: usize,
+}
+
+fn write_1<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    write_opts(solver, &args[0], WriteOpts::default())?;
+    Ok(true)
+}
+
+fn writeq_1<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    let opts = WriteOpts { quoted: true, ..WriteOpts::default() };
+    write_opts(solver, &args[0], opts)?;
+    Ok(true)
+}
+
+fn writeln_1<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    write_opts(solver, &args[0], WriteOpts::default())?;
+    emit(solver, "\n")?;
+    Ok(true)
+}
+
+fn write_canonical_1<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    args: &[Term<'ns>],
+) -> Result<'ns, bool> {
+    let opts = WriteOpts { quoted: true, ignore_ops: true, ..WriteOpts::default() };
+    write_opts(solver, &args[0], opts)?;
+    Ok(true)
+}
+
+fn write_term_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    let mut opts = WriteOpts::default();
+    for opt in solver.list_items(&args[1])? {
+        let opt = solver.bindings().resolve(&opt);
+        let (name, arg) = match opt.functor() {
+            Symbol::Funct(1, name) => (name.as_str(), opt.args()[0].functor()),
+            Symbol::Var(_) => return Err(error::instantiation_error(solver.ns())),
+            _ => return Err(error::domain_error(solver.ns(), "write_option", &opt)),
+        };
+        match (name, arg) {
+            (_, Symbol::Var(_)) => return Err(error::instantiation_error(solver.ns())),
+            ("quoted", Symbol::Funct(0, val)) if val.as_str() == "true" => opts.quoted = true,
+            ("quoted", Symbol::Funct(0, val)) if val.as_str() == "false" => opts.quoted = false,
+            ("ignore_ops", Symbol::Funct(0, val)) if val.as_str() == "true" => {
+                opts.ignore_ops = true
+            },
+            ("ignore_ops", Symbol::Funct(0, val)) if val.as_str() == "false" => {
+                opts.ignore_ops = false
+            },
+            ("max_depth", Symbol::Int(n)) if 0 <= n => opts.max_depth = n as usize,
+            _ => return Err(error::domain_error(solver.ns(), "write_option", &opt)),
+        }
+    }
+    write_opts(solver, &args[0], opts)?;
+    Ok(true)
+}
+
+fn nl_0<'a, 'ns>(solver: &mut Solver<'a, 'ns>, _: &[Term<'ns>]) -> Result<'ns, bool> {
+    emit(solver, "\n")?;
+    Ok(true)
+}
+
+fn term_to_atom_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    if let Some(text) = text_arg(solver, &args[1])? {
+        let term = read_text(solver, &text)?;
+        return Ok(unify(&args[0], &term, solver.bindings()));
+    }
+    let opts = WriteOpts { quoted: true, ..WriteOpts::default() };
+    let text = term_text(solver, &args[0], opts);
+    let atom = Term::atomic(Symbol::Funct(0, solver.ns().name(text)));
+    Ok(unify(&args[1], &atom, solver.bindings()))
+}
+
+/// Reads a term from the text of an atom. The options are ignored.
+fn read_term_from_atom_3<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    args: &[Term<'ns>],
+) -> Result<'ns, bool> {
+    match text_arg(solver, &args[0])? {
+        Some(text) => {
+            let term = read_text(solver, &text)?;
+            Ok(unify(&args[1], &term, solver.bindings()))
+        },
+        None => Err(error::instantiation_error(solver.ns())),
+    }
+}
+
+/// Reads text as a single term, using the operators of the solver. The
+/// variables of the term are fresh.
+fn read_text<'a, 'ns>(solver: &mut Solver<'a, 'ns>, text: &str) -> Result<'ns, Term<'ns>> {
+    let ns = solver.ns();
+    let ops = solver.ops().clone();
+    let st = match Parser::new(text.as_bytes(), ns, &ops).read_term() {
+        // The parser ties its output to the lifetime of the operators. The
+        // names are those of the solver, so they are rekeyed for its lifetime.
+        Ok(st) => st.rekey(&HashMap::new(), ns),
+        Err(err) => return Err(error::syntax_error(ns, &err.to_string())),
+    };
+    Ok(solver.bindings().rename(Arc::from(st)))
+}
+
+fn format_1<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    let text = format(solver, &args[0], vec![])?;
+    emit(solver, &text)?;
+    Ok(true)
+}
+
+fn format_2<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+    // A single argument need not be wrapped in a list.
+    let items = match solver.bindings().deref(&args[1]).functor() {
+        Symbol::List(..) => solver.list_items(&args[1])?,
+        _ => vec![args[1].clone()],
+    };
+    let text = format(solver, &args[0], items)?;
+    emit(solver, &text)?;
+    Ok(true)
+}
+
+/// Renders a format string with its arguments, as SWI-Prolog's `format/2`.
+///
+/// The supported directives are `~w`, `~p`, `~q`, `~a`, `~d`, `~f`, `~s`,
+/// `~c`, `~n`, and `~~`, and the column directives `~t`, `~|`, and `~+`. A
+/// numeric argument may be given in the directive, e.g. `~2d`, or taken from
+/// the arguments with `*`, e.g. `~*c`. Padding at a column stop is inserted at
+/// the first fill point, `~t`, of the column, or else at its end.
+fn format<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    fmt: &Term<'ns>,
+    args: Vec<Term<'ns>>,
+) -> Result<'ns, String> {
+    let fmt = match atom_arg(solver, fmt) {
+        Ok(Some(name)) => name.to_string(),
+        _ => match list_text(solver, fmt, true)? {
+            Some(text) => text,
+            None => return Err(error::instantiation_error(solver.ns())),
+        },
+    };
+    let mut args = args.into_iter();
+    let mut out = String::new();
+    let mut column_start = 0;
+    let mut fills: Vec<(usize, char)> = Vec::new();
+
+    let mut chars = fmt.chars().peekable();
+    while let Some(ch) = chars.next() {
+        if ch != '~' {
+            out.push(ch);
+            continue;
+        }
+
+        // Read the numeric argument, if any.
+        let mut num = None;
+        if chars.peek() == Some(&'*') {
+            chars.next();
+            let arg = next_arg(solver, &mut args)?;
+            match nat_arg(solver, &arg)? {
+                Some(n) => num = Some(n as usize),
+                None => return Err(error::instantiation_error(solver.ns())),
+            }
+        } else if chars.peek() == Some(&'`') {
+            chars.next();
+            num = chars.next().map(|ch| ch as usize);
+        } else {
+            while let Some(d) = chars.peek().and_then(|ch| ch.to_digit(10)) {
+                chars.next();
+                num = Some(num.unwrap_or(0) * 10 + d as usize);
+            }
+        }
+
+        let directive = match chars.next() {
+            Some(directive) => directive,
+            None => return Err(error::format_error(solver.ns(), "truncated format")),
+        };
+        match directive {
+            'w' | 'p' | 'q' => {
+                let arg = next_arg(solver, &mut args)?;
+                let opts = WriteOpts { quoted: directive != 'w', ..WriteOpts::default() };
+                out.push_str(&term_text(solver, &arg, opts));
+            },
+            'a' => {
+                let arg = next_arg(solver, &mut args)?;
+                match text_arg(solver, &arg)? {
+                    Some(text) => out.push_str(&text),
+                    None => return Err(error::instantiation_error(solver.ns())),
+                }
+            },
+            'd' => {
+                let arg = next_arg(solver, &mut args)?;
+                let i = match int_arg(solver, &arg)? {
+                    Some(i) => i,
+                    None => return Err(error::instantiation_error(solver.ns())),
+                };
+                out.push_str(&fixed_point(i, num.unwrap_or(0)));
+            },
+            'f' => {
+                let arg = next_arg(solver, &mut args)?;
+                let x = match solver.bindings().deref(&arg).functor() {
+                    Symbol::Int(i) => i as f64,
+                    Symbol::Float(f) => f.0,
+                    Symbol::Var(_) => return Err(error::instantiation_error(solver.ns())),
+                    _ => {
+                        let culprit = solver.bindings().resolve(&arg);
+                        return Err(error::type_error(solver.ns(), "number", &culprit));
+                    },
+                };
+                out.push_str(&format!("{:.*}", num.unwrap_or(6), x));
+            },
+            's' => {
+                let arg = next_arg(solver, &mut args)?;
+                match list_text(solver, &arg, true)? {
+                    Some(text) => out.push_str(&text),
+                    None => return Err(error::instantiation_error(solver.ns())),
+                }
+            },
+            'c' => {
+                let arg = next_arg(solver, &mut args)?;
+                let ch = match int_arg(solver, &arg)? {
+                    Some(code) => code_to_char(solver, code)?,
+                    None => return Err(error::instantiation_error(solver.ns())),
+                };
+                for _ in 0..num.unwrap_or(1) {
+                    out.push(ch);
+                }
+            },
+            'n' => {
+                for _ in 0..num.unwrap_or(1) {
+                    out.push('\n');
+                }
+            },
+            '~' => out.push('~'),
+            't' => {
+                let fill = num.and_then(|n| char::from_u32(n as u32)).unwrap_or(' ');
+                fills.push((out.len(), fill));
+            },
+            '|' | '+' => {
+                let line_start = out.rfind('\n').map(|i| i + 1).unwrap_or(0);
+                let col = out[line_start..].chars().count();
+                let start_col = if column_start < line_start {
+                    0
+                } else {
+                    out[line_start..column_start].chars().count()
+                };
+                let target = match directive {
+                    '|' => num.unwrap_or(col),
+                    _ => start_col + num.unwrap_or(8),
+                };
+                if col < target {
+                    let (pos, fill) = fills.first().cloned().unwrap_or((out.len(), ' '));
+                    let pad: String = (col..target).map(|_| fill).collect();
+                    out.insert_str(pos, &pad);
+                }
+                column_start = out.len();
+                fills.clear();
+            },
+            _ => return Err(error::format_error(solver.ns(), "unknown directive")),
+        }
+    }
+
+    if args.next().is_some() {
+        return Err(error::format_error(solver.ns(), "too many arguments"));
+    }
+    Ok(out)
+}
+
+/// Takes the next argument of a format string.
+fn next_arg<'a, 'ns, I>(solver: &mut Solver<'a, 'ns>, args: &mut I) -> Result<'ns, Term<'ns>>
+where
+    I: Iterator<Item = Term<'ns>>,
+{
+    match args.next() {
+        Some(arg) => Ok(arg),
+        None => Err(error::format_error(solver.ns(), "not enough arguments")),
+    }
+}
+
+/// Writes an integer with a decimal point inserted `n` digits from the right,
+/// as by `~Nd`.
+fn fixed_point(i: i64, n: usize) -> String {
+    if n == 0 {
+        return i.to_string();
+    }
+    let mut digits = i.to_string();
+    if i < 0 {
+        digits.remove(0);
+    }
+    while digits.len() <= n {
+        digits.insert(0, '0');
+    }
+    let point = digits.len() - n;
+    digits.insert(point, '.');
+    if i < 0 {
+        digits.insert(0, '-');
+    }
+    digits
+}
+
+/// Writes a term to the output stream of the solver.
+fn write_opts<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    term: &Term<'ns>,
+    opts: WriteOpts,
+) -> Result<'ns, ()> {
+    let text = term_text(solver, term, opts);
+    emit(solver, &text)
+}
+
+/// Renders a term as text.
+fn term_text<'a, 'ns>(solver: &mut Solver<'a, 'ns>, term: &Term<'ns>, opts: WriteOpts) -> String {
+    let mut st = solver.bindings().resolve(term);
+    if opts.max_depth != 0 {
+        let mut buf = Vec::with_capacity(st.len());
+        let ellipsis = Symbol::Funct(0, solver.ns().name("..."));
+        truncate(&st, opts.max_depth, ellipsis, &mut buf);
+        st = unsafe { Structure::from_vec(buf) };
+    }
+    Writer::new(solver.ops())
+        .quoted(opts.quoted)
+        .ignore_ops(opts.ignore_ops)
+        .to_string(&st)
+}
+
+/// Copies a structure into a buffer, replacing the subterms nested deeper
+/// than `depth` with an ellipsis.
+///
+/// As in SWI-Prolog, each element of a list is one level deeper than the
+/// last, so only the first `depth - 1` elements of a list are kept.
+fn truncate<'ns>(
+    st: &Structure<'ns>,
+    depth: usize,
+    ellipsis: Symbol<'ns>,
+    buf: &mut Vec<Symbol<'ns>>,
+) {
+    let cell = st.functor() == Symbol::List(false, 2);
+    if depth == 0 || (depth == 1 && cell) {
+        buf.push(ellipsis);
+        return;
+    }
+    for arg in st.args() {
+        truncate(arg, depth - 1, ellipsis, buf);
+    }
+    buf.push(st.functor());
+}
+
+/// Writes text to the output stream of the solver.
+fn emit<'a, 'ns>(solver: &mut Solver<'a, 'ns>, text: &str) -> Result<'ns, ()> {
+    match solver.output_stream().write_all(text.as_bytes()) {
+        Ok(()) => Ok(()),
+        Err(_) => {
+            let stream = term::atomic(Symbol::Funct(0, solver.ns().name("user_output")));
+            Err(error::permission_error(solver.ns(), "output", "stream", &stream))
+        },
+    }
+}
+
+/// Gets the value of an integer argument, or `None` if it is unbound.
+fn int_arg<'a, 'ns>(solver: &mut Solver<'a, 'ns>, arg: &Term<'ns>) -> Result<'ns, Option<i64>> {
+    let arg = solver.bindings().deref(arg);
+    match arg.functor() {
+        Symbol::Int(i) => Ok(Some(i)),
+        Symbol::Var(_) => Ok(None),
+        _ => Err(error::type_error(solver.ns(), "integer", &solver.bindings().resolve(&arg))),
+    }
+}
+
+/// Gets the value of a non-negative integer argument, or `None` if it is
+/// unbound.
+fn nat_arg<'a, 'ns>(solver: &mut Solver<'a, 'ns>, arg: &Term<'ns>) -> Result<'ns, Option<i64>> {
+    match int_arg(solver, arg)? {
+        Some(i) if i < 0 => {
+            let culprit = term::atomic(Symbol::Int(i));
+            Err(error::type_error(solver.ns(), "not_less_than_zero", &culprit))
+        },
+        val => Ok(val),
+    }
+}
+
+/// Evaluates a term as an arithmetic expression.
+fn eval<'a, 'ns>(solver: &mut Solver<'a, 'ns>, term: &Term<'ns>) -> Result<'ns, Number> {
+    let expr = solver.bindings().resolve(term);
+    arith::eval(&expr).map_err(|err| error::from_eval(solver.ns(), &err))
+}
+
+/// Evaluates two arithmetic expressions and compares their values. The
+/// comparison is `None` if either value is NaN.
+fn compare<'a, 'ns>(
+    solver: &mut Solver<'a, 'ns>,
+    args: &[Term<'ns>],
+) -> Result<'ns, Option<Ordering>> {
+    let a = eval(solver, &args[0])?;
+    let b = eval(solver, &args[1])?;
+    Ok(a.compare(b))
+}
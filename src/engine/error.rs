@@ -0,0 +1,176 @@
+//! Constructors for the ISO error terms.
+//!
+//! Errors in Prolog are ordinary terms of the form `error(Formal, Context)`,
+//! thrown by built-in predicates and caught with `catch/3`. The formal term
+//! describes the error, e.g. `type_error(integer, foo)`. The context is left
+//! unbound.
+
+use arith::EvalError;
+use engine::term;
+use syntax::{Structure, Symbol};
+use syntax::namespace::NameSpace;
+
+/// A type alias for results which may throw an error term.
+pub type Result<'ns, T> = ::std::result::Result<T, Box<Structure<'ns>>>;
+
+/// `error(instantiation_error, _)`: an argument is unbound.
+pub fn instantiation_error<'ns>(ns: &'ns NameSpace) -> Box<Structure<'ns>> {
+    error(ns, vec![atom(ns, "instantiation_error")])
+}
+
+/// `error(type_error(Type, Culprit), _)`: an argument has the wrong type.
+pub fn type_error<'ns>(
+    ns: &'ns NameSpace,
+    kind: &str,
+    culprit: &Structure<'ns>,
+) -> Box<Structure<'ns>> {
+    let mut formal = vec![atom(ns, kind)];
+    formal.extend_from_slice(culprit);
+    formal.push(Symbol::Funct(2, ns.name("type_error")));
+    error(ns, formal)
+}
+
+/// `error(domain_error(Domain, Culprit), _)`: an argument has the right type
+/// but the wrong value.
+pub fn domain_error<'ns>(
+    ns: &'ns NameSpace,
+    domain: &str,
+    culprit: &Structure<'ns>,
+) -> Box<Structure<'ns>> {
+    let mut formal = vec![atom(ns, domain)];
+    formal.extend_from_slice(culprit);
+    formal.push(Symbol::Funct(2, ns.name("domain_error")));
+    error(ns, formal)
+}
+
+/// `error(existence_error(Kind, Culprit), _)`: the culprit does not exist,
+/// e.g. `existence_error(procedure, foo/2)`.
+pub fn existence_error<'ns>(
+    ns: &'ns NameSpace,
+    kind: &str,
+    culprit: &Structure<'ns>,
+) -> Box<Structure<'ns>> {
+    let mut formal = vec![atom(ns, kind)];
+    formal.extend_from_slice(culprit);
+    formal.push(Symbol::Funct(2, ns.name("existence_error")));
+    error(ns, formal)
+}
+
+/// `error(permission_error(Action, Type, Culprit), _)`: the action is not
+/// permitted on the culprit, e.g. `permission_error(modify, static_procedure,
+/// foo/2)`.
+pub fn permission_error<'ns>(
+    ns: &'ns NameSpace,
+    action: &str,
+    kind: &str,
+    culprit: &Structure<'ns>,
+) -> Box<Structure<'ns>> {
+    let mut formal = vec![atom(ns, action), atom(ns, kind)];
+    formal.extend_from_slice(culprit);
+    formal.push(Symbol::Funct(3, ns.name("permission_error")));
+    error(ns, formal)
+}
+
+/// `error(evaluation_error(Error), _)`: an arithmetic function is undefined
+/// for its arguments, e.g. `evaluation_error(zero_divisor)`.
+pub fn evaluation_error<'ns>(ns: &'ns NameSpace, err: &str) -> Box<Structure<'ns>> {
+    error(ns, vec![atom(ns, err), Symbol::Funct(1, ns.name("evaluation_error"))])
+}
+
+/// `error(representation_error(Limit), _)`: a value cannot be represented,
+/// e.g. `representation_error(max_integer)`.
+pub fn representation_error<'ns>(ns: &'ns NameSpace, limit: &str) -> Box<Structure<'ns>> {
+    error(ns, vec![atom(ns, limit), Symbol::Funct(1, ns.name("representation_error"))])
+}
+
+/// `error(resource_error(Resource), _)`: some resource is exhausted.
+pub fn resource_error<'ns>(ns: &'ns NameSpace, resource: &str) -> Box<Structure<'ns>> {
+    error(ns, vec![atom(ns, resource), Symbol::Funct(1, ns.name("resource_error"))])
+}
+
+/// `error(syntax_error(What), _)`: text cannot be read as a term, e.g.
+/// `syntax_error(illegal_number)`.
+pub fn syntax_error<'ns>(ns: &'ns NameSpace, what: &str) -> Box<Structure<'ns>> {
+    error(ns, vec![atom(ns, what), Symbol::Funct(1, ns.name("syntax_error"))])
+}
+
+/// `error(format(Message), _)`: a format string does not match its
+/// arguments, as thrown by `format/2`.
+pub fn format_error<'ns>(ns: &'ns NameSpace, msg: &str) -> Box<Structure<'ns>> {
+    error(ns, vec![atom(ns, msg), Symbol::Funct(1, ns.name("format"))])
+}
+
+/// Converts an arithmetic error into the corresponding error term.
+pub fn from_eval<'ns>(ns: &'ns NameSpace, err: &EvalError) -> Box<Structure<'ns>> {
+    match *err {
+        EvalError::Instantiation => instantiation_error(ns),
+        EvalError::NotEvaluable(ref name, arity) => {
+            type_error(ns, "evaluable", &indicator(ns, name, arity))
+        },
+        EvalError::NotInteger(n) => type_error(ns, "integer", &term::atomic(n.to_symbol())),
+        EvalError::ZeroDivisor => evaluation_error(ns, "zero_divisor"),
+        EvalError::Undefined => evaluation_error(ns, "undefined"),
+        EvalError::IntOverflow => evaluation_error(ns, "int_overflow"),
+        EvalError::FloatOverflow => evaluation_error(ns, "float_overflow"),
+    }
+}
+
+/// Returns the predicate indicator `Name/Arity`.
+pub fn indicator<'ns>(ns: &'ns NameSpace, name: &str, arity: usize) -> Box<Structure<'ns>> {
+    let syms = vec![atom(ns, name), Symbol::Int(arity as i64), Symbol::Funct(2, ns.name("/"))];
+    unsafe { Structure::from_vec(syms) }
+}
+
+fn atom<'ns>(ns: &'ns NameSpace, name: &str) -> Symbol<'ns> {
+    Symbol::Funct(0, ns.name(name))
+}
+
+/// Wraps the symbols of a formal term as `error(Formal, _)`.
+fn error<'ns>(ns: &'ns NameSpace, mut formal: Vec<Symbol<'ns>>) -> Box<Structure<'ns>> {
+    let context = unsafe { term::var_count(Structure::from_slice(&formal)) };
+    formal.push(Symbol::Var(context));
+    formal.push(Symbol::Funct(2, ns.name("error")));
+    unsafe { Structure::from_vec(formal) }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::operators::OpTable;
+    use syntax::writer::Writer;
+    use super::*;
+
+    #[test]
+    fn structure() {
+        let ns = NameSpace::new();
+        let err = from_eval(&ns, &EvalError::NotEvaluable("foo".to_string(), 0));
+        assert_eq!(err.as_slice(), &[
+            Symbol::Funct(0, ns.name("evaluable")),
+            Symbol::Funct(0, ns.name("foo")),
+            Symbol::Int(0),
+            Symbol::Funct(2, ns.name("/")),
+            Symbol::Funct(2, ns.name("type_error")),
+            Symbol::Var(0),
+            Symbol::Funct(2, ns.name("error")),
+        ]);
+
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+        let culprit = indicator(&ns, "foo", 2);
+        let errors = vec![
+            instantiation_error(&ns),
+            existence_error(&ns, "procedure", &culprit),
+            permission_error(&ns, "modify", "static_procedure", &culprit),
+            from_eval(&ns, &EvalError::ZeroDivisor),
+        ];
+        let errors: Vec<_> = errors.iter().map(|err| writer.to_string(err)).collect();
+        assert_eq!(errors, vec![
+            "error(instantiation_error,_0)",
+            "error(existence_error(procedure,foo/2),_0)",
+            "error(permission_error(modify,static_procedure,foo/2),_0)",
+            "error(evaluation_error(zero_divisor),_0)",
+        ]);
+    }
+}
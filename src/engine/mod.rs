@@ -0,0 +1,25 @@
+//! The machinery for solving logic programs.
+//!
+//! The parser produces [`Structure`]s whose variables are numbered from zero.
+//! Before a structure takes part in a proof, its variables are renamed apart
+//! by placing it in a fresh frame of [`Bindings`]. The result is a [`Term`],
+//! a reference to some subterm of a shared structure along with the frame
+//! which gives meaning to its variables.
+//!
+//! [`Structure`]: ../syntax/struct.Structure.html
+//! [`Bindings`]: ./struct.Bindings.html
+//! [`Term`]: ./struct.Term.html
+
+pub mod error;
+mod bindings;
+mod builtins;
+mod order;
+mod solver;
+mod term;
+mod unify;
+
+pub use self::bindings::{Bindings, Mark};
+pub use self::builtins::Builtin;
+pub use self::solver::{Alternative, Solver};
+pub use self::term::{instantiate, Term};
+pub use self::unify::unify;
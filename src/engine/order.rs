@@ -0,0 +1,103 @@
+use std::cmp::Ordering;
+
+use syntax::{Structure, Symbol};
+
+/// Compares two structures by the standard order of terms.
+///
+/// Variables precede numbers, which precede atoms, which precede strings,
+/// which precede compound terms. Variables are ordered by their number.
+/// Numbers are ordered by value, and a float precedes an integer of equal
+/// value. Atoms are ordered alphabetically. Compound terms are ordered by
+/// arity, then by name, then by their arguments from left to right.
+///
+/// The empty list is ordered as the atom `[]`, and list cells as compound
+/// terms named `'.'`.
+pub fn compare(a: &Structure, b: &Structure) -> Ordering {
+    let (mut a, mut b) = (a, b);
+    loop {
+        let (x, y) = (a.functor(), b.functor());
+        let ord = rank(x).cmp(&rank(y)).then_with(|| compare_roots(x, y));
+        if ord != Ordering::Equal || x.arity() == 0 {
+            return ord;
+        }
+
+        // Compare all but the last argument recursively, then loop on the
+        // last argument, so that long lists do not overflow the stack.
+        let (xs, ys) = (a.args(), b.args());
+        let n = xs.len();
+        for i in 0..n - 1 {
+            let ord = compare(xs[i], ys[i]);
+            if ord != Ordering::Equal {
+                return ord;
+            }
+        }
+        a = xs[n - 1];
+        b = ys[n - 1];
+    }
+}
+
+/// Ranks the kinds of terms in the standard order.
+fn rank(sym: Symbol) -> u8 {
+    match sym {
+        Symbol::Var(_) => 0,
+        Symbol::Int(_) | Symbol::Float(_) => 1,
+        Symbol::Funct(0, _) | Symbol::List(true, 0) => 2,
+        Symbol::Str(_) => 3,
+        Symbol::Funct(..) | Symbol::List(..) => 4,
+    }
+}
+
+/// Compares the roots of two terms of the same rank.
+fn compare_roots(x: Symbol, y: Symbol) -> Ordering {
+    match (x, y) {
+        (Symbol::Var(a), Symbol::Var(b)) => a.cmp(&b),
+        (Symbol::Int(a), Symbol::Int(b)) => a.cmp(&b),
+        (Symbol::Float(a), Symbol::Float(b)) => a.cmp(&b),
+        (Symbol::Int(a), Symbol::Float(b)) => {
+            let ord = (a as f64).partial_cmp(&b.into_inner());
+            ord.unwrap_or(Ordering::Less).then(Ordering::Greater)
+        },
+        (Symbol::Float(a), Symbol::Int(b)) => {
+            let ord = a.into_inner().partial_cmp(&(b as f64));
+            ord.unwrap_or(Ordering::Greater).then(Ordering::Less)
+        },
+        (Symbol::Str(a), Symbol::Str(b)) => a.cmp(b),
+        (x, y) => x.arity().cmp(&y.arity()).then_with(|| name(x).cmp(name(y))),
+    }
+}
+
+/// Gets the name of an atom or compound term.
+fn name<'ns>(sym: Symbol<'ns>) -> &'ns str {
+    match sym {
+        Symbol::Funct(_, name) => name.as_str(),
+        Symbol::List(true, 0) => "[]",
+        Symbol::List(..) => ".",
+        _ => unreachable!(),
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::namespace::NameSpace;
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+    use super::*;
+
+    #[test]
+    fn standard_order() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "f(X, Y, 1.0, 1, 2, [], a, b, \"s\", g(a), [a], f(a, b), f(b, a), X).";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        let st = parser.next().unwrap().unwrap();
+        let terms = st.args();
+        for i in 0..terms.len() - 2 {
+            assert_eq!(compare(terms[i], terms[i + 1]), Ordering::Less);
+            assert_eq!(compare(terms[i + 1], terms[i]), Ordering::Greater);
+        }
+        assert_eq!(compare(terms[0], terms[terms.len() - 1]), Ordering::Equal);
+    }
+}
@@ -0,0 +1,1800 @@
+use std::borrow::Cow;
+use std::cell::{Cell, RefCell};
+use std::cmp::Ordering;
+use std::collections::HashMap;
+use std::io::{self, Write};
+use std::iter::Peekable;
+use std::mem;
+use std::rc::Rc;
+use std::sync::Arc;
+use std::usize;
+
+use db::{check_clause, dcg, ClauseError, DataBase, Rule};
+use engine::bindings::{Bindings, Mark};
+use engine::builtins::{self, Builtin};
+use engine::error::{self, Result};
+use engine::order;
+use engine::term::{self, Term};
+use engine::unify::unify;
+use syntax::{Structure, Symbol};
+use syntax::flags::{Flags, Unknown};
+use syntax::namespace::{Name, NameSpace};
+use syntax::operators::OpTable;
+
+/// Solves a query against a `DataBase` by SLD resolution.
+///
+/// A `Solver` is an iterator over the solutions to a query. Each solution is
+/// the query with its variables substituted by their bindings. Goals are
+/// solved depth-first, left to right, and clauses are tried in the order
+/// they appear in the database.
+///
+/// Errors are thrown as error terms. An error which is not caught ends the
+/// iteration.
+///
+/// The database may be changed by the query, using `assertz/1` and friends.
+/// Changes follow the logical update view: a call to a predicate only sees
+/// the clauses which existed when the call began.
+///
+/// The depth of the proof and the number of solutions may be limited, so that
+/// a program which never terminates cannot hang its host.
+pub struct Solver<'a, 'ns: 'a> {
+    db: &'a mut DataBase<'ns>,
+    ns: &'ns NameSpace,
+    flags: Flags,
+    natives: HashMap<(Name<'ns>, usize), Builtin>,
+    ops: Cow<'a, OpTable<'ns>>,
+    output: Box<Write + 'a>,
+    bindings: Bindings<'ns>,
+    query: Term<'ns>,
+    goals: Goals<'ns>,
+    choices: Vec<Choice<'ns>>,
+    fresh: bool,
+    depth: usize,
+    max_depth: usize,
+    solutions: usize,
+    max_solutions: usize,
+}
+
+/// A list of goals to be solved, in order.
+///
+/// Lists of goals share their tails, so a choice point can save the goals
+/// remaining at the time it was created without copying them.
+type Goals<'ns> = Option<Rc<Goal<'ns>>>;
+
+/// A goal and the goals which follow it.
+///
+/// The depth of a goal is the number of predicate calls between it and the
+/// query.
+struct Goal<'ns> {
+    act: Act<'ns>,
+    depth: usize,
+    next: Goals<'ns>,
+}
+
+/// The action to be taken for a goal.
+enum Act<'ns> {
+    /// Solve a term.
+    ///
+    /// The cut barrier is the height of the choice stack when the predicate
+    /// whose body contains the term was called. Cutting removes every choice
+    /// point above the barrier.
+    Call(Term<'ns>, usize),
+
+    /// Remove every choice point above a height, then fail.
+    ///
+    /// This follows the goal of a negation, `\+ Goal`. If the goal succeeds,
+    /// the negation fails without trying the goal again.
+    CutFail(usize),
+
+    /// Remove every choice point above a height.
+    ///
+    /// This follows the condition of an if-then-else, `Cond -> Then ; Else`.
+    /// Once the condition succeeds, neither it nor the else branch is tried
+    /// again.
+    CutTo(usize),
+
+    /// Leave the condition of a soft-cut, `Cond *-> Then ; Else`, whose else
+    /// branch is at the given height.
+    ///
+    /// The else branch is deactivated, but the choice points of the condition
+    /// remain, so that each of its solutions is tried.
+    SoftCut(usize, Rc<Cell<bool>>),
+
+    /// Add a solution to a bag, then fail to find the next.
+    Gather(Rc<Bag<'ns>>),
+
+    /// Leave the goal of `catch/3`, whose catcher is at the given height.
+    ///
+    /// The catcher is deactivated, so that it cannot catch errors thrown
+    /// after the goal. If the goal left choice points, it is reactivated when
+    /// backtracking into the goal.
+    ExitCatch(usize, Rc<Cell<bool>>),
+}
+
+/// A point in the proof to which the solver may backtrack.
+struct Choice<'ns> {
+    mark: Mark,
+    depth: usize,
+    goals: Goals<'ns>,
+    alt: Alt<'ns>,
+}
+
+/// The alternatives remaining at a choice point.
+enum Alt<'ns> {
+    /// The remaining rules for a call to a predicate.
+    Rules(Term<'ns>, Vec<Rule<'ns>>, usize),
+
+    /// The remaining rules for a call to `retract/1`.
+    Retract(Term<'ns>, Term<'ns>, Vec<Rule<'ns>>, usize),
+
+    /// Succeed with the saved goals.
+    ///
+    /// This precedes the goal of a negation, `\+ Goal`. If the goal fails,
+    /// the negation succeeds.
+    Succeed,
+
+    /// The right branch of a disjunction, its cut barrier, and whether it is
+    /// active.
+    ///
+    /// This precedes the left branch. The branch is only deactivated by a
+    /// soft-cut whose condition has succeeded.
+    Else(Term<'ns>, usize, Rc<Cell<bool>>),
+
+    /// Unify the result of an all-solutions predicate with the solutions
+    /// gathered in a bag.
+    ///
+    /// This precedes the goal of the predicate, and is reached once the goal
+    /// has no more solutions.
+    Collect(Rc<Bag<'ns>>),
+
+    /// The catcher and recovery goal of a call to `catch/3`, and whether the
+    /// catcher is active.
+    ///
+    /// This precedes the goal of `catch/3`. It is skipped when backtracking,
+    /// but serves as the target when unwinding the choice stack after an
+    /// error is thrown.
+    Catch(Term<'ns>, Term<'ns>, Rc<Cell<bool>>),
+
+    /// Reactivate the catcher of a call to `catch/3`, then keep backtracking.
+    ///
+    /// This is left when the goal of `catch/3` exits with choice points.
+    Reenter(Rc<Cell<bool>>),
+
+    /// The remaining alternatives of a nondeterministic built-in.
+    Builtin(Peekable<Alternatives<'ns>>),
+
+    /// The remaining groups of solutions for `bagof/3` or `setof/3`.
+    Groups(Rc<Bag<'ns>>, Vec<Vec<Box<Structure<'ns>>>>, usize),
+}
+
+/// An alternative solution of a nondeterministic built-in.
+///
+/// Each term is paired with a structure to unify with it. Each structure is
+/// placed in a fresh frame before unification.
+pub type Alternative<'ns> = Vec<(Term<'ns>, Box<Structure<'ns>>)>;
+
+/// A lazy sequence of alternatives.
+type Alternatives<'ns> = Box<Iterator<Item = Alternative<'ns>> + 'ns>;
+
+/// The solutions gathered by an all-solutions predicate.
+///
+/// Each solution is a copy of the pair `[Witness|Template]`, where the witness
+/// is the list of free variables of the goal. For `findall/3` the witness is
+/// always empty.
+///
+/// Each copy is paired with a key by which solutions are sorted. The key is
+/// numbered as if the solutions were copied in turn: the variables of each are
+/// renumbered by age, apart from those of every other solution. Distinct
+/// variables never compare equal, and those of later solutions sort after
+/// those of earlier ones.
+struct Bag<'ns> {
+    kind: BagKind,
+    witness: Term<'ns>,
+    pair: Term<'ns>,
+    result: Term<'ns>,
+    next: Cell<usize>,
+    items: RefCell<Vec<(Box<Structure<'ns>>, Box<Structure<'ns>>)>>,
+}
+
+/// The kinds of all-solutions predicates.
+#[derive(Clone, Copy)]
+#[derive(PartialEq, Eq)]
+enum BagKind {
+    Findall,
+    Bagof,
+    Setof,
+}
+
+// Public API
+// --------------------------------------------------
+
+impl<'a, 'ns> Solver<'a, 'ns> {
+    /// Constructs a `Solver` for a query against a database.
+    ///
+    /// The namespace is used to name any new atoms created by the solver.
+    pub fn new(
+        db: &'a mut DataBase<'ns>,
+        ns: &'ns NameSpace,
+        query: &Structure<'ns>,
+    ) -> Solver<'a, 'ns> {
+        let mut bindings = Bindings::new();
+        let query = bindings.rename(Arc::from(query.to_owned()));
+        let goals = Some(Rc::new(Goal {
+            act: Act::Call(query.clone(), 0),
+            depth: 0,
+            next: None,
+        }));
+        Solver {
+            db: db,
+            ns: ns,
+            flags: Flags::default(),
+            natives: HashMap::new(),
+            ops: Cow::Owned(OpTable::default(ns)),
+            output: Box::new(io::stdout()),
+            bindings: bindings,
+            query: query,
+            goals: goals,
+            choices: Vec::new(),
+            fresh: true,
+            depth: 0,
+            max_depth: usize::MAX,
+            solutions: 0,
+            max_solutions: usize::MAX,
+        }
+    }
+
+    /// Sets the flags which affect built-in predicates.
+    ///
+    /// By default, the flags are those of SWI-Prolog, whose built-ins are more
+    /// lenient than ISO, e.g. accepting numbers where atoms are expected.
+    pub fn with_flags(mut self, flags: Flags) -> Self {
+        self.flags = flags;
+        self
+    }
+
+    /// Sets the operators used by built-ins which write terms.
+    ///
+    /// By default, the operators are those of `OpTable::default`.
+    pub fn with_ops(mut self, ops: &'a OpTable<'ns>) -> Self {
+        self.ops = Cow::Borrowed(ops);
+        self
+    }
+
+    /// Sets the stream written by output built-ins like `write/1`.
+    ///
+    /// By default, output is written to stdout.
+    pub fn output<W: Write + 'a>(mut self, w: W) -> Self {
+        self.output = Box::new(w);
+        self
+    }
+
+    /// Registers a native predicate, implemented in Rust.
+    ///
+    /// Native predicates take precedence over the built-ins and the clauses
+    /// of the database. They follow the same conventions as the built-ins.
+    pub fn register(mut self, name: &str, arity: usize, builtin: Builtin) -> Self {
+        self.natives.insert((self.ns.name(name), arity), builtin);
+        self
+    }
+
+    /// Limits the depth of the proof.
+    ///
+    /// The depth of a goal is the number of predicate calls between it and the
+    /// query. Calling a goal deeper than the limit throws
+    /// `resource_error(max_depth)`, which may be caught like any other error.
+    /// By default, the depth is unlimited.
+    pub fn max_depth(mut self, depth: usize) -> Self {
+        self.max_depth = depth;
+        self
+    }
+
+    /// Limits the number of solutions.
+    ///
+    /// Once the limit is reached, looking for another solution ends the
+    /// iteration with `resource_error(max_solutions)`, unless there are no
+    /// more solutions. By default, the number of solutions is unlimited.
+    pub fn max_solutions(mut self, n: usize) -> Self {
+        self.max_solutions = n;
+        self
+    }
+
+    /// Gets the bindings of the solver.
+    ///
+    /// This is intended for built-in predicates, which are given the solver.
+    pub fn bindings(&mut self) -> &mut Bindings<'ns> {
+        &mut self.bindings
+    }
+
+    /// Gets the namespace of the solver.
+    pub fn ns(&self) -> &'ns NameSpace {
+        self.ns
+    }
+
+    /// Gets the flags of the solver.
+    pub fn flags(&self) -> &Flags {
+        &self.flags
+    }
+
+    /// Gets the operators of the solver.
+    pub fn ops(&self) -> &OpTable<'ns> {
+        &self.ops
+    }
+
+    /// Gets the output stream of the solver.
+    pub fn output_stream(&mut self) -> &mut Write {
+        &mut *self.output
+    }
+
+    /// Gets the items of a proper list.
+    ///
+    /// Throws an instantiation error if the list is partial, or a type error
+    /// if it is not a list.
+    pub fn list_items(&mut self, list: &Term<'ns>) -> Result<'ns, Vec<Term<'ns>>> {
+        let mut items = Vec::new();
+        let mut cell = self.bindings.deref(list);
+        loop {
+            match cell.functor() {
+                Symbol::List(true, 0) => return Ok(items),
+                Symbol::List(false, 2) => {
+                    let mut args = cell.args();
+                    cell = self.bindings.deref(&args[1]);
+                    items.push(args.swap_remove(0));
+                },
+                Symbol::Var(_) => return Err(error::instantiation_error(self.ns)),
+                _ => {
+                    let list = self.bindings.resolve(list);
+                    return Err(error::type_error(self.ns, "list", &list));
+                },
+            }
+        }
+    }
+
+    /// Tries a sequence of alternatives until one unifies. A choice point is
+    /// left for the rest. Returns false if none unify.
+    ///
+    /// This is intended for nondeterministic built-in predicates. The
+    /// alternatives are generated lazily, so the sequence may be infinite.
+    pub fn alternatives<I>(&mut self, alts: I) -> bool
+    where
+        I: Iterator<Item = Alternative<'ns>> + 'ns,
+    {
+        let alts: Alternatives<'ns> = Box::new(alts);
+        self.try_alternatives(alts.peekable())
+    }
+}
+
+impl<'a, 'ns> Iterator for Solver<'a, 'ns> {
+    type Item = Result<'ns, Box<Structure<'ns>>>;
+
+    fn next(&mut self) -> Option<Result<'ns, Box<Structure<'ns>>>> {
+        // After a solution, look for the next by backtracking.
+        if !self.fresh && !self.backtrack() {
+            return None;
+        }
+        self.fresh = false;
+
+        loop {
+            let goal = match self.goals.take() {
+                Some(goal) => goal,
+                None => {
+                    if self.solutions == self.max_solutions {
+                        self.choices.clear();
+                        return Some(Err(error::resource_error(self.ns, "max_solutions")));
+                    }
+                    self.solutions += 1;
+                    return Some(Ok(self.bindings.resolve(&self.query)));
+                },
+            };
+            self.goals = goal.next.clone();
+            self.depth = goal.depth;
+            let ok = match goal.act {
+                Act::Call(ref term, cut) => {
+                    let res = if self.max_depth < self.depth {
+                        Err(error::resource_error(self.ns, "max_depth"))
+                    } else {
+                        self.step(term, cut)
+                    };
+                    match res.or_else(|ball| self.throw(ball)) {
+                        Ok(ok) => ok,
+                        Err(ball) => return Some(Err(ball)),
+                    }
+                },
+                Act::CutFail(height) => {
+                    self.choices.truncate(height);
+                    false
+                },
+                Act::CutTo(height) => {
+                    self.choices.truncate(height);
+                    true
+                },
+                Act::SoftCut(height, ref active) => {
+                    if self.choices.len() == height + 1 {
+                        self.choices.pop();
+                    } else {
+                        active.set(false);
+                    }
+                    true
+                },
+                Act::Gather(ref bag) => {
+                    let key = self.bag_key(bag);
+                    bag.items.borrow_mut().push((key, self.bindings.resolve(&bag.pair)));
+                    false
+                },
+                Act::ExitCatch(height, ref active) => {
+                    if self.choices.len() == height + 1 {
+                        self.choices.pop();
+                    } else {
+                        active.set(false);
+                        self.choices.push(Choice {
+                            mark: self.bindings.mark(),
+                            depth: self.depth,
+                            goals: None,
+                            alt: Alt::Reenter(active.clone()),
+                        });
+                    }
+                    true
+                },
+            };
+            if !ok && !self.backtrack() {
+                return None;
+            }
+        }
+    }
+}
+
+// Resolution
+// --------------------------------------------------
+
+impl<'a, 'ns> Solver<'a, 'ns> {
+    /// Takes one step towards solving a goal. Returns false on failure.
+    fn step(&mut self, goal: &Term<'ns>, cut: usize) -> Result<'ns, bool> {
+        let goal = self.bindings.deref(goal);
+        let name = match goal.functor() {
+            Symbol::Funct(_, name) => name,
+            Symbol::Var(_) => return Err(error::instantiation_error(self.ns)),
+            _ => return Err(error::type_error(self.ns, "callable", goal.structure())),
+        };
+        let ok = match (name.as_str(), goal.arity()) {
+            ("true", 0) => true,
+            ("fail", 0) | ("false", 0) => false,
+            ("!", 0) => {
+                self.choices.truncate(cut);
+                true
+            },
+            (",", 2) => {
+                let args = goal.args();
+                self.push(Act::Call(args[1].clone(), cut));
+                self.push(Act::Call(args[0].clone(), cut));
+                true
+            },
+            (";", 2) => self.disjunction(&goal.args(), cut),
+            ("->", 2) => {
+                let args = goal.args();
+                let height = self.choices.len();
+                self.push(Act::Call(args[1].clone(), cut));
+                self.push(Act::CutTo(height));
+                self.push(Act::Call(args[0].clone(), height));
+                true
+            },
+            ("*->", 2) => {
+                let args = goal.args();
+                let height = self.choices.len();
+                self.push(Act::Call(args[1].clone(), cut));
+                self.push(Act::Call(args[0].clone(), height));
+                true
+            },
+            ("\\+", 1) | ("not", 1) => {
+                let height = self.choices.len();
+                self.choices.push(Choice {
+                    mark: self.bindings.mark(),
+                    depth: self.depth,
+                    goals: self.goals.clone(),
+                    alt: Alt::Succeed,
+                });
+                self.push(Act::CutFail(height));
+                self.push(Act::Call(goal.args()[0].clone(), height + 1));
+                true
+            },
+            ("catch", 3) => {
+                let args = goal.args();
+                let height = self.choices.len();
+                let active = Rc::new(Cell::new(true));
+                self.choices.push(Choice {
+                    mark: self.bindings.mark(),
+                    depth: self.depth,
+                    goals: self.goals.clone(),
+                    alt: Alt::Catch(args[1].clone(), args[2].clone(), active.clone()),
+                });
+                self.push(Act::ExitCatch(height, active));
+                self.push(Act::Call(args[0].clone(), height + 1));
+                true
+            },
+            ("throw", 1) => {
+                let ball = self.bindings.deref(&goal.args()[0]);
+                match ball.functor() {
+                    Symbol::Var(_) => return Err(error::instantiation_error(self.ns)),
+                    _ => return Err(self.bindings.resolve(&ball)),
+                }
+            },
+            ("^", 2) => {
+                self.push(Act::Call(goal.args()[1].clone(), cut));
+                true
+            },
+            ("call", n) if 1 <= n && n <= 8 => {
+                let args = goal.args();
+                let goal = self.extend_goal(&args[0], &args[1..])?;
+                let height = self.choices.len();
+                self.push(Act::Call(goal, height));
+                true
+            },
+            ("phrase", 2) | ("phrase", 3) => {
+                let args = goal.args();
+                let rest = match args.get(2) {
+                    Some(rest) => rest.clone(),
+                    None => Term::atomic(Symbol::List(true, 0)),
+                };
+                let goal = self.phrase_goal(&args[0], &args[1], rest)?;
+                let height = self.choices.len();
+                self.push(Act::Call(goal, height));
+                true
+            },
+            ("apply", 2) => {
+                let args = goal.args();
+                let extra = self.list_items(&args[1])?;
+                let goal = self.extend_goal(&args[0], &extra)?;
+                let height = self.choices.len();
+                self.push(Act::Call(goal, height));
+                true
+            },
+            ("assert", 1) | ("assertz", 1) => {
+                let clause = self.clause_arg(&goal.args()[0])?;
+                self.db.assert_clause(&clause);
+                true
+            },
+            ("asserta", 1) => {
+                let clause = self.clause_arg(&goal.args()[0])?;
+                self.db.asserta_clause(&clause);
+                true
+            },
+            ("retract", 1) => self.retract(goal.args()[0].clone())?,
+            ("findall", 3) => self.all_solutions(BagKind::Findall, &goal.args()),
+            ("bagof", 3) => self.all_solutions(BagKind::Bagof, &goal.args()),
+            ("setof", 3) => self.all_solutions(BagKind::Setof, &goal.args()),
+            (_, arity) if self.natives.contains_key(&(name, arity)) => {
+                let native = self.natives[&(name, arity)];
+                native(self, &goal.args())?
+            },
+            (name, arity) => {
+                match builtins::get(name, arity) {
+                    Some(builtin) => builtin(self, &goal.args())?,
+                    None => self.call(goal)?,
+                }
+            },
+        };
+        Ok(ok)
+    }
+
+    /// Begins a disjunction, `Left ; Right`, which may be an if-then-else or
+    /// a soft-cut.
+    ///
+    /// The condition of an if-then-else or soft-cut is opaque to cut. The
+    /// branches are transparent, so that a cut in either cuts the clause.
+    fn disjunction(&mut self, args: &[Term<'ns>], cut: usize) -> bool {
+        let left = self.bindings.deref(&args[0]);
+        let height = self.choices.len();
+        let active = Rc::new(Cell::new(true));
+        self.choices.push(Choice {
+            mark: self.bindings.mark(),
+            depth: self.depth,
+            goals: self.goals.clone(),
+            alt: Alt::Else(args[1].clone(), cut, active.clone()),
+        });
+        match left.functor() {
+            Symbol::Funct(2, name) if name.as_str() == "->" => {
+                let args = left.args();
+                self.push(Act::Call(args[1].clone(), cut));
+                self.push(Act::CutTo(height));
+                self.push(Act::Call(args[0].clone(), height + 1));
+            },
+            Symbol::Funct(2, name) if name.as_str() == "*->" => {
+                let args = left.args();
+                self.push(Act::Call(args[1].clone(), cut));
+                self.push(Act::SoftCut(height, active));
+                self.push(Act::Call(args[0].clone(), height + 1));
+            },
+            _ => self.push(Act::Call(left, cut)),
+        }
+        true
+    }
+
+    /// Unwinds the choice stack to the most recent call to `catch/3` whose
+    /// catcher unifies with the ball, then calls its recovery goal.
+    ///
+    /// Returns the ball if it is not caught. The choice stack is then empty.
+    fn throw(&mut self, ball: Box<Structure<'ns>>) -> Result<'ns, bool> {
+        let ball: Arc<Structure<'ns>> = Arc::from(ball);
+        while let Some(choice) = self.choices.pop() {
+            if let Alt::Catch(catcher, recovery, active) = choice.alt {
+                if !active.get() {
+                    continue;
+                }
+                self.bindings.undo(choice.mark);
+                self.depth = choice.depth;
+                self.goals = choice.goals;
+                let mark = self.bindings.mark();
+                let ball = self.bindings.rename(ball.clone());
+                if unify(&catcher, &ball, &mut self.bindings) {
+                    let cut = self.choices.len();
+                    self.push(Act::Call(recovery, cut));
+                    return Ok(true);
+                }
+                self.bindings.undo(mark);
+            }
+        }
+        self.goals = None;
+        Err((*ball).to_owned())
+    }
+
+    /// Calls a user-defined predicate.
+    ///
+    /// Calling a predicate which has not been defined is handled according
+    /// to the `unknown` flag. Warnings are written to the output stream.
+    fn call(&mut self, goal: Term<'ns>) -> Result<'ns, bool> {
+        if !self.db.is_defined(goal.functor()) {
+            let name = match goal.functor() {
+                Symbol::Funct(_, name) => name.as_str(),
+                _ => unreachable!(),
+            };
+            match self.flags.unknown {
+                Unknown::Error => {
+                    let culprit = error::indicator(self.ns, name, goal.arity());
+                    return Err(error::existence_error(self.ns, "procedure", &culprit));
+                },
+                Unknown::Warning => {
+                    let msg = format!("Warning: unknown procedure {}/{}\n", name, goal.arity());
+                    let _ = self.output.write_all(msg.as_bytes());
+                    return Ok(false);
+                },
+                Unknown::Fail => return Ok(false),
+            }
+        }
+
+        let first = match goal.args().first() {
+            Some(arg) => {
+                match self.bindings.deref(arg).functor() {
+                    Symbol::Var(_) => None,
+                    sym => Some(sym),
+                }
+            },
+            None => None,
+        };
+        let rules = self.db.candidates(goal.functor(), first);
+        Ok(self.try_rules(goal, rules, 0))
+    }
+
+    /// Tries the rules for a goal, starting at index `i`, until the head of
+    /// one unifies with the goal. A choice point is left for the rest.
+    fn try_rules(&mut self, goal: Term<'ns>, rules: Vec<Rule<'ns>>, i: usize) -> bool {
+        let cut = self.choices.len();
+        for j in i..rules.len() {
+            let mark = self.bindings.mark();
+            let (head, body) = self.rename(&rules[j]);
+            if unify(&goal, &head, &mut self.bindings) {
+                if j + 1 < rules.len() {
+                    self.choices.push(Choice {
+                        mark: mark,
+                        depth: self.depth,
+                        goals: self.goals.clone(),
+                        alt: Alt::Rules(goal, rules, j + 1),
+                    });
+                }
+                if let Some(body) = body {
+                    self.depth += 1;
+                    self.push(Act::Call(body, cut));
+                }
+                return true;
+            }
+            self.bindings.undo(mark);
+        }
+        false
+    }
+
+    /// Returns to the most recent choice point and tries the next
+    /// alternative. Returns false if there are no alternatives left.
+    fn backtrack(&mut self) -> bool {
+        while let Some(choice) = self.choices.pop() {
+            self.bindings.undo(choice.mark);
+            self.depth = choice.depth;
+            self.goals = choice.goals;
+            let ok = match choice.alt {
+                Alt::Rules(goal, rules, i) => self.try_rules(goal, rules, i),
+                Alt::Retract(head, body, rules, i) => self.try_retract(head, body, rules, i),
+                Alt::Builtin(alts) => self.try_alternatives(alts),
+                Alt::Succeed => true,
+                Alt::Else(goal, cut, active) => {
+                    if active.get() {
+                        self.push(Act::Call(goal, cut));
+                    }
+                    active.get()
+                },
+                Alt::Catch(..) => false,
+                Alt::Reenter(active) => {
+                    active.set(true);
+                    false
+                },
+                Alt::Collect(bag) => self.collect(bag),
+                Alt::Groups(bag, groups, i) => self.try_groups(bag, groups, i),
+            };
+            if ok {
+                return true;
+            }
+        }
+        false
+    }
+
+    /// Tries the alternatives of a nondeterministic built-in until one unifies.
+    /// A choice point is left for the rest.
+    fn try_alternatives(&mut self, mut alts: Peekable<Alternatives<'ns>>) -> bool {
+        while let Some(alt) = alts.next() {
+            let mark = self.bindings.mark();
+            let mut ok = true;
+            for (term, st) in alt {
+                let val = self.bindings.rename(Arc::from(st));
+                if !unify(&term, &val, &mut self.bindings) {
+                    ok = false;
+                    break;
+                }
+            }
+            if ok {
+                if alts.peek().is_some() {
+                    self.choices.push(Choice {
+                        mark: mark,
+                        depth: self.depth,
+                        goals: self.goals.clone(),
+                        alt: Alt::Builtin(alts),
+                    });
+                }
+                return true;
+            }
+            self.bindings.undo(mark);
+        }
+        false
+    }
+
+    /// Begins a call to `retract(Clause)`.
+    fn retract(&mut self, clause: Term<'ns>) -> Result<'ns, bool> {
+        let clause = self.bindings.deref(&clause);
+        let (head, body) = match clause.functor() {
+            Symbol::Funct(2, name) if name.as_str() == ":-" => {
+                let args = clause.args();
+                (self.bindings.deref(&args[0]), args[1].clone())
+            },
+            _ => (clause, self.atom("true")),
+        };
+        let rules = match head.functor() {
+            Symbol::Var(_) => return Err(error::instantiation_error(self.ns)),
+            functor => self.db.candidates(functor, None),
+        };
+        Ok(self.try_retract(head, body, rules, 0))
+    }
+
+    /// Resolves the argument of `assertz/1` and friends, raising an error if
+    /// it cannot be asserted.
+    fn clause_arg(&self, arg: &Term<'ns>) -> Result<'ns, Box<Structure<'ns>>> {
+        let clause = self.bindings.resolve(arg);
+        match check_clause(&clause) {
+            Ok(()) => (),
+            Err(ClauseError::Unbound) => return Err(error::instantiation_error(self.ns)),
+            Err(ClauseError::NotCallable(culprit)) => {
+                return Err(error::type_error(self.ns, "callable", culprit));
+            },
+        }
+        Ok(clause)
+    }
+
+    /// Tries the rules for a call to `retract/1`, starting at index `i`, until
+    /// one unifies with the clause and is removed. A choice point is left for
+    /// the rest.
+    fn try_retract(
+        &mut self,
+        head: Term<'ns>,
+        body: Term<'ns>,
+        rules: Vec<Rule<'ns>>,
+        i: usize,
+    ) -> bool {
+        for j in i..rules.len() {
+            let mark = self.bindings.mark();
+            let (h, b) = self.rename(&rules[j]);
+            let b = b.unwrap_or_else(|| self.atom("true"));
+            if unify(&head, &h, &mut self.bindings) && unify(&body, &b, &mut self.bindings) &&
+                self.db.retract(&rules[j])
+            {
+                if j + 1 < rules.len() {
+                    self.choices.push(Choice {
+                        mark: mark,
+                        depth: self.depth,
+                        goals: self.goals.clone(),
+                        alt: Alt::Retract(head, body, rules, j + 1),
+                    });
+                }
+                return true;
+            }
+            self.bindings.undo(mark);
+        }
+        false
+    }
+
+    /// Begins an all-solutions predicate, `findall(Template, Goal, Result)`
+    /// or similar.
+    ///
+    /// For `bagof/3` and `setof/3`, the free variables of the goal are those
+    /// which appear in neither the template nor the left side of `Var^Goal`.
+    fn all_solutions(&mut self, kind: BagKind, args: &[Term<'ns>]) -> bool {
+        let mut goal = args[1].clone();
+        let mut witness = Vec::new();
+        if kind != BagKind::Findall {
+            let mut bound = self.bindings.vars(&args[0]);
+            loop {
+                goal = self.bindings.deref(&goal);
+                match goal.functor() {
+                    Symbol::Funct(2, name) if name.as_str() == "^" => {
+                        let args = goal.args();
+                        bound.extend(self.bindings.vars(&args[0]));
+                        goal = args[1].clone();
+                    },
+                    _ => break,
+                }
+            }
+            for var in self.bindings.vars(&goal) {
+                if !bound.contains(&var) {
+                    witness.push(Term::var(var));
+                }
+            }
+        }
+
+        let witness = self.bindings.list(&witness);
+        let pair = self.pair(witness.clone(), args[0].clone());
+        let bag = Rc::new(Bag {
+            kind: kind,
+            witness: witness,
+            pair: pair,
+            result: args[2].clone(),
+            next: Cell::new(0),
+            items: RefCell::new(Vec::new()),
+        });
+
+        let height = self.choices.len();
+        self.choices.push(Choice {
+            mark: self.bindings.mark(),
+            depth: self.depth,
+            goals: self.goals.clone(),
+            alt: Alt::Collect(bag.clone()),
+        });
+        self.push(Act::Gather(bag));
+        self.push(Act::Call(goal, height + 1));
+        true
+    }
+
+    /// Unifies the result of an all-solutions predicate with the solutions
+    /// gathered in its bag.
+    fn collect(&mut self, bag: Rc<Bag<'ns>>) -> bool {
+        let items = mem::replace(&mut *bag.items.borrow_mut(), Vec::new());
+        if bag.kind == BagKind::Findall {
+            let mut templates = Vec::with_capacity(items.len());
+            for (_, item) in items {
+                templates.push(self.bindings.rename(Arc::from(item)).args()[1].clone());
+            }
+            let list = self.bindings.list(&templates);
+            return unify(&bag.result, &list, &mut self.bindings);
+        }
+
+        // Group the solutions by their witness, preserving their order. The
+        // copies number their variables by first appearance, starting with the
+        // witness, so witnesses which are variants have identical copies.
+        let mut items = items;
+        items.sort_by(|a, b| order::compare(a.0.args()[0], b.0.args()[0]));
+        let mut groups: Vec<Vec<(Box<Structure<'ns>>, Box<Structure<'ns>>)>> = Vec::new();
+        for item in items {
+            match groups.iter().position(|group| group[0].1.args()[0] == item.1.args()[0]) {
+                Some(i) => groups[i].push(item),
+                None => groups.push(vec![item]),
+            }
+        }
+
+        if bag.kind == BagKind::Setof {
+            for group in groups.iter_mut() {
+                group.sort_by(|a, b| order::compare(a.0.args()[1], b.0.args()[1]));
+                group.dedup_by(|a, b| {
+                    order::compare(a.0.args()[1], b.0.args()[1]) == Ordering::Equal
+                });
+            }
+        }
+
+        let groups = groups.into_iter()
+            .map(|group| group.into_iter().map(|(_, item)| item).collect())
+            .collect();
+        self.try_groups(bag, groups, 0)
+    }
+
+    /// Resolves the pair of a bag to a key for sorting its solutions.
+    fn bag_key(&self, bag: &Bag<'ns>) -> Box<Structure<'ns>> {
+        let key = self.bindings.resolve_by_age(&bag.pair);
+        let mut vars: Vec<usize> = key.iter()
+            .filter_map(|sym| match *sym {
+                Symbol::Var(n) => Some(n),
+                _ => None,
+            })
+            .collect();
+        vars.sort();
+        vars.dedup();
+
+        let next = bag.next.get();
+        bag.next.set(next + vars.len());
+        let syms = key.iter()
+            .map(|sym| match *sym {
+                Symbol::Var(n) => Symbol::Var(next + vars.binary_search(&n).unwrap()),
+                sym => sym,
+            })
+            .collect();
+        unsafe { Structure::from_vec(syms) }
+    }
+
+    /// Tries the groups of solutions for `bagof/3` or `setof/3`, starting at
+    /// index `i`, until one unifies with the witness and result. A choice
+    /// point is left for the rest.
+    fn try_groups(
+        &mut self,
+        bag: Rc<Bag<'ns>>,
+        groups: Vec<Vec<Box<Structure<'ns>>>>,
+        i: usize,
+    ) -> bool {
+        for j in i..groups.len() {
+            let mark = self.bindings.mark();
+            let mut witness = Vec::new();
+            let mut templates = Vec::with_capacity(groups[j].len());
+            for item in groups[j].iter() {
+                let args = self.bindings.rename(Arc::from((**item).to_owned())).args();
+                witness.push(args[0].clone());
+                templates.push(args[1].clone());
+            }
+            let list = self.bindings.list(&templates);
+            if unify(&bag.witness, &witness[0], &mut self.bindings) &&
+                unify(&bag.result, &list, &mut self.bindings)
+            {
+                if j + 1 < groups.len() {
+                    self.choices.push(Choice {
+                        mark: mark,
+                        depth: self.depth,
+                        goals: self.goals.clone(),
+                        alt: Alt::Groups(bag, groups, j + 1),
+                    });
+                }
+                return true;
+            }
+            self.bindings.undo(mark);
+        }
+        false
+    }
+
+    /// Builds a goal from a callable term with extra arguments appended, e.g.
+    /// `plus(1)` with the arguments `2, X` becomes `plus(1, 2, X)`.
+    fn extend_goal(&mut self, goal: &Term<'ns>, extra: &[Term<'ns>]) -> Result<'ns, Term<'ns>> {
+        let goal = self.bindings.deref(goal);
+        let (arity, name) = match goal.functor() {
+            Symbol::Funct(arity, name) => (arity as usize, name),
+            Symbol::Var(_) => return Err(error::instantiation_error(self.ns)),
+            _ => return Err(error::type_error(self.ns, "callable", goal.structure())),
+        };
+        if extra.is_empty() {
+            return Ok(goal);
+        }
+        let mut vals = goal.args();
+        vals.extend_from_slice(extra);
+        let mut st: Vec<_> = (0..vals.len()).map(Symbol::Var).collect();
+        st.push(Symbol::Funct((arity + extra.len()) as u32, name));
+        let st = unsafe { Structure::from_vec(st) };
+        Ok(self.bindings.build(st, &vals))
+    }
+
+    /// Translates a grammar body into a goal which parses `list`, leaving
+    /// `rest`, as for `phrase/3`.
+    ///
+    /// As in grammar bodies, a string to be parsed is a list of codes.
+    fn phrase_goal(
+        &mut self,
+        body: &Term<'ns>,
+        list: &Term<'ns>,
+        rest: Term<'ns>,
+    ) -> Result<'ns, Term<'ns>> {
+        let body = self.bindings.deref(body);
+        match body.functor() {
+            Symbol::Var(_) => return Err(error::instantiation_error(self.ns)),
+            Symbol::Funct(..) | Symbol::List(..) | Symbol::Str(_) => (),
+            _ => return Err(error::type_error(self.ns, "callable", body.structure())),
+        }
+
+        // The variables of the body keep their bindings in the goal.
+        let mut vars = HashMap::new();
+        let mut buf = Vec::new();
+        self.bindings.resolve_into(&body, &mut vars, &mut buf);
+        let n = vars.len();
+        let mut vals = vec![Term::var(0); n];
+        for (var, i) in vars {
+            vals[i] = Term::var(var);
+        }
+        vals.push(self.text_codes(list));
+        vals.push(rest);
+
+        let body = unsafe { Structure::from_vec(buf) };
+        let mut next = n + 2;
+        let goal = match dcg::translate_body(&body, n, n + 1, &mut next, self.ns) {
+            Some(goal) => goal,
+            None => return Err(error::type_error(self.ns, "list", &body)),
+        };
+        let frame = self.bindings.alloc(next - n - 2);
+        vals.extend((frame..frame + next - n - 2).map(Term::var));
+        Ok(self.bindings.build(goal, &vals))
+    }
+
+    /// Converts a string to a list of character codes. Other terms are
+    /// returned as-is.
+    fn text_codes(&mut self, term: &Term<'ns>) -> Term<'ns> {
+        let term = self.bindings.deref(term);
+        match term.functor() {
+            Symbol::Str(text) => {
+                let codes: Vec<_> = text.chars().map(|ch| Symbol::Int(ch as i64)).collect();
+                Term::new(Arc::from(term::list_of_atomics(codes)), 0)
+            },
+            _ => term,
+        }
+    }
+
+    /// Constructs a term for an atom.
+    fn atom(&self, name: &str) -> Term<'ns> {
+        Term::atomic(Symbol::Funct(0, self.ns.name(name)))
+    }
+
+    /// Builds the list cell `[Head|Tail]`.
+    fn pair(&mut self, head: Term<'ns>, tail: Term<'ns>) -> Term<'ns> {
+        let cell = vec![Symbol::Var(0), Symbol::Var(1), Symbol::List(false, 2)];
+        let cell = unsafe { Structure::from_vec(cell) };
+        self.bindings.build(cell, &[head, tail])
+    }
+
+    /// Places the head and body of a rule in a fresh frame.
+    fn rename(&mut self, rule: &Rule<'ns>) -> (Term<'ns>, Option<Term<'ns>>) {
+        let head = rule.head().clone();
+        let body = rule.body().cloned();
+        let n = match body {
+            Some(ref body) => term::var_count(&head).max(term::var_count(body)),
+            None => term::var_count(&head),
+        };
+        let frame = self.bindings.alloc(n);
+        (Term::new(head, frame), body.map(|body| Term::new(body, frame)))
+    }
+
+    /// Pushes a goal to be solved next, at the current depth.
+    fn push(&mut self, act: Act<'ns>) {
+        self.goals = Some(Rc::new(Goal {
+            act: act,
+            depth: self.depth,
+            next: self.goals.take(),
+        }));
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::flags::Dialect;
+    use syntax::namespace::NameSpace;
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+    use syntax::writer::Writer;
+    use super::*;
+
+    /// Solves each query against a program, rendering the solutions as text.
+    fn solve(program: &str, query: &str) -> Vec<String> {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let mut db = DataBase::new();
+        let errors = db.consult(&mut Parser::new(program.as_bytes(), &ns, &ops));
+        assert_eq!(errors.len(), 0);
+        let query = Parser::new(query.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+        let writer = Writer::new(&ops);
+        Solver::new(&mut db, &ns, &query)
+            .map(|solution| match solution {
+                Ok(st) => writer.to_string(&st),
+                Err(ball) => format!("uncaught {}", writer.to_string(&ball)),
+            })
+            .collect()
+    }
+
+    #[test]
+    fn ancestor() {
+        let program = "parent(tom, bob).\n\
+                       parent(bob, ann).\n\
+                       parent(bob, pat).\n\
+                       parent(pat, jim).\n\
+                       ancestor(X, Y) :- parent(X, Y).\n\
+                       ancestor(X, Y) :- parent(X, Z), ancestor(Z, Y).\n";
+
+        assert_eq!(solve(program, "ancestor(X, Y)."), vec![
+            "ancestor(tom,bob)",
+            "ancestor(bob,ann)",
+            "ancestor(bob,pat)",
+            "ancestor(pat,jim)",
+            "ancestor(tom,ann)",
+            "ancestor(tom,pat)",
+            "ancestor(tom,jim)",
+            "ancestor(bob,jim)",
+        ]);
+        assert_eq!(solve(program, "ancestor(ann, X)."), Vec::<String>::new());
+        assert_eq!(solve(program, "parent(bob, X), true, parent(X, Y)."), vec![
+            "parent(bob,pat),true,parent(pat,jim)",
+        ]);
+    }
+
+    #[test]
+    fn cut() {
+        let program = "max(X, Y, X) :- X >= Y, !.\n\
+                       max(X, Y, Y).\n\
+                       first(X, [X|_]) :- !.\n\
+                       first(X, [_|T]) :- first(X, T).\n\
+                       p(1). p(2). p(3).\n\
+                       q(X) :- p(X), X > 1, !.\n";
+
+        assert_eq!(solve(program, "max(3, 1, M)."), vec!["max(3,1,3)"]);
+        assert_eq!(solve(program, "max(1, 3, M)."), vec!["max(1,3,3)"]);
+        assert_eq!(solve(program, "first(X, [a, b, c])."), vec!["first(a,[a,b,c])"]);
+        assert_eq!(solve(program, "q(X)."), vec!["q(2)"]);
+
+        // A cut in the query prunes the choices of the whole query.
+        assert_eq!(solve(program, "p(X), !."), vec!["p(1),!"]);
+        assert_eq!(solve(program, "p(X), q(Y)."), vec!["p(1),q(2)", "p(2),q(2)", "p(3),q(2)"]);
+    }
+
+    #[test]
+    fn control() {
+        let program = "p(1). p(2). p(3).\n\
+                       max(X, Y, Z) :- ( X >= Y -> Z = X ; Z = Y ).\n\
+                       first(X) :- ( p(X), ! ; X = none ).\n\
+                       some(X) :- ( p(X), X > 1 ; X = 4 ), X < 4, !.\n\
+                       local(X) :- p(X), ( ! -> true ; fail ).\n\
+                       soft(X, Y) :- ( p(X), X > Y *-> true ; X = none ).\n";
+
+        assert_eq!(solve(program, "max(3, 1, M)."), vec!["max(3,1,3)"]);
+        assert_eq!(solve(program, "max(1, 3, M)."), vec!["max(1,3,3)"]);
+        assert_eq!(solve(program, "X = a ; X = b."), vec!["a=a;a=b", "b=a;b=b"]);
+
+        // The branches of a disjunction are transparent to cut.
+        assert_eq!(solve(program, "first(X)."), vec!["first(1)"]);
+        assert_eq!(solve(program, "some(X)."), vec!["some(2)"]);
+
+        // The condition of an if-then-else is opaque to cut, and is only
+        // tried once.
+        assert_eq!(solve(program, "local(X)."), vec!["local(1)", "local(2)", "local(3)"]);
+        assert_eq!(solve(program, "p(X) -> true."), vec!["p(1)->true"]);
+        assert_eq!(solve(program, "fail -> true."), Vec::<String>::new());
+
+        // Every solution of the condition of a soft-cut is tried.
+        assert_eq!(solve(program, "soft(X, 1)."), vec!["soft(2,1)", "soft(3,1)"]);
+        assert_eq!(solve(program, "soft(X, 3)."), vec!["soft(none,3)"]);
+        assert_eq!(solve(program, "p(X) *-> true."), vec![
+            "p(1)*->true",
+            "p(2)*->true",
+            "p(3)*->true",
+        ]);
+    }
+
+    #[test]
+    fn call() {
+        let program = "member(X, [X|_]).\n\
+                       member(X, [_|T]) :- member(X, T).\n\
+                       plus(X, Y, Z) :- Z is X + Y.\n\
+                       p(1). p(2).\n";
+
+        assert_eq!(solve(program, "call(member(X), [a, b])."), vec![
+            "call(member(a),[a,b])",
+            "call(member(b),[a,b])",
+        ]);
+        assert_eq!(solve(program, "call(plus(1), 2, X)."), vec!["call(plus(1),2,3)"]);
+        assert_eq!(solve(program, "call(plus, 1, 2, X)."), vec!["call(plus,1,2,3)"]);
+        assert_eq!(solve(program, "G = member(X), call(G, [a])."), vec![
+            "member(a)=member(a),call(member(a),[a])",
+        ]);
+        assert_eq!(solve(program, "apply(plus(1), [2, X])."), vec!["apply(plus(1),[2,3])"]);
+
+        // A cut within a meta-call is local to it.
+        assert_eq!(solve(program, "p(X), call((p(Y), !))."), vec![
+            "p(1),call((p(1),!))",
+            "p(2),call((p(1),!))",
+        ]);
+
+        assert_eq!(solve(program, "call(G, a)."), vec!["uncaught error(instantiation_error,_0)"]);
+        assert_eq!(solve(program, "call(1, a)."), vec![
+            "uncaught error(type_error(callable,1),_0)",
+        ]);
+        assert_eq!(solve(program, "apply(p, foo)."), vec![
+            "uncaught error(type_error(list,foo),_0)",
+        ]);
+    }
+
+    #[test]
+    fn negation() {
+        let program = "member(X, [X|_]).\n\
+                       member(X, [_|T]) :- member(X, T).\n";
+
+        assert_eq!(solve(program, "\\+ member(x, [a, b])."), vec!["\\+member(x,[a,b])"]);
+        assert_eq!(solve(program, "\\+ member(a, [a, b])."), Vec::<String>::new());
+        assert_eq!(solve(program, "not(member(a, [a, b]))."), Vec::<String>::new());
+
+        // Bindings made while proving the goal are not retained.
+        assert_eq!(solve(program, "\\+ \\+ X = a, X = b."), vec!["\\+ \\+b=a,b=b"]);
+
+        // The choice points of a negation do not escape it.
+        assert_eq!(solve(program, "member(X, [a, b]), \\+ member(X, [b, c])."), vec![
+            "member(a,[a,b]),\\+member(a,[b,c])",
+        ]);
+    }
+
+    #[test]
+    fn all_solutions() {
+        let program = "member(X, [X|_]).\n\
+                       member(X, [_|T]) :- member(X, T).\n\
+                       p(1, c). p(2, b). p(1, a). p(2, b).\n\
+                       q(f(Y)). q(f(Z)).\n\
+                       r(1, g(Y)). r(2, g(Z)).\n";
+
+        assert_eq!(solve(program, "findall(X, member(X, [c, a, b]), L)."), vec![
+            "findall(_0,member(_0,[c,a,b]),[c,a,b])",
+        ]);
+        assert_eq!(solve(program, "setof(X, member(X, [c, a, b]), L)."), vec![
+            "setof(_0,member(_0,[c,a,b]),[a,b,c])",
+        ]);
+        assert_eq!(solve(program, "findall(X, member(X, []), L)."), vec![
+            "findall(_0,member(_0,[]),[])",
+        ]);
+        assert_eq!(solve(program, "bagof(X, member(X, []), L)."), Vec::<String>::new());
+
+        // Solutions are grouped by the free variables of the goal.
+        assert_eq!(solve(program, "bagof(X, p(K, X), L)."), vec![
+            "bagof(_0,p(1,_0),[c,a])",
+            "bagof(_0,p(2,_0),[b,b])",
+        ]);
+        assert_eq!(solve(program, "setof(X, p(K, X), L)."), vec![
+            "setof(_0,p(1,_0),[a,c])",
+            "setof(_0,p(2,_0),[b])",
+        ]);
+        assert_eq!(solve(program, "setof(X, K^p(K, X), L)."), vec![
+            "setof(_0,_1^p(_1,_0),[a,b,c])",
+        ]);
+        assert_eq!(solve(program, "setof(K-X, p(K, X), L)."), vec![
+            "setof(_0- _1,p(_0,_1),[1-a,1-c,2-b])",
+        ]);
+
+        // Distinct variables are never merged.
+        assert_eq!(solve(program, "setof(X, q(X), L)."), vec![
+            "setof(_0,q(_0),[f(_1),f(_2)])",
+        ]);
+        assert_eq!(solve(program, "setof(X, A^B^member(X, [B, A, B]), L)."), vec![
+            "setof(_0,_1^ _2^member(_0,[_2,_1,_2]),[_3,_4,_5])",
+        ]);
+
+        // Witnesses which are variants are grouped together.
+        assert_eq!(solve(program, "bagof(X, r(X, W), L)."), vec![
+            "bagof(_0,r(_0,g(_1)),[1,2])",
+        ]);
+    }
+
+    #[test]
+    fn assert() {
+        let program = "p(1). p(2).\n";
+
+        // Each call to `p/1` sees only the clauses which existed when it began.
+        let query = "findall(X, (p(X), Y is X + 10, assertz(p(Y))), L), findall(X, p(X), M).";
+        assert_eq!(solve(program, query), vec![
+            "findall(_0,(p(_0),_1 is _0+10,assertz(p(_1))),[1,2]),\
+             findall(_0,p(_0),[1,2,11,12])",
+        ]);
+        assert_eq!(solve(program, "asserta(p(0)), findall(X, p(X), L)."), vec![
+            "asserta(p(0)),findall(_0,p(_0),[0,1,2])",
+        ]);
+        assert_eq!(solve(program, "assertz((q(X) :- p(X))), q(X)."), vec![
+            "assertz((q(1):-p(1))),q(1)",
+            "assertz((q(2):-p(2))),q(2)",
+        ]);
+
+        // Retracting on backtracking removes each matching clause.
+        assert_eq!(solve(program, "retract(p(X))."), vec!["retract(p(1))", "retract(p(2))"]);
+        assert_eq!(solve(program, "retract(p(2)), findall(X, p(X), L)."), vec![
+            "retract(p(2)),findall(_0,p(_0),[1])",
+        ]);
+        assert_eq!(solve(program, "retract(p(3))."), Vec::<String>::new());
+
+        // Clauses which cannot be called are not asserted.
+        let errors = vec![
+            ("assertz(X).", "instantiation_error"),
+            ("asserta((X :- true)).", "instantiation_error"),
+            ("assertz((foo :- X)).", "instantiation_error"),
+            ("assertz(1).", "type_error(callable,1)"),
+            ("asserta((1.5 :- true)).", "type_error(callable,1.5)"),
+            ("assertz((foo :- 1)).", "type_error(callable,1)"),
+            ("assertz((foo :- p(a), (q ; 1))).", "type_error(callable,(p(a),(q;1)))"),
+            ("retract(X).", "instantiation_error"),
+            ("retract((X :- true)).", "instantiation_error"),
+        ];
+        for (query, err) in errors {
+            assert_eq!(solve(program, query), vec![format!("uncaught error({},_0)", err)]);
+        }
+        assert_eq!(solve(program, "assertz((foo(X) :- X, true)), foo(true)."), vec![
+            "assertz((foo(_0):- _0,true)),foo(true)",
+        ]);
+    }
+
+    #[test]
+    fn errors() {
+        let program = "p(1). p(2).\n";
+
+        assert_eq!(solve(program, "p(X), Y is foo + X."), vec![
+            "uncaught error(type_error(evaluable,foo/0),_0)",
+        ]);
+        assert_eq!(solve(program, "p(X), X > Y."), vec!["uncaught error(instantiation_error,_0)"]);
+        assert_eq!(solve(program, "p(X), Y is X / 0."), vec![
+            "uncaught error(evaluation_error(zero_divisor),_0)",
+        ]);
+        assert_eq!(solve(program, "p(X), X."), vec!["uncaught error(type_error(callable,1),_0)"]);
+        assert_eq!(solve(program, "p(X), Y."), vec!["uncaught error(instantiation_error,_0)"]);
+    }
+
+    #[test]
+    fn integers() {
+        let program = "";
+
+        assert_eq!(solve(program, "findall(X, between(1, 3, X), L)."), vec![
+            "findall(_0,between(1,3,_0),[1,2,3])",
+        ]);
+        assert_eq!(solve(program, "between(1, 3, 3)."), vec!["between(1,3,3)"]);
+        assert_eq!(solve(program, "between(1, 3, 4)."), Vec::<String>::new());
+        assert_eq!(solve(program, "between(3, 1, X)."), Vec::<String>::new());
+        assert_eq!(solve(program, "between(1, inf, X), X > 2, !."), vec!["between(1,inf,3),3>2,!"]);
+        assert_eq!(solve(program, "between(9223372036854775807, inf, X)."), vec![
+            "between(9223372036854775807,inf,9223372036854775807)",
+        ]);
+        assert_eq!(solve(program, "between(9223372036854775806, 9223372036854775807, X)."), vec![
+            "between(9223372036854775806,9223372036854775807,9223372036854775806)",
+            "between(9223372036854775806,9223372036854775807,9223372036854775807)",
+        ]);
+        assert_eq!(solve(program, "between(1, a, X)."), vec![
+            "uncaught error(type_error(integer,a),_0)",
+        ]);
+
+        assert_eq!(solve(program, "succ(X, 5)."), vec!["succ(4,5)"]);
+        assert_eq!(solve(program, "succ(4, Y)."), vec!["succ(4,5)"]);
+        assert_eq!(solve(program, "succ(X, 0)."), Vec::<String>::new());
+        assert_eq!(solve(program, "succ(X, -1)."), vec![
+            "uncaught error(type_error(not_less_than_zero,-1),_0)",
+        ]);
+        assert_eq!(solve(program, "succ(X, Y)."), vec!["uncaught error(instantiation_error,_0)"]);
+    }
+
+    #[test]
+    fn length() {
+        let program = "";
+
+        assert_eq!(solve(program, "length([a, b, c], N)."), vec!["length([a,b,c],3)"]);
+        assert_eq!(solve(program, "length([a, b, c], 2)."), Vec::<String>::new());
+        assert_eq!(solve(program, "length(L, 2)."), vec!["length([_0,_1],2)"]);
+        assert_eq!(solve(program, "length([a|T], 2)."), vec!["length([a,_0],2)"]);
+        assert_eq!(solve(program, "length([a, b|T], 1)."), Vec::<String>::new());
+        assert_eq!(solve(program, "length([a|T], N), N >= 3, !."), vec![
+            "length([a,_0,_1],3),3>=3,!",
+        ]);
+        assert_eq!(solve(program, "length(L, N), N >= 2, !."), vec!["length([_0,_1],2),2>=2,!"]);
+        assert_eq!(solve(program, "length(L, -1)."), vec![
+            "uncaught error(domain_error(not_less_than_zero,-1),_0)",
+        ]);
+    }
+
+    #[test]
+    fn text() {
+        assert_eq!(solve("", "atom_codes(foo, X)."), vec!["atom_codes(foo,[102,111,111])"]);
+        assert_eq!(solve("", "atom_chars(X, [f, o, o])."), vec!["atom_chars(foo,[f,o,o])"]);
+        assert_eq!(solve("", "atom_chars(ab, [a|T])."), vec!["atom_chars(ab,[a,b])"]);
+        assert_eq!(solve("", "atom_codes(X, [97|T])."), vec![
+            "uncaught error(instantiation_error,_0)",
+        ]);
+        assert_eq!(solve("", "char_code(a, X), char_code(Y, 98)."), vec![
+            "char_code(a,97),char_code(b,98)",
+        ]);
+        assert_eq!(solve("", "char_code(ab, X)."), vec![
+            "uncaught error(type_error(character,ab),_0)",
+        ]);
+
+        assert_eq!(solve("", "number_codes(X, \"42\")."), vec![
+            "number_codes(42,\"42\")",
+        ]);
+        assert_eq!(solve("", "number_codes(X, \"-1.5\"), number_codes(-7, Y)."), vec![
+            "number_codes(-1.5,\"-1.5\"),number_codes(-7,[45,55])",
+        ]);
+        assert_eq!(solve("", "number_codes(X, \"4a\")."), vec![
+            "uncaught error(syntax_error(illegal_number),_0)",
+        ]);
+        assert_eq!(solve("", "atom_number('0x1F', X), atom_number(Y, 2.5)."), vec![
+            "atom_number('0x1F',31),atom_number('2.5',2.5)",
+        ]);
+        assert_eq!(solve("", "atom_number(foo, X)."), Vec::<String>::new());
+    }
+
+    #[test]
+    fn atoms() {
+        assert_eq!(solve("", "atom_concat(foo, bar, X)."), vec!["atom_concat(foo,bar,foobar)"]);
+        assert_eq!(solve("", "atom_concat(X, Y, ab)."), vec![
+            "atom_concat('',ab,ab)",
+            "atom_concat(a,b,ab)",
+            "atom_concat(ab,'',ab)",
+        ]);
+        assert_eq!(solve("", "atom_concat(X, b, ab)."), vec!["atom_concat(a,b,ab)"]);
+        assert_eq!(solve("", "atom_concat(X, b, Y)."), vec![
+            "uncaught error(instantiation_error,_0)",
+        ]);
+
+        assert_eq!(solve("", "sub_atom(abc, B, 1, A, S)."), vec![
+            "sub_atom(abc,0,1,2,a)",
+            "sub_atom(abc,1,1,1,b)",
+            "sub_atom(abc,2,1,0,c)",
+        ]);
+        assert_eq!(solve("", "sub_atom(abcab, B, L, A, ab)."), vec![
+            "sub_atom(abcab,0,2,3,ab)",
+            "sub_atom(abcab,3,2,0,ab)",
+        ]);
+        assert_eq!(solve("", "sub_atom(abc, B, L, 0, S)."), vec![
+            "sub_atom(abc,0,3,0,abc)",
+            "sub_atom(abc,1,2,0,bc)",
+            "sub_atom(abc,2,1,0,c)",
+            "sub_atom(abc,3,0,0,'')",
+        ]);
+
+        assert_eq!(solve("", "atomic_list_concat([a, b, c], ',', X)."), vec![
+            "atomic_list_concat([a,b,c],(','),'a,b,c')",
+        ]);
+        assert_eq!(solve("", "atomic_list_concat([a, 1, 2.5], X)."), vec![
+            "atomic_list_concat([a,1,2.5],'a12.5')",
+        ]);
+        assert_eq!(solve("", "atomic_list_concat(L, ',', 'a,b,,c')."), vec![
+            "atomic_list_concat([a,b,'',c],(','),'a,b,,c')",
+        ]);
+        assert_eq!(solve("", "atomic_list_concat([a, X], '', ab)."), vec![
+            "uncaught error(domain_error(non_empty_atom,''),_0)",
+        ]);
+
+        // Numbers are taken as atoms, unless the dialect is ISO.
+        assert_eq!(solve("", "atom_concat(a, 1, X)."), vec!["atom_concat(a,1,a1)"]);
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let mut db = DataBase::new();
+        let query = Parser::new("atom_concat(a, 1, X).".as_bytes(), &ns, &ops).next().unwrap();
+        let mut solver = Solver::new(&mut db, &ns, &query.unwrap())
+            .with_flags(Flags::dialect(Dialect::Iso));
+        let ball = solver.next().unwrap().unwrap_err();
+        assert_eq!(Writer::new(&ops).to_string(&ball), "error(type_error(atom,1),_0)");
+    }
+
+    #[test]
+    fn term_to_atom() {
+        assert_eq!(solve("", "term_to_atom(foo(X, [1, 2]), A), term_to_atom(T, A)."), vec![
+            "term_to_atom(foo(_0,[1,2]),'foo(_0,[1,2])'),\
+             term_to_atom(foo(_1,[1,2]),'foo(_0,[1,2])')",
+        ]);
+        assert_eq!(solve("", "term_to_atom(T, 'X + Y * 2'), T = A + B."), vec![
+            "term_to_atom(_0+ _1*2,'X + Y * 2'),_0+ _1*2= _0+ _1*2",
+        ]);
+        assert_eq!(solve("", "read_term_from_atom('p(\\'a b\\')', T, [])."), vec![
+            "read_term_from_atom('p(\\'a b\\')',p('a b'),[])",
+        ]);
+        assert_eq!(solve("", "term_to_atom(T, 'f(')."), vec![
+            "uncaught error(syntax_error('2:1: unexpected token: eof'),_0)",
+        ]);
+    }
+
+    #[test]
+    fn sorting() {
+        assert_eq!(solve("", "msort([c, X, 1, a, c, f(x)], L)."), vec![
+            "msort([c,_0,1,a,c,f(x)],[_0,1,a,c,c,f(x)])",
+        ]);
+
+        // Pairs with equal keys keep their relative order.
+        assert_eq!(solve("", "keysort([b-w, a-x, b-y, a-z], L)."), vec![
+            "keysort([b-w,a-x,b-y,a-z],[a-x,a-z,b-w,b-y])",
+        ]);
+        assert_eq!(solve("", "keysort([b-z, b-y, b-w, a-x], L)."), vec![
+            "keysort([b-z,b-y,b-w,a-x],[a-x,b-z,b-y,b-w])",
+        ]);
+
+        assert_eq!(solve("", "keysort([a-x, b], L)."), vec![
+            "uncaught error(type_error(pair,b),_0)",
+        ]);
+        assert_eq!(solve("", "msort([a|T], L)."), vec!["uncaught error(instantiation_error,_0)"]);
+
+        // Variables are sorted by age, as they are compared by `@</2`.
+        // `X` is older than `Y`, though `Y` appears first in the list.
+        assert_eq!(solve("", "X == X, msort([Y, X], L), X @< Y, L == [X, Y]."), vec![
+            "_0== _0,msort([_1,_0],[_0,_1]),_0@< _1,[_0,_1]==[_0,_1]",
+        ]);
+        assert_eq!(solve("", "X == X, keysort([Y-a, X-b, f(Y)-c, f(X)-d], L)."), vec![
+            "_0== _0,keysort([_1-a,_0-b,f(_1)-c,f(_0)-d],[_0-b,_1-a,f(_0)-d,f(_1)-c])",
+        ]);
+    }
+
+    #[test]
+    fn phrase() {
+        let program = "digits --> digit, digits.\n\
+                       digits --> digit.\n\
+                       digit --> [C], {C >= 48, C =< 57}.\n\
+                       greeting --> [hello], name, !.\n\
+                       name --> [world].\n\
+                       name --> [there].\n\
+                       ab --> ( [a] -> [b] ; [c] ).\n\
+                       opt --> [x] | [].\n";
+        assert_eq!(solve(program, "phrase(digits, \"123\", Rest)."), vec![
+            "phrase(digits,\"123\",[])",
+            "phrase(digits,\"123\",[51])",
+            "phrase(digits,\"123\",[50,51])",
+        ]);
+        assert_eq!(solve(program, "phrase(digits, \"12a\", Rest)."), vec![
+            "phrase(digits,\"12a\",[97])",
+            "phrase(digits,\"12a\",[50,97])",
+        ]);
+        assert_eq!(solve(program, "phrase(digits, \"123\")."), vec!["phrase(digits,\"123\")"]);
+        assert_eq!(solve(program, "phrase(digits, \"a\")."), Vec::<String>::new());
+        assert_eq!(solve(program, "phrase(greeting, [hello, X])."), vec![
+            "phrase(greeting,[hello,world])",
+        ]);
+        assert_eq!(solve(program, "phrase(([a], digit), [a, 55], R)."), vec![
+            "phrase(([a],digit),[a,55],[])",
+        ]);
+        assert_eq!(solve(program, "phrase(ab, [a, b])."), vec!["phrase(ab,[a,b])"]);
+        assert_eq!(solve(program, "phrase(ab, [c])."), vec!["phrase(ab,[c])"]);
+        assert_eq!(solve(program, "phrase(ab, [a, c])."), Vec::<String>::new());
+        assert_eq!(solve(program, "phrase(opt, [x], R)."), vec![
+            "phrase(opt,[x],[])",
+            "phrase(opt,[x],[x])",
+        ]);
+        assert_eq!(solve(program, "phrase(G, [])."), vec![
+            "uncaught error(instantiation_error,_0)",
+        ]);
+        assert_eq!(solve(program, "phrase([a|T], [a])."), vec![
+            "uncaught error(type_error(list,[a|_0]),_1)",
+        ]);
+    }
+
+    #[test]
+    fn comparison() {
+        assert_eq!(solve("", "X == X."), vec!["_0== _0"]);
+        assert_eq!(solve("", "X == Y."), Vec::<String>::new());
+        assert_eq!(solve("", "X \\== Y."), vec!["_0\\== _1"]);
+        assert_eq!(solve("", "X = Y, X == Y."), vec!["_0= _0,_0== _0"]);
+        assert_eq!(solve("", "f(a, 1.0) == f(a, 1)."), Vec::<String>::new());
+
+        // Variables are ordered by age, regardless of where they appear.
+        assert_eq!(solve("", "f(X) @< f(Y)."), vec!["f(_0)@<f(_1)"]);
+        assert_eq!(solve("", "f(X) = A, f(Y) = B, B @> A."), vec![
+            "f(_0)=f(_0),f(_1)=f(_1),f(_1)@>f(_0)",
+        ]);
+        assert_eq!(solve("", "1.0 @< 1, 1 @< a, a @< \"a\", \"a\" @< f(a), f(b) @=< f(b)."), vec![
+            "1.0@<1,1@<a,a@<\"a\",\"a\"@<f(a),f(b)@=<f(b)",
+        ]);
+        assert_eq!(solve("", "g(a) @>= f(a, b)."), Vec::<String>::new());
+
+        assert_eq!(solve("", "compare(O, 1, a)."), vec!["compare(<,1,a)"]);
+        assert_eq!(solve("", "compare(O, f(b), f(a))."), vec!["compare(>,f(b),f(a))"]);
+        assert_eq!(solve("", "compare(=, X, X)."), vec!["compare(=,_0,_0)"]);
+        assert_eq!(solve("", "compare(foo, 1, 2)."), vec![
+            "uncaught error(domain_error(order,foo),_0)",
+        ]);
+        assert_eq!(solve("", "compare(1, 1, 2)."), vec!["uncaught error(type_error(atom,1),_0)"]);
+
+        assert_eq!(solve("", "f(X, Y) =@= f(Y, X)."), vec!["f(_0,_1)=@=f(_1,_0)"]);
+        assert_eq!(solve("", "f(X, X) =@= f(X, Y)."), Vec::<String>::new());
+        assert_eq!(solve("", "f(X, X) \\=@= f(X, Y)."), vec!["f(_0,_0)\\=@=f(_0,_1)"]);
+    }
+
+    #[test]
+    fn unknown() {
+        let program = "p(1).\n\
+                       q(X) :- r(X).\n";
+        assert_eq!(solve(program, "p(X), foo(X, 2)."), vec![
+            "uncaught error(existence_error(procedure,foo/2),_0)",
+        ]);
+        assert_eq!(solve(program, "catch(q(X), error(existence_error(K, PI), C), true)."), vec![
+            "catch(q(_0),error(existence_error(procedure,r/1),_1),true)",
+        ]);
+
+        // A predicate whose clauses were all retracted is still defined.
+        assert_eq!(solve(program, "retract(p(1)), \\+ p(_)."), vec!["retract(p(1)),\\+p(_0)"]);
+
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let mut db = DataBase::new();
+        let query = Parser::new("foo(1, 2).".as_bytes(), &ns, &ops).next().unwrap().unwrap();
+        let modes = [
+            (Unknown::Fail, ""),
+            (Unknown::Warning, "Warning: unknown procedure foo/2\n"),
+        ];
+        for &(mode, expected) in modes.iter() {
+            let mut flags = Flags::default();
+            flags.unknown = mode;
+            let mut buf = Vec::new();
+            {
+                let mut solver = Solver::new(&mut db, &ns, &query)
+                    .with_flags(flags)
+                    .output(&mut buf);
+                assert!(solver.next().is_none());
+            }
+            assert_eq!(String::from_utf8(buf).unwrap(), expected);
+        }
+    }
+
+    #[test]
+    fn natives() {
+        fn double<'a, 'ns>(solver: &mut Solver<'a, 'ns>, args: &[Term<'ns>]) -> Result<'ns, bool> {
+            match solver.bindings().deref(&args[0]).functor() {
+                Symbol::Int(x) => {
+                    let y = Term::atomic(Symbol::Int(2 * x));
+                    Ok(unify(&args[1], &y, solver.bindings()))
+                },
+                _ => Err(error::instantiation_error(solver.ns())),
+            }
+        }
+
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+        let mut db = DataBase::new();
+        let program = "double(_, wrong).\nquad(X, Z) :- double(X, Y), double(Y, Z).\n";
+        for clause in Parser::new(program.as_bytes(), &ns, &ops) {
+            db.assert_clause(&clause.unwrap());
+        }
+        let query = "quad(3, X), catch(double(Y, _), E, true).";
+        let query = Parser::new(query.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+        let solutions: Vec<_> = Solver::new(&mut db, &ns, &query)
+            .register("double", 2, double)
+            .map(|solution| writer.to_string(&solution.unwrap()))
+            .collect();
+        assert_eq!(solutions, vec![
+            "quad(3,12),catch(double(_0,_1),error(instantiation_error,_2),true)",
+        ]);
+    }
+
+    #[test]
+    fn output() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let mut db = DataBase::new();
+        let query = "write(a+b), nl, \
+                     print('A'-\"s\"), writeln(' '), \
+                     write_canonical([x, 'Y'|T]), nl, \
+                     write_term(f(g(h(x))), [quoted(true), max_depth(3)]), nl, \
+                     write_term([1, 2, 3, 4], [max_depth(3)]).";
+        let query = Parser::new(query.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+        let mut buf = Vec::new();
+        {
+            let mut solver = Solver::new(&mut db, &ns, &query).with_ops(&ops).output(&mut buf);
+            assert!(solver.next().unwrap().is_ok());
+        }
+        assert_eq!(String::from_utf8(buf).unwrap(), "a+b\n\
+                                                     'A'-\"s\" \n\
+                                                     [x,'Y'|_0]\n\
+                                                     f(g(h(...)))\n\
+                                                     [1,2|...]");
+
+        let query = "format(\"~w = ~d~n\", [x, 42]), \
+                     format('~a~t~8|~q~n', [abc, 'B']), \
+                     format('~t~w~6|~*c~2d~n', [right, 3, 46, 314]), \
+                     format(\"~p, ~s, ~2f~~\", [\"s\", [104, 105], 3.14159]), \
+                     format(done).";
+        let query = Parser::new(query.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+        let mut buf = Vec::new();
+        {
+            let mut solver = Solver::new(&mut db, &ns, &query).with_ops(&ops).output(&mut buf);
+            assert!(solver.next().unwrap().is_ok());
+        }
+        assert_eq!(String::from_utf8(buf).unwrap(), "x = 42\n\
+                                                     abc     'B'\n \
+                                                     right...3.14\n\
+                                                     \"s\", hi, 3.14~done");
+
+        assert_eq!(solve("", "format(\"~w ~w\", [a])."), vec![
+            "uncaught error(format('not enough arguments'),_0)",
+        ]);
+        assert_eq!(solve("", "format(\"~w\", [a, b])."), vec![
+            "uncaught error(format('too many arguments'),_0)",
+        ]);
+        assert_eq!(solve("", "write_term(a, [bogus])."), vec![
+            "uncaught error(domain_error(write_option,bogus),_0)",
+        ]);
+    }
+
+    #[test]
+    fn cyclic() {
+        // Without the occurs check, unification may build cyclic terms. Their
+        // solutions are cut where the cycle reenters.
+        assert_eq!(solve("", "X = f(X)."), vec!["f(_0)=f(f(_0))"]);
+        assert_eq!(solve("", "X = f(X), Y = g(X)."), vec!["f(_0)=f(f(_0)),g(f(_0))=g(f(_0))"]);
+    }
+
+    #[test]
+    fn limits() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+        let mut db = DataBase::new();
+        let program = "p :- p, q.\n\
+                       r(1). r(2). r(3).\n";
+        for clause in Parser::new(program.as_bytes(), &ns, &ops) {
+            db.assert_clause(&clause.unwrap());
+        }
+        let mut solve = |query: &str, depth: usize, n: usize| -> Vec<String> {
+            let query = Parser::new(query.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+            Solver::new(&mut db, &ns, &query)
+                .max_depth(depth)
+                .max_solutions(n)
+                .map(|solution| match solution {
+                    Ok(st) => writer.to_string(&st),
+                    Err(ball) => format!("uncaught {}", writer.to_string(&ball)),
+                })
+                .collect()
+        };
+
+        // A left-recursive predicate stops at the depth limit.
+        assert_eq!(solve("p.", 100, 10), vec!["uncaught error(resource_error(max_depth),_0)"]);
+        assert_eq!(solve("catch(p, error(E, _), true).", 100, 10), vec![
+            "catch(p,error(resource_error(max_depth),_0),true)",
+        ]);
+
+        // Reaching the solution limit is only an error if there are more.
+        assert_eq!(solve("r(X).", 100, 3), vec!["r(1)", "r(2)", "r(3)"]);
+        assert_eq!(solve("r(X).", 100, 2), vec![
+            "r(1)",
+            "r(2)",
+            "uncaught error(resource_error(max_solutions),_0)",
+        ]);
+    }
+
+    #[test]
+    fn catch() {
+        let program = "p(1). p(2).\n\
+                       q(X) :- catch(r(X), oops, X = caught).\n\
+                       r(X) :- X = 1, throw(oops).\n\
+                       s(1).\n\
+                       s(_) :- throw(oops).\n";
+
+        let query = "catch(X is foo + 1, error(type_error(T, C), _), Y = recovered).";
+        assert_eq!(solve(program, query), vec![
+            "catch(_0 is foo+1,error(type_error(evaluable,foo/0),_1),recovered=recovered)",
+        ]);
+
+        // Bindings made before the error are undone.
+        assert_eq!(solve(program, "q(X)."), vec!["q(caught)"]);
+
+        // The innermost matching catcher is used.
+        let query = "catch(catch(throw(a), b, X = inner), a, X = outer).";
+        assert_eq!(solve(program, query), vec![
+            "catch(catch(throw(a),b,outer=inner),a,outer=outer)",
+        ]);
+
+        // Errors thrown after the goal exits are not caught.
+        assert_eq!(solve(program, "catch(p(X), _, true), throw(oops)."), vec!["uncaught oops"]);
+        assert_eq!(solve(program, "catch(true, _, true), throw(oops)."), vec!["uncaught oops"]);
+
+        // The catcher is active again when backtracking into the goal.
+        let query = "catch(s(X), oops, X = caught), X \\= 1.";
+        assert_eq!(solve(program, query), vec!["catch(s(caught),oops,caught=caught),caught\\=1"]);
+        assert_eq!(solve(program, "catch(p(X), _, true)."), vec![
+            "catch(p(1),_0,true)",
+            "catch(p(2),_0,true)",
+        ]);
+    }
+}
@@ -0,0 +1,203 @@
+use std::collections::HashMap;
+use std::sync::Arc;
+
+use syntax::{Structure, Symbol};
+
+/// A subterm of a shared `Structure`, placed in a frame of variables.
+///
+/// The variables of a structure are numbered from zero. Within a `Term`, the
+/// variable `Var(n)` stands for the variable `frame + n` of some `Bindings`.
+/// Thus the same structure may appear in many terms whose variables are
+/// distinct, as when a clause is used many times during a proof.
+///
+/// Terms are cheap to clone; the underlying structure is reference counted.
+#[derive(Debug)]
+#[derive(Clone)]
+pub struct Term<'ns> {
+    st: Arc<Structure<'ns>>,
+    start: usize,
+    end: usize,
+    frame: usize,
+}
+
+impl<'ns> Term<'ns> {
+    /// Constructs a term for an entire structure in the given frame.
+    pub fn new(st: Arc<Structure<'ns>>, frame: usize) -> Term<'ns> {
+        let end = st.len();
+        Term {
+            st: st,
+            start: 0,
+            end: end,
+            frame: frame,
+        }
+    }
+
+    /// Constructs a term for a single atomic symbol.
+    ///
+    /// The symbol must not be a variable or compound.
+    pub fn atomic(sym: Symbol<'ns>) -> Term<'ns> {
+        Term::new(Arc::from(atomic(sym)), 0)
+    }
+
+    /// Constructs a term for the variable with the given number.
+    pub fn var(var: usize) -> Term<'ns> {
+        let st = unsafe { Structure::from_vec(vec![Symbol::Var(0)]) };
+        Term::new(Arc::from(st), var)
+    }
+
+    /// Views the subterm as a `Structure`.
+    ///
+    /// Variables of the structure are numbered relative to the frame.
+    pub fn structure(&self) -> &Structure<'ns> {
+        unsafe { Structure::from_slice(&self.st[self.start..self.end]) }
+    }
+
+    /// Gets the offset of the frame holding the variables of the term.
+    pub fn frame(&self) -> usize {
+        self.frame
+    }
+
+    /// Gets the root of the term.
+    ///
+    /// Variables are given their number within the `Bindings`, not the
+    /// structure.
+    pub fn functor(&self) -> Symbol<'ns> {
+        match self.st[self.end - 1] {
+            Symbol::Var(n) => Symbol::Var(self.frame + n),
+            sym => sym,
+        }
+    }
+
+    /// Gets the arity of the root of the term.
+    pub fn arity(&self) -> usize {
+        self.functor().arity()
+    }
+
+    /// Gets the arguments of the root of the term, from left to right.
+    pub fn args(&self) -> Vec<Term<'ns>> {
+        self.structure()
+            .arg_ranges()
+            .into_iter()
+            .map(|r| {
+                Term {
+                    st: self.st.clone(),
+                    start: self.start + r.start,
+                    end: self.start + r.end,
+                    frame: self.frame,
+                }
+            })
+            .collect()
+    }
+}
+
+/// Returns the number of variables in a structure.
+pub fn var_count(st: &Structure) -> usize {
+    st.iter()
+        .filter_map(|sym| match *sym {
+            Symbol::Var(n) => Some(n + 1),
+            _ => None,
+        })
+        .max()
+        .unwrap_or(0)
+}
+
+/// Returns the structure of a single atomic symbol.
+///
+/// The symbol must not be a variable or compound.
+pub fn atomic<'ns>(sym: Symbol<'ns>) -> Box<Structure<'ns>> {
+    debug_assert!(sym.arity() == 0);
+    unsafe { Structure::from_vec(vec![sym]) }
+}
+
+/// Returns the structure of a proper list of `n` distinct variables.
+pub fn list_of_vars<'ns>(n: usize) -> Box<Structure<'ns>> {
+    let mut buf: Vec<_> = (0..n).map(Symbol::Var).collect();
+    buf.push(Symbol::List(true, 0));
+    buf.extend((0..n).map(|_| Symbol::List(false, 2)));
+    unsafe { Structure::from_vec(buf) }
+}
+
+/// Returns the structure of a proper list of atomic symbols.
+pub fn list_of_atomics<'ns>(mut syms: Vec<Symbol<'ns>>) -> Box<Structure<'ns>> {
+    debug_assert!(syms.iter().all(|sym| sym.arity() == 0));
+    let n = syms.len();
+    syms.push(Symbol::List(true, 0));
+    syms.extend((0..n).map(|_| Symbol::List(false, 2)));
+    unsafe { Structure::from_vec(syms) }
+}
+
+/// Copies a template, replacing its variables with the given structures.
+///
+/// The variable `Var(i)` of the template is replaced by `subst[&i]`, if any.
+/// The variables of the result are renumbered by first appearance. The
+/// substitutions share a single set of variables, which is distinct from the
+/// variables left in the template.
+pub fn instantiate<'ns>(
+    template: &Structure<'ns>,
+    subst: &HashMap<usize, &Structure<'ns>>,
+) -> Box<Structure<'ns>> {
+    let mut vars = HashMap::new();
+    let mut buf = Vec::with_capacity(template.len());
+    for sym in template.iter() {
+        let (key, st) = match *sym {
+            Symbol::Var(n) => match subst.get(&n) {
+                Some(st) => (true, *st),
+                None => {
+                    let next = vars.len();
+                    let var = vars.entry((false, n)).or_insert(next);
+                    buf.push(Symbol::Var(*var));
+                    continue;
+                },
+            },
+            sym => {
+                buf.push(sym);
+                continue;
+            },
+        };
+        for sym in st.iter() {
+            match *sym {
+                Symbol::Var(m) => {
+                    let next = vars.len();
+                    let var = vars.entry((key, m)).or_insert(next);
+                    buf.push(Symbol::Var(*var));
+                },
+                sym => buf.push(sym),
+            }
+        }
+    }
+    unsafe { Structure::from_vec(buf) }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::namespace::NameSpace;
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+    use syntax::writer::Writer;
+    use super::*;
+
+    #[test]
+    fn instantiate() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+        let pl = "point(X, Y). 1. 2. f(A, B, Z, X, Y). g(A, B). h(A).";
+        let sts: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).map(|st| st.unwrap()).collect();
+
+        let mut subst = HashMap::new();
+        subst.insert(0, &*sts[1]);
+        subst.insert(1, &*sts[2]);
+        let st = super::instantiate(&sts[0], &subst);
+        assert_eq!(writer.to_string(&st), "point(1,2)");
+
+        // Unsubstituted variables stay distinct from those of the substitutions.
+        let mut subst = HashMap::new();
+        subst.insert(0, &*sts[4]);
+        subst.insert(3, &*sts[5]);
+        let st = super::instantiate(&sts[3], &subst);
+        assert_eq!(writer.to_string(&st), "f(g(_0,_1),_2,_3,h(_0),_4)");
+    }
+}
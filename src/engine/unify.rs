@@ -0,0 +1,73 @@
+use engine::bindings::Bindings;
+use engine::term::Term;
+use syntax::Symbol;
+
+/// Unifies two terms, recording any new bindings.
+///
+/// The terms may come from different structures. If unification fails, some
+/// bindings may have been made before the failure was discovered; the caller
+/// should `undo` to a mark taken before the call.
+pub fn unify<'ns>(a: &Term<'ns>, b: &Term<'ns>, bindings: &mut Bindings<'ns>) -> bool {
+    let mut stack = vec![(a.clone(), b.clone())];
+    while let Some((a, b)) = stack.pop() {
+        let a = bindings.deref(&a);
+        let b = bindings.deref(&b);
+        match (a.functor(), b.functor()) {
+            (Symbol::Var(x), Symbol::Var(y)) if x == y => (),
+            (Symbol::Var(x), _) => bindings.bind(x, b),
+            (_, Symbol::Var(y)) => bindings.bind(y, a),
+            (x, y) => {
+                if x != y {
+                    return false;
+                }
+                stack.extend(a.args().into_iter().zip(b.args()));
+            },
+        }
+    }
+    true
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use std::sync::Arc;
+
+    use syntax::namespace::NameSpace;
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+    use super::*;
+
+    #[test]
+    fn subterms() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "f(X, g(b)). h(g(Y), Y).";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        let first = Arc::from(parser.next().unwrap().unwrap());
+        let second = Arc::from(parser.next().unwrap().unwrap());
+
+        let mut bindings = Bindings::new();
+        let first = bindings.rename(first);
+        let second = bindings.rename(second);
+        let (a, b) = (first.args(), second.args());
+
+        // The subterms `g(b)` and `g(Y)` unify, binding `Y` to `b`.
+        let mark = bindings.mark();
+        assert!(unify(&a[1], &b[0], &mut bindings));
+        assert_eq!(bindings.deref(&b[1]).functor(), Symbol::Funct(0, ns.name("b")));
+
+        // The subterms `X` and `Y` unify, binding `X` to `b`.
+        assert!(unify(&a[0], &b[1], &mut bindings));
+        assert_eq!(bindings.deref(&a[0]).functor(), Symbol::Funct(0, ns.name("b")));
+
+        // After undoing to the mark, `X` and `Y` are unbound again.
+        bindings.undo(mark);
+        assert_eq!(bindings.deref(&a[0]).functor(), a[0].functor());
+        assert_eq!(bindings.deref(&b[1]).functor(), b[1].functor());
+
+        // The whole clauses do not unify.
+        assert!(!unify(&first, &second, &mut bindings));
+    }
+}
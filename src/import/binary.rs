@@ -0,0 +1,359 @@
+//! A compact binary format for sequences of clauses.
+//!
+//! Loading a large fact base from text spends most of its time lexing and
+//! parsing. The binary format stores clauses in the same postfix form as a
+//! `Structure`, so reading them is little more than copying.
+//!
+//! The format starts with the magic bytes `RIPL` and a version byte. Then
+//! comes a table of the names and strings used by the clauses, each stored
+//! once, followed by the clauses. Every clause is prefixed with its number of
+//! symbols. Integers are little endian.
+
+use std::collections::HashMap;
+use std::io::{self, Read, Write};
+
+use ordered_float::OrderedFloat;
+
+use syntax::{Result, Structure, Symbol, SyntaxError};
+use syntax::namespace::{Name, NameSpace};
+
+/// The current version of the format.
+pub const VERSION: u8 = 1;
+
+const MAGIC: &'static [u8] = b"RIPL";
+
+// Symbol tags.
+const FUNCT: u8 = 0;
+const STR: u8 = 1;
+const VAR: u8 = 2;
+const INT: u8 = 3;
+const FLOAT: u8 = 4;
+const LIST: u8 = 5;
+
+/// Writes a sequence of clauses in the binary format.
+pub fn write_binary<W: Write>(w: &mut W, clauses: &[&Structure]) -> io::Result<()> {
+    // Collect the names and strings, in order of first appearance.
+    let mut index = HashMap::new();
+    let mut table = Vec::new();
+    for sym in clauses.iter().flat_map(|st| st.iter()) {
+        let text = match *sym {
+            Symbol::Funct(_, name) => name.as_str(),
+            Symbol::Str(s) => s,
+            _ => continue,
+        };
+        if !index.contains_key(text) {
+            index.insert(text, table.len() as u32);
+            table.push(text);
+        }
+    }
+
+    let mut buf = Vec::new();
+    buf.extend_from_slice(MAGIC);
+    buf.push(VERSION);
+    put_u32(&mut buf, table.len() as u32);
+    for text in table {
+        put_u32(&mut buf, text.len() as u32);
+        buf.extend_from_slice(text.as_bytes());
+    }
+
+    put_u32(&mut buf, clauses.len() as u32);
+    for st in clauses {
+        put_u32(&mut buf, st.len() as u32);
+        for sym in st.iter() {
+            match *sym {
+                Symbol::Funct(n, name) => {
+                    buf.push(FUNCT);
+                    put_u32(&mut buf, n);
+                    put_u32(&mut buf, index[name.as_str()]);
+                },
+                Symbol::Str(s) => {
+                    buf.push(STR);
+                    put_u32(&mut buf, index[s]);
+                },
+                Symbol::Var(n) => {
+                    buf.push(VAR);
+                    put_u64(&mut buf, n as u64);
+                },
+                Symbol::Int(i) => {
+                    buf.push(INT);
+                    put_u64(&mut buf, i as u64);
+                },
+                Symbol::Float(f) => {
+                    buf.push(FLOAT);
+                    put_u64(&mut buf, f.into_inner().to_bits());
+                },
+                Symbol::List(nil, n) => {
+                    buf.push(LIST);
+                    buf.push(nil as u8);
+                    put_u32(&mut buf, n);
+                },
+            }
+        }
+    }
+    w.write_all(&buf)
+}
+
+/// Reads a sequence of clauses written by `write_binary`.
+///
+/// Names are assigned by the given namespace. Malformed input is reported as
+/// a `SyntaxError` whose column is the byte offset of the problem.
+pub fn read_binary<'ns, R: Read>(
+    mut reader: R,
+    ns: &'ns NameSpace,
+) -> Result<Vec<Box<Structure<'ns>>>> {
+    let mut bytes = Vec::new();
+    if let Err(err) = reader.read_to_end(&mut bytes) {
+        return Err(SyntaxError::wrap(1, 1, err));
+    }
+    let mut input = Input {
+        bytes: &bytes,
+        pos: 0,
+    };
+
+    if input.take(MAGIC.len())? != MAGIC {
+        return Err(input.error("not a binary clause file"));
+    }
+    if input.take(1)?[0] != VERSION {
+        return Err(input.error("unsupported version"));
+    }
+
+    let n = input.u32()?;
+    let mut table = Vec::new();
+    for _ in 0..n {
+        let len = input.u32()? as usize;
+        match ::std::str::from_utf8(input.take(len)?) {
+            Ok(text) => table.push(ns.name(text)),
+            Err(_) => return Err(input.error("invalid UTF-8")),
+        }
+    }
+
+    let n = input.u32()?;
+    let mut clauses = Vec::new();
+    for _ in 0..n {
+        // Every symbol takes at least five bytes, so a corrupt length cannot
+        // ask for more space than the input could fill.
+        let len = input.u32()? as usize;
+        let mut buf = Vec::with_capacity(len.min(input.remaining() / 5));
+        let mut depth = 0usize;
+        for _ in 0..len {
+            let tag = input.take(1)?[0];
+            let sym = match tag {
+                FUNCT => {
+                    let n = input.u32()?;
+                    Symbol::Funct(n, input.name(&table)?)
+                },
+                STR => Symbol::Str(input.name(&table)?.as_str()),
+                // Variables are numbered from zero, so a clause cannot have
+                // more variables than symbols.
+                VAR => {
+                    let n = input.u64()?;
+                    if len as u64 <= n {
+                        return Err(input.error("variable out of range"));
+                    }
+                    Symbol::Var(n as usize)
+                },
+                INT => Symbol::Int(input.u64()? as i64),
+                FLOAT => Symbol::Float(OrderedFloat(f64::from_bits(input.u64()?))),
+                LIST => {
+                    let nil = input.take(1)?[0];
+                    match (nil, input.u32()?) {
+                        (1, 0) => Symbol::List(true, 0),
+                        (0, 2) => Symbol::List(false, 2),
+                        _ => return Err(input.error("invalid list symbol")),
+                    }
+                },
+                _ => return Err(input.error("unknown symbol")),
+            };
+
+            // Check that the symbols form a tree, as `Structure` requires.
+            let arity = sym.arity();
+            if depth < arity {
+                return Err(input.error("malformed clause"));
+            }
+            depth = depth - arity + 1;
+            buf.push(sym);
+        }
+        if depth != 1 {
+            return Err(input.error("malformed clause"));
+        }
+        clauses.push(unsafe { Structure::from_vec(buf) });
+    }
+
+    if input.pos != bytes.len() {
+        return Err(input.error("data after last clause"));
+    }
+    Ok(clauses)
+}
+
+fn put_u32(buf: &mut Vec<u8>, n: u32) {
+    for i in 0..4 {
+        buf.push((n >> (8 * i)) as u8);
+    }
+}
+
+fn put_u64(buf: &mut Vec<u8>, n: u64) {
+    for i in 0..8 {
+        buf.push((n >> (8 * i)) as u8);
+    }
+}
+
+/// A cursor over the bytes being read.
+struct Input<'a> {
+    bytes: &'a [u8],
+    pos: usize,
+}
+
+impl<'a> Input<'a> {
+    fn remaining(&self) -> usize {
+        self.bytes.len() - self.pos
+    }
+
+    fn take(&mut self, n: usize) -> Result<&'a [u8]> {
+        if self.remaining() < n {
+            return Err(self.error("unexpected end of input"));
+        }
+        let bytes = &self.bytes[self.pos..self.pos + n];
+        self.pos += n;
+        Ok(bytes)
+    }
+
+    fn u32(&mut self) -> Result<u32> {
+        let bytes = self.take(4)?;
+        Ok(bytes.iter().rev().fold(0, |n, &b| n << 8 | b as u32))
+    }
+
+    fn u64(&mut self) -> Result<u64> {
+        let bytes = self.take(8)?;
+        Ok(bytes.iter().rev().fold(0, |n, &b| n << 8 | b as u64))
+    }
+
+    fn name<'ns>(&mut self, table: &[Name<'ns>]) -> Result<Name<'ns>> {
+        let i = self.u32()? as usize;
+        match table.get(i) {
+            Some(&name) => Ok(name),
+            None => Err(self.error("unknown name")),
+        }
+    }
+
+    fn error(&self, what: &'static str) -> SyntaxError {
+        SyntaxError::malformed(1, self.pos + 1, what)
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+    use super::*;
+
+    #[test]
+    fn round_trip() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "fact(1, -2, 3.5, \"str\", 'quoted atom').\n\
+                  rule(X, [a, b|T]) :- member(X, T), X \\= a.\n\
+                  big(9223372036854775807, -0.0).\n\
+                  fact(2, -3, 4.5, \"str\", 'quoted atom').\n";
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops)
+            .map(|c| c.unwrap())
+            .collect();
+        let refs: Vec<_> = clauses.iter().map(|c| &**c).collect();
+        let mut buf = Vec::new();
+        write_binary(&mut buf, &refs).unwrap();
+
+        // Names are read into any namespace.
+        let other = NameSpace::new();
+        let read = read_binary(&buf[..], &other).unwrap();
+        let names = ns.import(&other);
+        let read: Vec<_> = read.iter().map(|c| c.rekey(&names, &ns)).collect();
+        assert_eq!(read, clauses);
+
+        let empty = read_binary(&{
+            let mut buf = Vec::new();
+            write_binary(&mut buf, &[]).unwrap();
+            buf
+        }[..], &ns);
+        assert_eq!(empty.unwrap().len(), 0);
+    }
+
+    /// Compares reading 50k facts from text and from the binary format.
+    ///
+    /// Run with `cargo test --release -- --ignored --nocapture`.
+    #[test]
+    #[ignore]
+    fn bench_read() {
+        use std::time::Instant;
+
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let mut pl = String::new();
+        for i in 0..50000 {
+            let fact = format!("fact({}, name_{}, \"text {}\", [a, b|T], {}.5).\n", i, i % 100, i, i);
+            pl.push_str(&fact);
+        }
+
+        let start = Instant::now();
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops)
+            .map(|c| c.unwrap())
+            .collect();
+        let text = start.elapsed();
+
+        let refs: Vec<_> = clauses.iter().map(|c| &**c).collect();
+        let mut buf = Vec::new();
+        write_binary(&mut buf, &refs).unwrap();
+        let start = Instant::now();
+        let read = read_binary(&buf[..], &ns).unwrap();
+        let binary = start.elapsed();
+
+        assert_eq!(read, clauses);
+        println!("text: {:?} for {} bytes", text, pl.len());
+        println!("binary: {:?} for {} bytes", binary, buf.len());
+    }
+
+    #[test]
+    fn errors() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let mut parser = Parser::new("f(a, \"b\").".as_bytes(), &ns, &ops);
+        let clause = parser.next().unwrap().unwrap();
+        let mut buf = Vec::new();
+        write_binary(&mut buf, &[&clause]).unwrap();
+
+        let err = |bytes: &[u8]| read_binary(bytes, &ns).unwrap_err().to_string();
+        assert_eq!(err(b"LPIR\x01"), "1:5: malformed input: not a binary clause file");
+        assert_eq!(err(b"RIPL\x02"), "1:6: malformed input: unsupported version");
+        let n = buf.len();
+        let truncated = format!("1:{}: malformed input: unexpected end of input", n - 3);
+        assert_eq!(err(&buf[..n - 1]), truncated);
+
+        // The arity of `f` is changed to 3, which is not a valid tree.
+        let mut bad = buf.clone();
+        bad[n - 8] = 3;
+        assert_eq!(err(&bad), format!("1:{}: malformed input: malformed clause", n + 1));
+
+        // A file with no names and one clause of the given symbols.
+        let clause = |len: u32, syms: &[u8]| {
+            let mut buf = b"RIPL\x01".to_vec();
+            put_u32(&mut buf, 0);
+            put_u32(&mut buf, 1);
+            put_u32(&mut buf, len);
+            buf.extend_from_slice(syms);
+            buf
+        };
+        let huge = clause(u32::max_value(), &[]);
+        assert_eq!(err(&huge), "1:18: malformed input: unexpected end of input");
+        let var = clause(1, &[VAR, 0, 0, 0, 0, 0, 1, 0, 0]);
+        assert_eq!(err(&var), "1:27: malformed input: variable out of range");
+        let var = clause(1, &[VAR, 1, 0, 0, 0, 0, 0, 0, 0]);
+        assert_eq!(err(&var), "1:27: malformed input: variable out of range");
+        let nil = clause(1, &[LIST, 1, 5, 0, 0, 0]);
+        assert_eq!(err(&nil), "1:24: malformed input: invalid list symbol");
+        let cons = clause(1, &[LIST, 0, 0, 0, 0, 0]);
+        assert_eq!(err(&cons), "1:24: malformed input: invalid list symbol");
+        let ok = clause(1, &[LIST, 1, 0, 0, 0, 0]);
+        assert_eq!(read_binary(&ok[..], &ns).unwrap()[0].as_slice(), &[Symbol::List(true, 0)]);
+    }
+}
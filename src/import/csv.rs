@@ -0,0 +1,245 @@
+//! A reader for comma and tab separated values.
+
+use std::io::BufRead;
+use std::mem;
+
+use ordered_float::OrderedFloat;
+
+use syntax::{Result, Structure, Symbol, SyntaxError};
+use syntax::namespace::{Name, NameSpace};
+
+/// Reads the rows of a CSV file as facts.
+///
+/// Each row becomes a fact whose name is given and whose arguments are the
+/// cells of the row, so the row `alice,30` read as `row` is `row(alice, 30)`.
+/// Unquoted cells which read as numbers become numbers, and every other cell
+/// becomes an atom. Quoted cells are always atoms. A quoted cell may contain
+/// the delimiter, line breaks, and quotes written twice, as in `"a ""b"""`.
+///
+/// Blank lines are skipped. The reader is an iterator over the facts, and is
+/// lazy: rows are read as they are requested.
+pub struct CsvReader<'ns, B: BufRead> {
+    reader: B,
+    ns: &'ns NameSpace,
+    functor: Name<'ns>,
+    delimiter: char,
+    header: bool,
+    columns: Option<usize>,
+    line: usize,
+    buf: String,
+}
+
+/// A cell of a row, and whether it was quoted.
+type Cell = (String, bool);
+
+impl<'ns, B: BufRead> CsvReader<'ns, B> {
+    /// Constructs a reader producing facts with the given name.
+    ///
+    /// By default, cells are separated by commas and the first row is data.
+    pub fn new(reader: B, functor: &str, ns: &'ns NameSpace) -> Self {
+        CsvReader {
+            reader: reader,
+            ns: ns,
+            functor: ns.name(functor),
+            delimiter: ',',
+            header: false,
+            columns: None,
+            line: 0,
+            buf: String::with_capacity(128),
+        }
+    }
+
+    /// Sets the character separating cells, e.g. `'\t'` for TSV.
+    pub fn delimiter(mut self, delimiter: char) -> Self {
+        self.delimiter = delimiter;
+        self
+    }
+
+    /// Toggles whether the first row is a header.
+    ///
+    /// The header is skipped, and every other row must have as many cells.
+    pub fn header(mut self, yes: bool) -> Self {
+        self.header = yes;
+        self
+    }
+
+    /// Requires every row to have exactly `n` cells.
+    ///
+    /// Rows with some other number of cells are errors.
+    pub fn columns(mut self, n: usize) -> Self {
+        self.columns = Some(n);
+        self
+    }
+
+    /// Reads the next row, or `None` at the end of input.
+    fn read_row(&mut self) -> Option<Result<Vec<Cell>>> {
+        loop {
+            match self.read_line() {
+                Ok(true) if self.buf.is_empty() => continue,
+                Ok(true) => break,
+                Ok(false) => return None,
+                Err(err) => return Some(Err(err)),
+            }
+        }
+
+        let mut row = Vec::new();
+        let mut field = String::new();
+        let mut quoted = false;
+        let mut open = None;
+        loop {
+            let line = mem::replace(&mut self.buf, String::new());
+            let mut chars = line.chars().enumerate().peekable();
+            while let Some((i, ch)) = chars.next() {
+                if open.is_some() {
+                    if ch != '"' {
+                        field.push(ch);
+                    } else if chars.peek().map(|&(_, ch)| ch) == Some('"') {
+                        field.push('"');
+                        chars.next();
+                    } else {
+                        open = None;
+                    }
+                } else if ch == self.delimiter {
+                    row.push((mem::replace(&mut field, String::new()), quoted));
+                    quoted = false;
+                } else if ch == '"' && field.is_empty() && !quoted {
+                    quoted = true;
+                    open = Some((self.line, i + 1));
+                } else {
+                    field.push(ch);
+                }
+            }
+            self.buf = line;
+
+            // A quoted cell may continue on the next line.
+            let (line, col) = match open {
+                Some(pos) => pos,
+                None => break,
+            };
+            field.push('\n');
+            match self.read_line() {
+                Ok(true) => (),
+                Ok(false) => return Some(Err(SyntaxError::unbalanced(line, col, '"'))),
+                Err(err) => return Some(Err(err)),
+            }
+        }
+        row.push((field, quoted));
+        Some(Ok(row))
+    }
+
+    /// Reads the next line into the buffer, without the line break. Returns
+    /// false at the end of input.
+    fn read_line(&mut self) -> Result<bool> {
+        self.buf.clear();
+        match self.reader.read_line(&mut self.buf) {
+            Ok(0) => Ok(false),
+            Ok(_) => {
+                self.line += 1;
+                while self.buf.ends_with('\n') || self.buf.ends_with('\r') {
+                    self.buf.pop();
+                }
+                Ok(true)
+            },
+            Err(err) => Err(SyntaxError::wrap(self.line + 1, 1, err)),
+        }
+    }
+
+    /// Returns the symbol for a cell.
+    fn cell(&self, text: &str, quoted: bool) -> Symbol<'ns> {
+        if !quoted {
+            if let Ok(i) = text.parse() {
+                return Symbol::Int(i);
+            }
+            let numeric = text.chars().all(|ch| ch.is_digit(10) || "+-.eE".contains(ch));
+            if numeric && text.chars().any(|ch| ch.is_digit(10)) {
+                if let Ok(f) = text.parse() {
+                    return Symbol::Float(OrderedFloat(f));
+                }
+            }
+        }
+        Symbol::Funct(0, self.ns.name(text))
+    }
+}
+
+impl<'ns, B: BufRead> Iterator for CsvReader<'ns, B> {
+    type Item = Result<Box<Structure<'ns>>>;
+
+    fn next(&mut self) -> Option<Result<Box<Structure<'ns>>>> {
+        let row = match self.read_row() {
+            Some(Ok(row)) => row,
+            Some(Err(err)) => return Some(Err(err)),
+            None => return None,
+        };
+
+        if self.header {
+            self.header = false;
+            if self.columns.is_none() {
+                self.columns = Some(row.len());
+            }
+            return self.next();
+        }
+
+        if let Some(n) = self.columns {
+            if row.len() != n {
+                return Some(Err(SyntaxError::malformed(self.line, 1, "wrong number of cells")));
+            }
+        }
+
+        let mut syms: Vec<_> = row.iter()
+            .map(|&(ref text, quoted)| self.cell(text, quoted))
+            .collect();
+        syms.push(Symbol::Funct(row.len() as u32, self.functor));
+        Some(Ok(unsafe { Structure::from_vec(syms) }))
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::operators::OpTable;
+    use syntax::writer::Writer;
+    use super::*;
+
+    #[test]
+    fn rows() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+        let csv = "name,age,score\n\
+                   alice,30,1.5\n\
+                   \n\
+                   \"bob, \"\"jr\"\"\",41,x\n\
+                   \"carol\n\
+                   ann\",-7,\"12\"\n\
+                   dave,50\n";
+
+        let facts: Vec<_> = CsvReader::new(csv.as_bytes(), "row", &ns)
+            .header(true)
+            .map(|fact| fact.map(|st| writer.to_string(&st)).map_err(|err| err.to_string()))
+            .collect();
+        assert_eq!(facts, vec![
+            Ok("row(alice,30,1.5)".to_string()),
+            Ok("row('bob, \"jr\"',41,x)".to_string()),
+            Ok("row('carol\\nann',-7,'12')".to_string()),
+            Err("7:1: malformed input: wrong number of cells".to_string()),
+        ]);
+    }
+
+    #[test]
+    fn tsv() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+        let tsv = "a\tb,c\t3\n\"d\t";
+
+        let mut reader = CsvReader::new(tsv.as_bytes(), "row", &ns).delimiter('\t').columns(3);
+        assert_eq!(writer.to_string(&reader.next().unwrap().unwrap()), "row(a,'b,c',3)");
+        assert_eq!(
+            reader.next().unwrap().unwrap_err().to_string(),
+            "2:1: unbalanced grouping character: '\"'"
+        );
+        assert!(reader.next().is_none());
+    }
+}
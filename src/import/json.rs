@@ -0,0 +1,257 @@
+//! A reader for JSON documents.
+
+use std::char;
+use std::io::Read;
+
+use ordered_float::OrderedFloat;
+
+use import::scan::Scanner;
+use syntax::{Result, Structure, Symbol, SyntaxError};
+use syntax::namespace::NameSpace;
+
+/// Reads a JSON document as a term, in the classic representation of SWI's
+/// `json_read/2`.
+///
+/// Objects become `json(Pairs)`, where `Pairs` is a list of `Key-Value`
+/// pairs whose keys are atoms. Arrays become lists, strings become atoms,
+/// and numbers become integers or floats. The literals `true`, `false`, and
+/// `null` become atoms of the same name. Thus `{"a": 1, "b": [true, null]}`
+/// is read as `json([a-1, b-[true, null]])`.
+///
+/// The input must hold exactly one JSON value.
+pub fn read_json<'ns, R: Read>(mut reader: R, ns: &'ns NameSpace) -> Result<Box<Structure<'ns>>> {
+    let mut text = String::new();
+    if let Err(err) = reader.read_to_string(&mut text) {
+        return Err(SyntaxError::wrap(1, 1, err));
+    }
+
+    let mut json = Json {
+        scanner: Scanner::new(&text),
+        ns: ns,
+        buf: Vec::new(),
+    };
+    json.read_value()?;
+    json.scanner.skip_space();
+    if json.scanner.peek().is_some() {
+        return Err(json.scanner.error("text after JSON value"));
+    }
+    Ok(unsafe { Structure::from_vec(json.buf) })
+}
+
+/// The state of a JSON reader.
+///
+/// Values are read recursively, pushing their symbols onto the buffer in
+/// postfix order.
+struct Json<'ns> {
+    scanner: Scanner,
+    ns: &'ns NameSpace,
+    buf: Vec<Symbol<'ns>>,
+}
+
+impl<'ns> Json<'ns> {
+    fn read_value(&mut self) -> Result<()> {
+        self.scanner.skip_space();
+        match self.scanner.peek() {
+            Some('{') => self.read_object(),
+            Some('[') => self.read_array(),
+            Some('"') => {
+                let s = self.read_string()?;
+                self.push_atom(&s);
+                Ok(())
+            },
+            Some(ch) if ch == '-' || ch.is_digit(10) => self.read_number(),
+            Some(ch) if ch.is_alphabetic() => {
+                let word = self.scanner.take_while(char::is_alphanumeric);
+                match word.as_str() {
+                    "true" | "false" | "null" => {
+                        self.push_atom(&word);
+                        Ok(())
+                    },
+                    _ => Err(self.scanner.error("unknown literal")),
+                }
+            },
+            Some(_) => Err(self.scanner.error("unexpected character")),
+            None => Err(self.scanner.error("unexpected end of input")),
+        }
+    }
+
+    /// Reads an object as `json([Key-Value, ...])`.
+    fn read_object(&mut self) -> Result<()> {
+        self.scanner.next();
+        let mut n = 0;
+        self.scanner.skip_space();
+        if !self.scanner.eat('}') {
+            loop {
+                self.scanner.skip_space();
+                if self.scanner.peek() != Some('"') {
+                    return Err(self.scanner.error("expected a string key"));
+                }
+                let key = self.read_string()?;
+                self.push_atom(&key);
+                self.scanner.skip_space();
+                if !self.scanner.eat(':') {
+                    return Err(self.scanner.error("expected ':'"));
+                }
+                self.read_value()?;
+                self.buf.push(Symbol::Funct(2, self.ns.name("-")));
+                n += 1;
+                if !self.read_separator('}')? {
+                    break;
+                }
+            }
+        }
+        self.push_list(n);
+        self.buf.push(Symbol::Funct(1, self.ns.name("json")));
+        Ok(())
+    }
+
+    /// Reads an array as a list.
+    fn read_array(&mut self) -> Result<()> {
+        self.scanner.next();
+        let mut n = 0;
+        self.scanner.skip_space();
+        if !self.scanner.eat(']') {
+            loop {
+                self.read_value()?;
+                n += 1;
+                if !self.read_separator(']')? {
+                    break;
+                }
+            }
+        }
+        self.push_list(n);
+        Ok(())
+    }
+
+    /// Reads the comma between members or the closing bracket. Returns false
+    /// at the closing bracket.
+    fn read_separator(&mut self, close: char) -> Result<bool> {
+        self.scanner.skip_space();
+        if self.scanner.eat(',') {
+            Ok(true)
+        } else if self.scanner.eat(close) {
+            Ok(false)
+        } else {
+            Err(self.scanner.error("expected ',' or closing bracket"))
+        }
+    }
+
+    /// Reads a quoted string, replacing escape sequences.
+    fn read_string(&mut self) -> Result<String> {
+        self.scanner.next();
+        let mut buf = String::new();
+        loop {
+            match self.scanner.next() {
+                Some('"') => return Ok(buf),
+                Some('\\') => {
+                    let ch = match self.scanner.next() {
+                        Some('b') => '\u{8}',
+                        Some('f') => '\u{c}',
+                        Some('n') => '\n',
+                        Some('r') => '\r',
+                        Some('t') => '\t',
+                        Some('u') => self.read_code_point()?,
+                        Some(ch) if ch == '"' || ch == '\\' || ch == '/' => ch,
+                        _ => return Err(self.scanner.error("invalid escape sequence")),
+                    };
+                    buf.push(ch);
+                },
+                Some(ch) => buf.push(ch),
+                None => return Err(self.scanner.error("unterminated string")),
+            }
+        }
+    }
+
+    /// Reads the code point of a `\uXXXX` escape, following the `u`.
+    ///
+    /// Code points outside of the basic multilingual plane are written as a
+    /// pair of escaped surrogates.
+    fn read_code_point(&mut self) -> Result<char> {
+        let high = self.read_hex()?;
+        if 0xD800 <= high && high < 0xDC00 {
+            if !(self.scanner.eat('\\') && self.scanner.eat('u')) {
+                return Err(self.scanner.error("unpaired surrogate"));
+            }
+            let low = self.read_hex()?;
+            if low < 0xDC00 || 0xE000 <= low {
+                return Err(self.scanner.error("unpaired surrogate"));
+            }
+            let code = 0x10000 + ((high - 0xD800) << 10) + (low - 0xDC00);
+            return Ok(char::from_u32(code).unwrap());
+        }
+        match char::from_u32(high) {
+            Some(ch) => Ok(ch),
+            None => Err(self.scanner.error("unpaired surrogate")),
+        }
+    }
+
+    /// Reads four hexadecimal digits.
+    fn read_hex(&mut self) -> Result<u32> {
+        let mut code = 0;
+        for _ in 0..4 {
+            match self.scanner.next().and_then(|ch| ch.to_digit(16)) {
+                Some(d) => code = code * 16 + d,
+                None => return Err(self.scanner.error("invalid escape sequence")),
+            }
+        }
+        Ok(code)
+    }
+
+    /// Reads a number. Numbers with a fraction or exponent are floats, and
+    /// the rest are integers.
+    fn read_number(&mut self) -> Result<()> {
+        let text = self.scanner.take_while(|ch| ch.is_digit(10) || "+-.eE".contains(ch));
+        let sym = match text.contains(|ch| ch == '.' || ch == 'e' || ch == 'E') {
+            false => text.parse().map(Symbol::Int).ok(),
+            true => text.parse().map(|f| Symbol::Float(OrderedFloat(f))).ok(),
+        };
+        match sym {
+            Some(sym) => {
+                self.buf.push(sym);
+                Ok(())
+            },
+            None => Err(self.scanner.error("invalid number")),
+        }
+    }
+
+    fn push_atom(&mut self, name: &str) {
+        self.buf.push(Symbol::Funct(0, self.ns.name(name)));
+    }
+
+    /// Pushes the end of a list of `n` elements, which must already be on the
+    /// buffer.
+    fn push_list(&mut self, n: usize) {
+        self.buf.push(Symbol::List(true, 0));
+        for _ in 0..n {
+            self.buf.push(Symbol::List(false, 2));
+        }
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::operators::OpTable;
+    use syntax::writer::Writer;
+    use super::*;
+
+    #[test]
+    fn documents() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+        let read = |text: &str| match read_json(text.as_bytes(), &ns) {
+            Ok(st) => writer.to_string(&st),
+            Err(err) => err.to_string(),
+        };
+
+        assert_eq!(read(r#"{"a":1,"b":[true,null]}"#), "json([a- 1,b-[true,null]])");
+        assert_eq!(read(r#" { "x y" : -2.5e1, "z": {} } "#), "json(['x y'- -25.0,z-json([])])");
+        assert_eq!(read(r#"["a\"b\n", "é😀", []]"#), "['a\"b\\n','\u{e9}\u{1F600}',[]]");
+        assert_eq!(read("[1, 2"), "1:6: malformed input: expected ',' or closing bracket");
+        assert_eq!(read("[1] 2"), "1:5: malformed input: text after JSON value");
+        assert_eq!(read("nope"), "1:5: malformed input: unknown literal");
+    }
+}
@@ -0,0 +1,11 @@
+//! Readers for data in formats other than Prolog.
+//!
+//! Each reader turns its input into `Structure`s named in a `NameSpace`, so
+//! that foreign data can be asserted as facts or unified with like any other
+//! term. Malformed input is reported as a `SyntaxError`.
+
+pub mod binary;
+pub mod csv;
+pub mod json;
+pub mod sexpr;
+mod scan;
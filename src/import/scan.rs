@@ -0,0 +1,74 @@
+use syntax::SyntaxError;
+
+/// A cursor over the characters of some text, tracking line and column.
+pub struct Scanner {
+    chars: Vec<char>,
+    pos: usize,
+    line: usize,
+    col: usize,
+}
+
+impl Scanner {
+    /// Constructs a scanner at the start of the text.
+    pub fn new(text: &str) -> Scanner {
+        Scanner {
+            chars: text.chars().collect(),
+            pos: 0,
+            line: 1,
+            col: 1,
+        }
+    }
+
+    /// Returns the next character without consuming it.
+    pub fn peek(&self) -> Option<char> {
+        self.chars.get(self.pos).cloned()
+    }
+
+    /// Consumes the next character.
+    pub fn next(&mut self) -> Option<char> {
+        let ch = self.peek();
+        match ch {
+            Some('\n') => {
+                self.line += 1;
+                self.col = 1;
+            },
+            Some(_) => self.col += 1,
+            None => return None,
+        }
+        self.pos += 1;
+        ch
+    }
+
+    /// Consumes the next character if it is `ch`.
+    pub fn eat(&mut self, ch: char) -> bool {
+        if self.peek() == Some(ch) {
+            self.next();
+            true
+        } else {
+            false
+        }
+    }
+
+    /// Consumes characters while they satisfy a predicate, returning them.
+    pub fn take_while<F: Fn(char) -> bool>(&mut self, f: F) -> String {
+        let mut buf = String::new();
+        while let Some(ch) = self.peek() {
+            if !f(ch) {
+                break;
+            }
+            buf.push(ch);
+            self.next();
+        }
+        buf
+    }
+
+    /// Consumes whitespace.
+    pub fn skip_space(&mut self) {
+        self.take_while(char::is_whitespace);
+    }
+
+    /// Returns an error at the current position.
+    pub fn error(&self, what: &'static str) -> SyntaxError {
+        SyntaxError::malformed(self.line, self.col, what)
+    }
+}
@@ -0,0 +1,282 @@
+//! A reader and writer for S-expressions.
+
+use std::collections::HashMap;
+use std::io::Read;
+
+use ordered_float::OrderedFloat;
+
+use import::scan::Scanner;
+use syntax::{Result, Structure, Symbol, SyntaxError};
+use syntax::namespace::NameSpace;
+
+/// Reads an S-expression as a term.
+///
+/// A list whose head is a symbol is a compound term, so `(foo a (g b c))` is
+/// read as `foo(a, g(b, c))`. The empty list `()` is the empty list `[]`,
+/// and a list cell is written `(. Head Tail)`. Symbols starting with `?` are
+/// variables, and `?_` is anonymous. Numbers are integers or floats. Text in
+/// double quotes is a string, and text in bars, like `|hello world|`, is a
+/// symbol which may contain any character. Comments start with `;` and extend
+/// to the end of the line.
+///
+/// The input must hold exactly one S-expression.
+pub fn read_sexpr<'ns, R: Read>(mut reader: R, ns: &'ns NameSpace) -> Result<Box<Structure<'ns>>> {
+    let mut text = String::new();
+    if let Err(err) = reader.read_to_string(&mut text) {
+        return Err(SyntaxError::wrap(1, 1, err));
+    }
+
+    let mut sexpr = Sexpr {
+        scanner: Scanner::new(&text),
+        ns: ns,
+        vars: HashMap::new(),
+        var_count: 0,
+        buf: Vec::new(),
+    };
+    sexpr.read_expr()?;
+    sexpr.skip_layout();
+    if sexpr.scanner.peek().is_some() {
+        return Err(sexpr.scanner.error("text after S-expression"));
+    }
+    Ok(unsafe { Structure::from_vec(sexpr.buf) })
+}
+
+/// Writes a term as an S-expression, in the form read by `read_sexpr`.
+///
+/// Variables are written as `?_0`, `?_1`, etc. Atoms are written in bars
+/// when they would not otherwise be read back as the same symbol.
+pub fn write_sexpr(st: &Structure) -> String {
+    let mut buf = String::new();
+    write_into(st, &mut buf);
+    buf
+}
+
+fn write_into(st: &Structure, buf: &mut String) {
+    let name = match st.functor() {
+        Symbol::Var(n) => return buf.push_str(&format!("?_{}", n)),
+        Symbol::Int(i) => return buf.push_str(&i.to_string()),
+        Symbol::Float(f) => return buf.push_str(&format!("{:?}", f.0)),
+        Symbol::Str(s) => return quote(s, '"', buf),
+        Symbol::List(true, 0) => return buf.push_str("()"),
+        Symbol::Funct(0, name) => return write_symbol(name.as_str(), buf),
+        Symbol::Funct(_, name) => name.as_str(),
+        Symbol::List(..) => ".",
+    };
+    buf.push('(');
+    if name == "." {
+        buf.push('.');
+    } else {
+        write_symbol(name, buf);
+    }
+    for arg in st.args() {
+        buf.push(' ');
+        write_into(arg, buf);
+    }
+    buf.push(')');
+}
+
+/// Writes a symbol, in bars if necessary.
+fn write_symbol(name: &str, buf: &mut String) {
+    let plain = !name.is_empty() && !name.starts_with('?') && name != "." &&
+        !name.contains(is_delimiter) && number(name).is_none();
+    if plain {
+        buf.push_str(name);
+    } else {
+        quote(name, '|', buf);
+    }
+}
+
+fn quote(text: &str, q: char, buf: &mut String) {
+    buf.push(q);
+    for ch in text.chars() {
+        if ch == q || ch == '\\' {
+            buf.push('\\');
+        }
+        buf.push(ch);
+    }
+    buf.push(q);
+}
+
+/// Returns true if the character ends a bare symbol or number.
+fn is_delimiter(ch: char) -> bool {
+    ch.is_whitespace() || "()\"|;".contains(ch)
+}
+
+/// Reads a bare token as a number, if it is one.
+fn number<'ns>(text: &str) -> Option<Symbol<'ns>> {
+    if let Ok(i) = text.parse() {
+        return Some(Symbol::Int(i));
+    }
+    let numeric = text.chars().all(|ch| ch.is_digit(10) || "+-.eE".contains(ch));
+    if numeric && text.chars().any(|ch| ch.is_digit(10)) {
+        if let Ok(f) = text.parse() {
+            return Some(Symbol::Float(OrderedFloat(f)));
+        }
+    }
+    None
+}
+
+/// The state of an S-expression reader.
+///
+/// Expressions are read recursively, pushing their symbols onto the buffer in
+/// postfix order.
+struct Sexpr<'ns> {
+    scanner: Scanner,
+    ns: &'ns NameSpace,
+    vars: HashMap<String, usize>,
+    var_count: usize,
+    buf: Vec<Symbol<'ns>>,
+}
+
+impl<'ns> Sexpr<'ns> {
+    fn read_expr(&mut self) -> Result<()> {
+        self.skip_layout();
+        match self.scanner.peek() {
+            Some('(') => self.read_list(),
+            Some(')') => Err(self.scanner.error("unexpected ')'")),
+            Some('"') => {
+                let text = self.read_quoted()?;
+                self.buf.push(Symbol::Str(self.ns.name(text).as_str()));
+                Ok(())
+            },
+            Some('|') => {
+                let text = self.read_quoted()?;
+                self.buf.push(Symbol::Funct(0, self.ns.name(text)));
+                Ok(())
+            },
+            Some(_) => {
+                let token = self.scanner.take_while(|ch| !is_delimiter(ch));
+                let sym = self.token(token);
+                self.buf.push(sym);
+                Ok(())
+            },
+            None => Err(self.scanner.error("unexpected end of input")),
+        }
+    }
+
+    /// Reads a parenthesized list as a compound term or list.
+    fn read_list(&mut self) -> Result<()> {
+        self.scanner.next();
+        self.skip_layout();
+        if self.scanner.eat(')') {
+            self.buf.push(Symbol::List(true, 0));
+            return Ok(());
+        }
+
+        let name = match self.scanner.peek() {
+            Some('|') => self.read_quoted()?,
+            Some(ch) if !is_delimiter(ch) => self.scanner.take_while(|ch| !is_delimiter(ch)),
+            _ => return Err(self.scanner.error("expected a symbol")),
+        };
+        let mut n = 0;
+        loop {
+            self.skip_layout();
+            if self.scanner.eat(')') {
+                break;
+            }
+            self.read_expr()?;
+            n += 1;
+        }
+        let sym = match (name.as_str(), n) {
+            (".", 2) => Symbol::List(false, 2),
+            (name, n) => Symbol::Funct(n, self.ns.name(name)),
+        };
+        self.buf.push(sym);
+        Ok(())
+    }
+
+    /// Reads text quoted by the next character, replacing escaped characters.
+    fn read_quoted(&mut self) -> Result<String> {
+        let q = self.scanner.next().unwrap();
+        let mut buf = String::new();
+        loop {
+            match self.scanner.next() {
+                Some('\\') => {
+                    match self.scanner.next() {
+                        Some(ch) => buf.push(ch),
+                        None => return Err(self.scanner.error("unterminated quote")),
+                    }
+                },
+                Some(ch) if ch == q => return Ok(buf),
+                Some(ch) => buf.push(ch),
+                None => return Err(self.scanner.error("unterminated quote")),
+            }
+        }
+    }
+
+    /// Returns the symbol for a bare token.
+    fn token(&mut self, token: String) -> Symbol<'ns> {
+        if token == "?_" {
+            self.var_count += 1;
+            return Symbol::Var(self.var_count - 1);
+        }
+        if token.starts_with('?') {
+            let n = self.var_count;
+            let var = *self.vars.entry(token).or_insert(n);
+            if var == n {
+                self.var_count += 1;
+            }
+            return Symbol::Var(var);
+        }
+        match number(&token) {
+            Some(sym) => sym,
+            None => Symbol::Funct(0, self.ns.name(token)),
+        }
+    }
+
+    /// Skips whitespace and comments.
+    fn skip_layout(&mut self) {
+        loop {
+            self.scanner.skip_space();
+            if !self.scanner.eat(';') {
+                break;
+            }
+            self.scanner.take_while(|ch| ch != '\n');
+        }
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::operators::OpTable;
+    use syntax::writer::Writer;
+    use super::*;
+
+    #[test]
+    fn round_trip() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+
+        let text = "(foo a (g b c) ?X () ; a comment\n\
+                    (. 1 (. 2.5 ())) \"s t\" |hello world| |42| ?X ?_ (h))";
+        let st = read_sexpr(text.as_bytes(), &ns).unwrap();
+        assert_eq!(
+            writer.to_string(&st),
+            "foo(a,g(b,c),_0,[],[1,2.5],\"s t\",'hello world','42',_0,_1,h)"
+        );
+
+        let text = write_sexpr(&st);
+        assert_eq!(
+            text,
+            "(foo a (g b c) ?_0 () (. 1 (. 2.5 ())) \"s t\" |hello world| |42| ?_0 ?_1 h)"
+        );
+        assert_eq!(read_sexpr(text.as_bytes(), &ns).unwrap(), st);
+
+        // Anonymous variables are distinct from any named variable.
+        let st = read_sexpr("(f ?_ ?_0 ?_0 ?_)".as_bytes(), &ns).unwrap();
+        assert_eq!(writer.to_string(&st), "f(_0,_1,_1,_2)");
+    }
+
+    #[test]
+    fn errors() {
+        let ns = NameSpace::new();
+        let read = |text: &str| read_sexpr(text.as_bytes(), &ns).unwrap_err().to_string();
+        assert_eq!(read("(a (b)"), "1:7: malformed input: unexpected end of input");
+        assert_eq!(read("(a) b"), "1:5: malformed input: text after S-expression");
+        assert_eq!(read("((a) b)"), "1:2: malformed input: expected a symbol");
+    }
+}
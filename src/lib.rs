@@ -9,6 +9,9 @@ extern crate rand;
 extern crate regex;
 extern crate unicode_normalization;
 
+pub mod arith;
 pub mod collections;
 pub mod db;
+pub mod engine;
+pub mod import;
 pub mod syntax;
@@ -0,0 +1,113 @@
+use std::borrow::ToOwned;
+use std::collections::HashMap;
+use std::mem;
+
+use syntax::error::Result;
+use syntax::namespace::NameSpace;
+use syntax::operators::OpTable;
+use syntax::parser::Parser;
+use syntax::repr::Structure;
+
+/// A cache of parsed clauses keyed by their source text.
+///
+/// A REPL or test harness often parses the same snippets repeatedly. The
+/// cache returns a copy of the previously parsed clause instead of parsing
+/// again. Copies are independent of one another and of the cache. Variables
+/// are numbered within each clause, so copies share no variables.
+///
+/// Entries are only valid for the operator table with which they were parsed.
+/// The cache is cleared whenever it is used with a different table.
+pub struct Cache<'ctx> {
+    ns: &'ctx NameSpace,
+    ops: OpTable<'ctx>,
+    clauses: HashMap<String, Box<Structure<'ctx>>>,
+}
+
+impl<'ctx> Cache<'ctx> {
+    /// Constructs a new, empty cache for clauses named in the given namespace.
+    pub fn new(ns: &'ctx NameSpace) -> Cache<'ctx> {
+        Cache {
+            ns: ns,
+            ops: OpTable::new(),
+            clauses: HashMap::new(),
+        }
+    }
+
+    /// Parses the first clause of the given text, or returns a copy of the
+    /// clause if it was previously parsed with the same operators.
+    ///
+    /// Returns `None` if the text contains no clauses. Syntax errors are not
+    /// cached.
+    pub fn parse(
+        &mut self,
+        text: &str,
+        ops: &OpTable<'ctx>,
+    ) -> Option<Result<Box<Structure<'ctx>>>> {
+        if *ops != self.ops {
+            self.ops = ops.clone();
+            self.clauses.clear();
+        }
+
+        if let Some(clause) = self.clauses.get(text) {
+            return Some(Ok(clause.as_ref().to_owned()));
+        }
+
+        let res = Parser::new(text.as_bytes(), self.ns, &self.ops).next();
+        match res {
+            Some(Ok(clause)) => {
+                // SAFETY: All names in the clause are assigned by the
+                // namespace, which outlives `'ctx`.
+                let clause: Box<Structure<'ctx>> = unsafe { mem::transmute(clause) };
+                self.clauses.insert(text.to_string(), clause.as_ref().to_owned());
+                Some(Ok(clause))
+            },
+            Some(Err(e)) => Some(Err(e)),
+            None => None,
+        }
+    }
+
+    /// Returns the number of cached clauses.
+    pub fn len(&self) -> usize {
+        self.clauses.len()
+    }
+
+    /// Removes all cached clauses.
+    pub fn clear(&mut self) {
+        self.clauses.clear();
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use syntax::operators::Op;
+
+    #[test]
+    fn basic() {
+        let ns = NameSpace::new();
+        let mut ops = OpTable::default(&ns);
+        let mut cache = Cache::new(&ns);
+
+        let a = cache.parse("foo(X, Y) :- X ~ Y.", &ops).unwrap();
+        let b = cache.parse("foo(X, Y) :- X ~ Y.", &ops).unwrap();
+        assert!(a.is_err());
+        assert!(b.is_err());
+        assert_eq!(cache.len(), 0);
+
+        // Defining `~` changes how the clause is parsed.
+        ops.insert(Op::XFX(700, ns.name("~")));
+        let a = cache.parse("foo(X, Y) :- X ~ Y.", &ops).unwrap().unwrap();
+        let b = cache.parse("foo(X, Y) :- X ~ Y.", &ops).unwrap().unwrap();
+        assert_eq!(cache.len(), 1);
+        assert_eq!(a, b);
+        assert!(a.as_ptr() != b.as_ptr());
+
+        // Changing the operators invalidates the cache.
+        ops.insert(Op::XFX(700, ns.name("~~")));
+        cache.parse("bar.", &ops).unwrap().unwrap();
+        assert_eq!(cache.len(), 1);
+    }
+}
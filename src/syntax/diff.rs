@@ -0,0 +1,96 @@
+//! Structural differences between terms.
+//!
+//! Comparing parsed structures with `==` only reports whether they differ.
+//! The [`diff`] function instead reports where they differ, which makes test
+//! failures on large terms much easier to debug.
+//!
+//! [`diff`]: ./fn.diff.html
+
+use std::fmt;
+
+use syntax::repr::{Structure, Symbol};
+
+/// A point at which two structures differ.
+#[derive(Debug)]
+#[derive(Clone)]
+#[derive(PartialEq, Eq)]
+pub struct Difference<'ns> {
+    /// The argument indices leading from the root to the differing subterms.
+    /// Indices are zero-based.
+    pub path: Vec<usize>,
+
+    /// The root symbol of the differing subterm on the left.
+    pub left: Symbol<'ns>,
+
+    /// The root symbol of the differing subterm on the right.
+    pub right: Symbol<'ns>,
+}
+
+/// Computes the differences between two structures.
+///
+/// The structures are walked in parallel from the root. Wherever the symbols
+/// differ, including in arity, a difference is reported and the subterms are
+/// not compared further. The differences are given in depth-first order from
+/// left to right. The result is empty if and only if the structures are equal.
+pub fn diff<'ns>(a: &Structure<'ns>, b: &Structure<'ns>) -> Vec<Difference<'ns>> {
+    let mut diffs = Vec::new();
+    let mut stack = vec![(a, b, Vec::new())];
+    while let Some((a, b, path)) = stack.pop() {
+        let (left, right) = (a.functor(), b.functor());
+        if left != right {
+            diffs.push(Difference {
+                path: path,
+                left: left,
+                right: right,
+            });
+            continue;
+        }
+        let pairs = a.args().into_iter().zip(b.args()).enumerate();
+        for (i, (a, b)) in pairs.rev() {
+            let mut path = path.clone();
+            path.push(i);
+            stack.push((a, b, path));
+        }
+    }
+    diffs
+}
+
+impl<'ns> fmt::Display for Difference<'ns> {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "at {:?}: {:?} != {:?}", self.path, self.left, self.right)
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use syntax::namespace::NameSpace;
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+
+    #[test]
+    fn basic() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "f(a, g(b, c)). f(a, g(b, X)). f(a, g(b, c)).";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        let x = parser.next().unwrap().unwrap();
+        let y = parser.next().unwrap().unwrap();
+        let z = parser.next().unwrap().unwrap();
+
+        assert_eq!(diff(&x, &z), vec![]);
+        assert_eq!(
+            diff(&x, &y),
+            vec![
+                Difference {
+                    path: vec![1, 1],
+                    left: Symbol::Funct(0, ns.name("c")),
+                    right: Symbol::Var(0),
+                },
+            ]
+        );
+    }
+}
@@ -0,0 +1,176 @@
+use std::char;
+use std::io::{self, BufRead, Read};
+
+/// A character encoding of source text.
+#[derive(Debug)]
+#[derive(Clone, Copy)]
+#[derive(PartialEq, Eq)]
+pub enum Encoding {
+    Utf8,
+    Latin1,
+    Utf16Le,
+    Utf16Be,
+}
+
+impl Encoding {
+    /// Gets an encoding by name, e.g. `"utf8"` or `"iso_8859_1"`.
+    ///
+    /// Names are case insensitive, and hyphens and underscores are ignored.
+    pub fn from_name(name: &str) -> Option<Encoding> {
+        let name: String = name.chars()
+            .filter(|&ch| ch != '-' && ch != '_')
+            .flat_map(|ch| ch.to_lowercase())
+            .collect();
+        match name.as_str() {
+            "utf8" => Some(Encoding::Utf8),
+            "latin1" | "iso88591" => Some(Encoding::Latin1),
+            "utf16" | "utf16le" | "unicodele" => Some(Encoding::Utf16Le),
+            "utf16be" | "unicodebe" => Some(Encoding::Utf16Be),
+            _ => None,
+        }
+    }
+}
+
+/// A reader which transcodes its input to UTF-8.
+///
+/// The lexer reads UTF-8. A `Decoder` wraps a reader of text in some other
+/// encoding so that it can be lexed. Text which is not valid in the encoding
+/// is reported as an `InvalidData` error. UTF-8 input is passed through
+/// unchanged and is validated by the lexer.
+///
+/// Byte order marks are not removed; the lexer skips a leading byte order
+/// mark in any source.
+pub struct Decoder<R: Read> {
+    reader: R,
+    encoding: Encoding,
+    eof: bool,
+
+    // Bytes read but not yet decoded, e.g. half of a UTF-16 code unit.
+    raw: Vec<u8>,
+
+    // Decoded text, and the position of the next byte to be consumed.
+    buf: Vec<u8>,
+    pos: usize,
+}
+
+impl<R: Read> Decoder<R> {
+    /// Constructs a decoder for text of the given encoding.
+    pub fn new(reader: R, encoding: Encoding) -> Decoder<R> {
+        Decoder {
+            reader: reader,
+            encoding: encoding,
+            eof: false,
+            raw: Vec::new(),
+            buf: Vec::with_capacity(4096),
+            pos: 0,
+        }
+    }
+
+    /// Decodes as much of the raw input as possible into the buffer.
+    fn decode(&mut self) -> io::Result<()> {
+        let mut tmp = [0; 4];
+        let decoded = match self.encoding {
+            Encoding::Utf8 => {
+                self.buf.extend_from_slice(&self.raw);
+                self.raw.len()
+            },
+            Encoding::Latin1 => {
+                for &b in self.raw.iter() {
+                    let ch = b as char;
+                    self.buf.extend_from_slice(ch.encode_utf8(&mut tmp).as_bytes());
+                }
+                self.raw.len()
+            },
+            Encoding::Utf16Le | Encoding::Utf16Be => {
+                let le = self.encoding == Encoding::Utf16Le;
+                let mut units: Vec<u16> = self.raw
+                    .chunks(2)
+                    .filter(|pair| pair.len() == 2)
+                    .map(|pair| {
+                        let (lo, hi) = if le { (pair[0], pair[1]) } else { (pair[1], pair[0]) };
+                        (hi as u16) << 8 | lo as u16
+                    })
+                    .collect();
+
+                // A high surrogate may be completed by the next read.
+                let last = units.last().cloned().unwrap_or(0);
+                if !self.eof && 0xD800 <= last && last <= 0xDBFF {
+                    units.pop();
+                }
+                if self.eof && self.raw.len() % 2 == 1 {
+                    return Err(invalid("truncated UTF-16 code unit"));
+                }
+                for res in char::decode_utf16(units.iter().cloned()) {
+                    let ch = res.map_err(|_| invalid("unpaired UTF-16 surrogate"))?;
+                    self.buf.extend_from_slice(ch.encode_utf8(&mut tmp).as_bytes());
+                }
+                units.len() * 2
+            },
+        };
+        self.raw.drain(..decoded);
+        Ok(())
+    }
+}
+
+impl<R: Read> Read for Decoder<R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let n = {
+            let mut avail = self.fill_buf()?;
+            avail.read(buf)?
+        };
+        self.consume(n);
+        Ok(n)
+    }
+}
+
+impl<R: Read> BufRead for Decoder<R> {
+    fn fill_buf(&mut self) -> io::Result<&[u8]> {
+        while self.pos == self.buf.len() && !self.eof {
+            self.buf.clear();
+            self.pos = 0;
+            let mut chunk = [0; 4096];
+            match self.reader.read(&mut chunk) {
+                Ok(0) => self.eof = true,
+                Ok(n) => self.raw.extend_from_slice(&chunk[..n]),
+                Err(ref e) if e.kind() == io::ErrorKind::Interrupted => continue,
+                Err(e) => return Err(e),
+            }
+            self.decode()?;
+        }
+        Ok(&self.buf[self.pos..])
+    }
+
+    fn consume(&mut self, amt: usize) {
+        self.pos += amt;
+    }
+}
+
+fn invalid(msg: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, msg)
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    fn decode_all(bytes: &[u8], encoding: Encoding) -> io::Result<String> {
+        let mut s = String::new();
+        Decoder::new(bytes, encoding).read_to_string(&mut s)?;
+        Ok(s)
+    }
+
+    #[test]
+    fn decode() {
+        assert_eq!(decode_all(b"caf\xe9.", Encoding::Latin1).unwrap(), "café.");
+        assert_eq!(decode_all(b"a\x00\xe9\x00", Encoding::Utf16Le).unwrap(), "aé");
+        assert_eq!(decode_all(b"\x00a\xd8\x3d\xde\x00", Encoding::Utf16Be).unwrap(), "a😀");
+        assert!(decode_all(b"\x00a\xd8\x3d", Encoding::Utf16Be).is_err());
+        assert!(decode_all(b"a\x00b", Encoding::Utf16Le).is_err());
+        assert_eq!(Encoding::from_name("ISO-8859-1"), Some(Encoding::Latin1));
+        assert_eq!(Encoding::from_name("UTF-8"), Some(Encoding::Utf8));
+        assert_eq!(Encoding::from_name("ebcdic"), None);
+    }
+}
@@ -1,23 +1,31 @@
 use std::error::Error;
 use std::fmt;
+use std::sync::Arc;
 
 /// A type alias for results with possible `SyntaxError`s.
 pub type Result<T> = ::std::result::Result<T, SyntaxError>;
 
 /// The location and description of syntax errors.
 #[derive(Debug)]
+#[derive(Clone)]
 pub struct SyntaxError {
+    source: Option<String>,
     line: usize,
     col: usize,
     kind: Kind,
 }
 
 #[derive(Debug)]
+#[derive(Clone)]
 enum Kind {
     PrioirtyClash,
     Unbalanced(char),
     Unexpected(&'static str),
-    Wrapper(Box<Error + Send + Sync>),
+    BadEscape,
+    Malformed(&'static str),
+    Representation(&'static str),
+    Resource(&'static str),
+    Wrapper(Arc<Error + Send + Sync>),
 
     // Emitted when using an incomplete feature.
     TODO,
@@ -26,6 +34,7 @@ enum Kind {
 impl SyntaxError {
     fn new(line: usize, col: usize, kind: Kind) -> SyntaxError {
         SyntaxError {
+            source: None,
             line: line,
             col: col,
             kind: kind,
@@ -36,7 +45,7 @@ impl SyntaxError {
     where
         E: Into<Box<Error + Send + Sync>>,
     {
-        SyntaxError::new(line, col, Kind::Wrapper(err.into()))
+        SyntaxError::new(line, col, Kind::Wrapper(Arc::from(err.into())))
     }
 
     pub fn priority_clash(line: usize, col: usize) -> SyntaxError {
@@ -51,10 +60,52 @@ impl SyntaxError {
         SyntaxError::new(line, col, Kind::Unexpected(s))
     }
 
+    pub fn bad_escape(line: usize, col: usize) -> SyntaxError {
+        SyntaxError::new(line, col, Kind::BadEscape)
+    }
+
+    pub fn malformed(line: usize, col: usize, what: &'static str) -> SyntaxError {
+        SyntaxError::new(line, col, Kind::Malformed(what))
+    }
+
+    /// Constructs an error for input exceeding an implementation limit, e.g.
+    /// `max_arity`.
+    pub fn representation(line: usize, col: usize, limit: &'static str) -> SyntaxError {
+        SyntaxError::new(line, col, Kind::Representation(limit))
+    }
+
+    /// Constructs an error for input exhausting a configured resource, e.g.
+    /// `max_clauses`.
+    pub fn resource(line: usize, col: usize, resource: &'static str) -> SyntaxError {
+        SyntaxError::new(line, col, Kind::Resource(resource))
+    }
+
     pub fn todo(line: usize, col: usize) -> SyntaxError {
         SyntaxError::new(line, col, Kind::TODO)
     }
 
+    /// Attributes the error to the named source, unless it is already
+    /// attributed to some other source.
+    pub fn in_source(mut self, name: Option<&str>) -> SyntaxError {
+        if self.source.is_none() {
+            self.source = name.map(String::from);
+        }
+        self
+    }
+
+    /// Moves the error to another line and column, e.g. when the text before
+    /// it is edited.
+    pub fn relocate(mut self, line: usize, col: usize) -> SyntaxError {
+        self.line = line;
+        self.col = col;
+        self
+    }
+
+    /// Returns the name of the source in which the error occurs, if known.
+    pub fn source_name(&self) -> Option<&str> {
+        self.source.as_ref().map(|s| s.as_str())
+    }
+
     /// Returns the line at which the error occurs.
     pub fn line(&self) -> usize {
         self.line
@@ -72,6 +123,10 @@ impl Error for SyntaxError {
             &Kind::PrioirtyClash => "operator priority clash",
             &Kind::Unbalanced(_) => "unbalanced quote or paren",
             &Kind::Unexpected(_) => "unexpected token",
+            &Kind::BadEscape => "invalid escape sequence",
+            &Kind::Malformed(_) => "malformed input",
+            &Kind::Representation(_) => "limit exceeded",
+            &Kind::Resource(_) => "resource exhausted",
             &Kind::TODO => "not yet implemented",
             &Kind::Wrapper(ref e) => e.description(),
         }
@@ -88,11 +143,18 @@ impl Error for SyntaxError {
 
 impl<'ctx> fmt::Display for SyntaxError {
     fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        if let Some(ref name) = self.source {
+            write!(f, "{}:", name)?;
+        }
         write!(f, "{}:{}: ", self.line, self.col)?;
         match &self.kind {
             &Kind::PrioirtyClash => write!(f, "operator priority clash"),
             &Kind::Unbalanced(ch) => write!(f, "unbalanced grouping character: '{}'", ch),
             &Kind::Unexpected(tok) => write!(f, "unexpected token: {}", tok),
+            &Kind::BadEscape => write!(f, "invalid escape sequence"),
+            &Kind::Malformed(what) => write!(f, "malformed input: {}", what),
+            &Kind::Representation(limit) => write!(f, "representation_error({})", limit),
+            &Kind::Resource(resource) => write!(f, "resource_error({})", resource),
             &Kind::TODO => write!(f, "not yet implemented"),
             &Kind::Wrapper(ref e) => write!(f, "{}", e),
         }
@@ -101,6 +163,6 @@ impl<'ctx> fmt::Display for SyntaxError {
 
 impl PartialEq for SyntaxError {
     fn eq(&self, other: &SyntaxError) -> bool {
-        self.line == other.line && self.col == other.col
+        self.source == other.source && self.line == other.line && self.col == other.col
     }
 }
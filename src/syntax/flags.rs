@@ -0,0 +1,207 @@
+//! Prolog flags which affect parsing.
+//!
+//! The ISO standard defines a number of flags which change how text is read,
+//! most notably `double_quotes`. The parser consults a [`Flags`] value while
+//! reading, and `set_prolog_flag/2` directives update it between clauses.
+//!
+//! [`Flags`]: ./struct.Flags.html
+
+use std::fmt;
+
+/// The flags consulted by the parser.
+#[derive(Debug)]
+#[derive(Clone)]
+#[derive(PartialEq, Eq)]
+pub struct Flags {
+    /// How text in double quotes is read.
+    pub double_quotes: Quotes,
+
+    /// How text in back quotes is read.
+    pub back_quotes: Quotes,
+
+    /// What happens when an unknown predicate is called.
+    pub unknown: Unknown,
+
+    /// The greatest representable integer. This flag is read-only.
+    pub max_integer: i64,
+
+    /// The least representable integer. This flag is read-only.
+    pub min_integer: i64,
+
+    /// The dialect whose defaults are in effect. This flag is read-only.
+    pub dialect: Dialect,
+}
+
+/// The ways in which quoted text may be read.
+#[derive(Debug)]
+#[derive(Clone, Copy)]
+#[derive(PartialEq, Eq)]
+pub enum Quotes {
+    /// A list of character codes.
+    Codes,
+    /// A list of single character atoms.
+    Chars,
+    /// An atom.
+    Atom,
+    /// A string object.
+    String,
+}
+
+/// The ways in which calls to unknown predicates may be handled.
+#[derive(Debug)]
+#[derive(Clone, Copy)]
+#[derive(PartialEq, Eq)]
+pub enum Unknown {
+    /// Raise an existence error.
+    Error,
+    /// Print a warning and fail.
+    Warning,
+    /// Fail silently.
+    Fail,
+}
+
+/// The dialects whose defaults are supported.
+#[derive(Debug)]
+#[derive(Clone, Copy)]
+#[derive(PartialEq, Eq)]
+pub enum Dialect {
+    /// Strict ISO Prolog.
+    Iso,
+    /// SWI-Prolog, version 7 and later.
+    Swi,
+}
+
+// Flags
+// --------------------------------------------------
+
+impl Flags {
+    /// Returns the default flags of the given dialect.
+    pub fn dialect(dialect: Dialect) -> Flags {
+        let double_quotes = match dialect {
+            Dialect::Iso => Quotes::Codes,
+            Dialect::Swi => Quotes::String,
+        };
+        Flags {
+            double_quotes: double_quotes,
+            back_quotes: Quotes::Codes,
+            unknown: Unknown::Error,
+            max_integer: i64::max_value(),
+            min_integer: i64::min_value(),
+            dialect: dialect,
+        }
+    }
+
+    /// Sets a flag by name, as done by `set_prolog_flag/2`.
+    ///
+    /// Returns false if the flag is unknown or read-only, or if the value is
+    /// not valid for the flag. In that case the flags are unchanged.
+    pub fn set(&mut self, flag: &str, value: &str) -> bool {
+        match flag {
+            "double_quotes" => set_parsed(&mut self.double_quotes, value),
+            "back_quotes" => set_parsed(&mut self.back_quotes, value),
+            "unknown" => set_parsed(&mut self.unknown, value),
+            _ => false,
+        }
+    }
+}
+
+impl Default for Flags {
+    /// The default flags are those of SWI-Prolog.
+    fn default() -> Flags {
+        Flags::dialect(Dialect::Swi)
+    }
+}
+
+/// Parses a flag value into the given slot.
+fn set_parsed<T: FlagValue>(slot: &mut T, value: &str) -> bool {
+    match T::parse(value) {
+        Some(val) => {
+            *slot = val;
+            true
+        },
+        None => false,
+    }
+}
+
+/// A type which may be the value of a flag.
+trait FlagValue: Sized {
+    fn parse(value: &str) -> Option<Self>;
+}
+
+// Flag Values
+// --------------------------------------------------
+
+impl FlagValue for Quotes {
+    fn parse(value: &str) -> Option<Quotes> {
+        match value {
+            "codes" => Some(Quotes::Codes),
+            "chars" => Some(Quotes::Chars),
+            "atom" => Some(Quotes::Atom),
+            "string" => Some(Quotes::String),
+            _ => None,
+        }
+    }
+}
+
+impl FlagValue for Unknown {
+    fn parse(value: &str) -> Option<Unknown> {
+        match value {
+            "error" => Some(Unknown::Error),
+            "warning" => Some(Unknown::Warning),
+            "fail" => Some(Unknown::Fail),
+            _ => None,
+        }
+    }
+}
+
+impl fmt::Display for Quotes {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match *self {
+            Quotes::Codes => f.write_str("codes"),
+            Quotes::Chars => f.write_str("chars"),
+            Quotes::Atom => f.write_str("atom"),
+            Quotes::String => f.write_str("string"),
+        }
+    }
+}
+
+impl fmt::Display for Unknown {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match *self {
+            Unknown::Error => f.write_str("error"),
+            Unknown::Warning => f.write_str("warning"),
+            Unknown::Fail => f.write_str("fail"),
+        }
+    }
+}
+
+impl fmt::Display for Dialect {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match *self {
+            Dialect::Iso => f.write_str("iso"),
+            Dialect::Swi => f.write_str("swi"),
+        }
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn set() {
+        let mut flags = Flags::default();
+        assert_eq!(flags.double_quotes, Quotes::String);
+        assert!(flags.set("double_quotes", "chars"));
+        assert_eq!(flags.double_quotes, Quotes::Chars);
+        assert!(flags.set("unknown", "fail"));
+        assert_eq!(flags.unknown, Unknown::Fail);
+        assert!(!flags.set("double_quotes", "foo"));
+        assert!(!flags.set("max_integer", "0"));
+        assert!(!flags.set("foo", "bar"));
+        assert_eq!(flags.double_quotes, Quotes::Chars);
+    }
+}
@@ -0,0 +1,217 @@
+use std::ops::Range;
+
+use syntax::namespace::NameSpace;
+use syntax::operators::OpTable;
+use syntax::parser::{ParsedClause, Parser, Span};
+
+/// An edit to source text, given as line and column positions.
+///
+/// The text between `start` and `old_end` in the old text was replaced by the
+/// text between `start` and `new_end` in the new text. Positions are as in a
+/// `Span`: lines and columns are numbered from 1, and columns count bytes.
+#[derive(Debug)]
+#[derive(Clone, Copy)]
+#[derive(PartialEq, Eq)]
+pub struct Edit {
+    pub start: (usize, usize),
+    pub old_end: (usize, usize),
+    pub new_end: (usize, usize),
+}
+
+impl Edit {
+    /// Maps a position in the old text at or after `old_end` to the new text.
+    fn shift(&self, pos: (usize, usize)) -> (usize, usize) {
+        if pos.0 == self.old_end.0 {
+            (self.new_end.0, pos.1 - self.old_end.1 + self.new_end.1)
+        } else {
+            (pos.0 - self.old_end.0 + self.new_end.0, pos.1)
+        }
+    }
+}
+
+/// Updates the clauses of a source after an edit, re-parsing only the
+/// clauses which the edit touches.
+///
+/// The previous clauses must be those read from the old text, in order, as
+/// by `Parser::read_parsed`. Clauses which end before the edit are reused
+/// as-is, and clauses which start after the edit are reused with their spans
+/// moved. The text between them is parsed again. Returns the clauses of the
+/// new text and the range of indices of those which were re-parsed.
+///
+/// The text is parsed with the given operators. Operators defined by
+/// directives before the edit are not applied; callers which rely on such
+/// directives should re-parse the whole text.
+pub fn reparse<'ctx>(
+    prev: Vec<ParsedClause<'ctx>>,
+    text: &str,
+    edit: &Edit,
+    ns: &'ctx NameSpace,
+    ops: &'ctx OpTable<'ctx>,
+) -> (Vec<ParsedClause<'ctx>>, Range<usize>) {
+    let before = prev.iter().take_while(|p| p.span.end < edit.start).count();
+    let after = prev.iter().rev().take_while(|p| edit.old_end < p.span.start).count();
+    let after = prev.len() - after.min(prev.len() - before);
+
+    let mut clauses = prev;
+    let mut tail: Vec<_> = clauses.drain(after..).map(|p| shift(p, edit)).collect();
+    clauses.truncate(before);
+
+    // Parse the text between the last clause before the edit and the first
+    // clause after the edit. If the last clause parsed is not terminated,
+    // e.g. because the edit removed an end token, it runs into the clause
+    // which follows, so that clause is parsed again too.
+    let from = clauses.last().map(|p| p.span.end).unwrap_or((1, 1));
+    let mut parsed;
+    loop {
+        let to = tail.first().map(|p| p.span.start);
+        let region = slice(text, from, to);
+        let mut parser = Parser::new(region.as_bytes(), ns, ops);
+        parsed = Vec::new();
+        let mut terminated = true;
+        while let Some(p) = parser.next_parsed() {
+            terminated = parser.terminated();
+            parsed.push(offset(p, from));
+        }
+        if terminated || tail.is_empty() {
+            break;
+        }
+        tail.remove(0);
+    }
+
+    let range = before..before + parsed.len();
+    clauses.extend(parsed);
+    clauses.extend(tail);
+    (clauses, range)
+}
+
+/// Moves a clause which follows an edit.
+fn shift<'ctx>(mut clause: ParsedClause<'ctx>, edit: &Edit) -> ParsedClause<'ctx> {
+    clause.span = Span {
+        start: edit.shift(clause.span.start),
+        end: edit.shift(clause.span.end),
+    };
+    clause.errors = clause.errors
+        .into_iter()
+        .map(|e| {
+            let (line, col) = edit.shift((e.line(), e.col()));
+            e.relocate(line, col)
+        })
+        .collect();
+    clause
+}
+
+/// Moves a clause parsed from a region of text starting at `base` to its
+/// position in the whole text.
+fn offset<'ctx>(mut clause: ParsedClause<'ctx>, base: (usize, usize)) -> ParsedClause<'ctx> {
+    let pos = |(line, col): (usize, usize)| if line == 1 {
+        (base.0, col + base.1 - 1)
+    } else {
+        (line + base.0 - 1, col)
+    };
+    clause.span = Span {
+        start: pos(clause.span.start),
+        end: pos(clause.span.end),
+    };
+    clause.errors = clause.errors
+        .into_iter()
+        .map(|e| {
+            let (line, col) = pos((e.line(), e.col()));
+            e.relocate(line, col)
+        })
+        .collect();
+    clause
+}
+
+/// Returns the text from one position up to another, or to the end.
+fn slice(text: &str, from: (usize, usize), to: Option<(usize, usize)>) -> &str {
+    let start = byte_offset(text, from);
+    let end = to.map(|to| byte_offset(text, to)).unwrap_or(text.len());
+    &text[start..end.max(start)]
+}
+
+/// Converts a line and column to a byte offset, clamped to the text.
+fn byte_offset(text: &str, (line, col): (usize, usize)) -> usize {
+    let mut start = 0;
+    for _ in 1..line {
+        match text[start..].find('\n') {
+            Some(i) => start += i + 1,
+            None => return text.len(),
+        }
+    }
+    (start + col - 1).min(text.len())
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    /// Asserts that two lists of clauses have the same structures, spans, and
+    /// error positions.
+    fn assert_same(a: &[ParsedClause], b: &[ParsedClause]) {
+        assert_eq!(a.len(), b.len());
+        for (x, y) in a.iter().zip(b.iter()) {
+            assert_eq!(x.clause, y.clause);
+            assert_eq!(x.span, y.span);
+            let xs: Vec<_> = x.errors.iter().map(|e| (e.line(), e.col())).collect();
+            let ys: Vec<_> = y.errors.iter().map(|e| (e.line(), e.col())).collect();
+            assert_eq!(xs, ys);
+        }
+    }
+
+    #[test]
+    fn one_clause() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let old = "a(0).\nb(1).\nc(2).\nd(3).\ne(4).\nf(5).\ng(6). h(7).\ni(8 .\nj(9).\n";
+        let new = "a(0).\nb(1).\nc(2).\nd(3).\ne(4, X) :-\n  x(X).\n\
+                   f(5).\ng(6). h(7).\ni(8 .\nj(9).\n";
+        let prev = Parser::new(old.as_bytes(), &ns, &ops).read_parsed();
+        assert_eq!(prev.len(), 10);
+
+        let edit = Edit {
+            start: (5, 4),
+            old_end: (5, 4),
+            new_end: (6, 6),
+        };
+        let (clauses, reparsed) = reparse(prev, new, &edit, &ns, &ops);
+        assert_eq!(reparsed, 4..5);
+        assert_same(&clauses, &Parser::new(new.as_bytes(), &ns, &ops).read_parsed());
+    }
+
+    #[test]
+    fn split_and_join() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        // Split one clause into two, on the same line as a following clause.
+        let old = "a.\nb(1, 2). c.\nd.\n";
+        let new = "a.\nb(1). b(2). c.\nd.\n";
+        let prev = Parser::new(old.as_bytes(), &ns, &ops).read_parsed();
+        let edit = Edit {
+            start: (2, 4),
+            old_end: (2, 6),
+            new_end: (2, 9),
+        };
+        let (clauses, reparsed) = reparse(prev, new, &edit, &ns, &ops);
+        assert_eq!(reparsed, 1..3);
+        assert_same(&clauses, &Parser::new(new.as_bytes(), &ns, &ops).read_parsed());
+
+        // Remove the end of a clause, joining it to the next.
+        let old = new;
+        let new = "a.\nb(1) b(2). c.\nd.\n";
+        let prev = Parser::new(old.as_bytes(), &ns, &ops).read_parsed();
+        let edit = Edit {
+            start: (2, 5),
+            old_end: (2, 6),
+            new_end: (2, 5),
+        };
+        let (clauses, reparsed) = reparse(prev, new, &edit, &ns, &ops);
+        assert_eq!(reparsed, 1..2);
+        assert_eq!(clauses[1].errors.len(), 1);
+        assert_same(&clauses, &Parser::new(new.as_bytes(), &ns, &ops).read_parsed());
+    }
+}
@@ -0,0 +1,144 @@
+use std::fmt;
+
+use syntax::error::{Result, SyntaxError};
+use syntax::lexer::{Lexer, Token};
+use syntax::namespace::{Name, NameSpace};
+use syntax::repr::{Structure, Symbol};
+use syntax::writer::quote_atom;
+
+/// A predicate indicator, e.g. `foo/2`.
+///
+/// Indicators identify predicates by name and arity, as in `dynamic`
+/// declarations and listings.
+#[derive(Debug)]
+#[derive(Clone, Copy)]
+#[derive(PartialEq, Eq)]
+#[derive(PartialOrd, Ord)]
+#[derive(Hash)]
+pub struct Indicator<'ns> {
+    pub name: Name<'ns>,
+    pub arity: u32,
+}
+
+impl<'ns> Indicator<'ns> {
+    /// Constructs a new `Indicator`.
+    pub fn new(name: Name<'ns>, arity: u32) -> Indicator<'ns> {
+        Indicator {
+            name: name,
+            arity: arity,
+        }
+    }
+
+    /// Returns the indicator of a function symbol.
+    ///
+    /// Returns `None` if the symbol is not a function symbol.
+    pub fn of(sym: Symbol<'ns>) -> Option<Indicator<'ns>> {
+        match sym {
+            Symbol::Funct(arity, name) => Some(Indicator::new(name, arity)),
+            _ => None,
+        }
+    }
+
+    /// Reads an indicator from a structure of the form `Name/Arity`.
+    ///
+    /// Returns `None` if the structure is not of that form.
+    pub fn from_structure(st: &Structure<'ns>) -> Option<Indicator<'ns>> {
+        match st.functor() {
+            Symbol::Funct(2, slash) if slash.as_str() == "/" => (),
+            _ => return None,
+        }
+        let args = st.args();
+        match (args[0].functor(), args[1].functor()) {
+            (Symbol::Funct(0, name), Symbol::Int(n)) if 0 <= n && n <= u32::max_value() as i64 => {
+                Some(Indicator::new(name, n as u32))
+            },
+            _ => None,
+        }
+    }
+
+    /// Parses an indicator from text, e.g. `"foo/2"`.
+    ///
+    /// The name may be quoted, and the text may end with a period.
+    pub fn parse(text: &str, ns: &'ns NameSpace) -> Result<Indicator<'ns>> {
+        let mut lexer = Lexer::new(text.as_bytes(), ns);
+        let name = match lexer.next() {
+            Some(Token::Funct(_, _, name)) => name,
+            tok => return Err(expected(tok, 1)),
+        };
+        match lexer.next() {
+            Some(Token::Funct(_, _, slash)) if slash.as_str() == "/" => (),
+            tok => return Err(expected(tok, text.len() + 1)),
+        }
+        let arity = match lexer.next() {
+            Some(Token::Int(_, _, n)) if 0 <= n && n <= u32::max_value() as i64 => n as u32,
+            tok => return Err(expected(tok, text.len() + 1)),
+        };
+        match lexer.next() {
+            None | Some(Token::Dot(..)) => Ok(Indicator::new(name, arity)),
+            tok => Err(expected(tok, text.len() + 1)),
+        }
+    }
+
+    /// Returns the function symbol identified by the indicator.
+    pub fn functor(&self) -> Symbol<'ns> {
+        Symbol::Funct(self.arity, self.name)
+    }
+}
+
+/// Returns the error for an unexpected token while parsing an indicator.
+///
+/// The column `eof` is used when the input ends early.
+fn expected(tok: Option<Token>, eof: usize) -> SyntaxError {
+    let (line, col) = match tok {
+        Some(Token::Err(err)) => return err,
+        Some(tok) => (tok.line(), tok.col()),
+        None => (1, eof),
+    };
+    SyntaxError::wrap(line, col, "expected a predicate indicator")
+}
+
+impl<'ns> fmt::Display for Indicator<'ns> {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "{}/{}", quote_atom(self.name.as_str()), self.arity)
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+
+    #[test]
+    fn parse() {
+        let ns = NameSpace::new();
+        let foo = Indicator::new(ns.name("foo"), 2);
+        assert_eq!(Indicator::parse("foo/2", &ns), Ok(foo));
+        assert_eq!(Indicator::parse(" foo / 2 .", &ns), Ok(foo));
+        assert_eq!(foo.to_string(), "foo/2");
+        assert_eq!(foo.functor(), Symbol::Funct(2, ns.name("foo")));
+
+        let hello = Indicator::parse("'hello world'/0", &ns).unwrap();
+        assert_eq!(hello, Indicator::new(ns.name("hello world"), 0));
+        assert_eq!(hello.to_string(), "'hello world'/0");
+
+        let err = Indicator::parse("foo/bar", &ns).unwrap_err();
+        assert_eq!((err.line(), err.col()), (1, 5));
+        assert!(Indicator::parse("foo", &ns).is_err());
+        assert!(Indicator::parse("foo/2 bar", &ns).is_err());
+    }
+
+    #[test]
+    fn from_structure() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let mut parser = Parser::new("foo/2. foo/bar. f(x).".as_bytes(), &ns, &ops);
+        let foo = Indicator::new(ns.name("foo"), 2);
+        assert_eq!(Indicator::from_structure(&parser.next().unwrap().unwrap()), Some(foo));
+        assert_eq!(Indicator::from_structure(&parser.next().unwrap().unwrap()), None);
+        assert_eq!(Indicator::from_structure(&parser.next().unwrap().unwrap()), None);
+    }
+}
@@ -6,29 +6,64 @@
 //! passing errors to the caller. This greatly simplifies error handling logic
 //! when iterating over tokens.
 //!
+//! A lexer may be split with `tee` into two iterators over the same tokens,
+//! so that two consumers can share one pass over the input.
+//!
 //! [`Lexer`]: ./struct.Lexer.html
 //! [`Token`]: ./enum.Token.html
 
+use std::cell::RefCell;
+use std::char;
+use std::collections::VecDeque;
 use std::fmt;
-use std::io::BufRead;
+use std::io::{BufRead, Read};
+use std::iter::Peekable;
+use std::mem;
+use std::rc::Rc;
+use std::usize;
 
 use regex::Regex;
 use unicode_normalization::UnicodeNormalization;
 
 use syntax::namespace::{Name, NameSpace};
+use syntax::encoding::{Decoder, Encoding};
 use syntax::error::SyntaxError;
+use syntax::lines::LineIndex;
+use syntax::source::Source;
 
 /// A lexer for logic programs.
 ///
 /// The lexer interface is an iterator over [`Token`]s.
 ///
+/// The lexer reads from a stack of [`Source`]s. Additional sources may be
+/// spliced into the input with the `include` method, after which lexing
+/// resumes in the including source.
+///
 /// [`Token`]: ./enum.Token.html
+/// [`Source`]: ../struct.Source.html
+#[derive(Clone)]
 pub struct Lexer<'ns, B: BufRead> {
-    reader: B,
+    source: Source<B>,
+    included: Vec<Frame<B>>,
     ns: &'ns NameSpace,
     line: usize,
     col: usize,
+    bytes: u64,
     skip_space: bool,
+    strict_dot: bool,
+    dot_operator: bool,
+    normalize: bool,
+
+    // The nesting depth of parens, brackets, and braces in the current clause.
+    depth: usize,
+
+    // The raw text of the tokens lexed since it was last taken.
+    // `None` unless the lexer is configured to record it.
+    raw: Option<String>,
+
+    // The positions of the lines of the outermost source.
+    // `None` unless the lexer is configured to index them.
+    index: Option<LineIndex>,
 
     // Two buffers: The first holds each line.
     // The second holds the normalized form of the line.
@@ -36,6 +71,32 @@ pub struct Lexer<'ns, B: BufRead> {
     buf_norm: String,
 }
 
+/// One of two iterators over the tokens of a single lexer.
+///
+/// See `Lexer::tee`.
+pub struct Tee<'ns, B: BufRead> {
+    shared: Rc<RefCell<TeeState<'ns, B>>>,
+    side: usize,
+}
+
+/// The lexer shared by a pair of `Tee`s, and the tokens each has yet to see.
+///
+/// The buffer of a side is `None` once that side is dropped.
+struct TeeState<'ns, B: BufRead> {
+    lexer: Lexer<'ns, B>,
+    bufs: [Option<VecDeque<Token<'ns>>>; 2],
+}
+
+/// The saved state of a source suspended by an include.
+#[derive(Clone)]
+struct Frame<B: BufRead> {
+    source: Source<B>,
+    line: usize,
+    col: usize,
+    bytes: u64,
+    buf: String,
+}
+
 /// A lexical item of a logic program.
 ///
 /// Every `Token` includes its line and column as the first two members. When
@@ -43,11 +104,13 @@ pub struct Lexer<'ns, B: BufRead> {
 ///
 /// Lexical errors are given as a `Token::Err` whose value is the error message.
 #[derive(Debug)]
+#[derive(Clone)]
 #[derive(PartialEq)]
 pub enum Token<'ns> {
     Err(SyntaxError),
     Funct(usize, usize, Name<'ns>),
     Str(usize, usize, Name<'ns>),
+    BackQuote(usize, usize, Name<'ns>),
     Var(usize, usize, Name<'ns>),
     Int(usize, usize, i64),
     Float(usize, usize, f64),
@@ -61,7 +124,20 @@ pub enum Token<'ns> {
     Comma(usize, usize, Name<'ns>),
     Dot(usize, usize),
     Space(usize, usize),
-    Comment(usize, usize),
+    Comment(usize, usize, CommentKind),
+}
+
+/// The kinds of comments.
+#[derive(Debug)]
+#[derive(Clone, Copy)]
+#[derive(PartialEq, Eq)]
+pub enum CommentKind {
+    /// An ordinary comment, starting with `%`.
+    Line,
+
+    /// A documentation comment, starting with `%!`, as in
+    /// `%! append(?List1, ?List2, ?List3)`.
+    Doc,
 }
 
 // Public API
@@ -72,12 +148,25 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
     ///
     /// By default, the lexer is configured to skip space and comment tokens.
     pub fn new(reader: B, ns: &'ns NameSpace) -> Self {
+        Lexer::from_source(Source::anonymous(reader), ns)
+    }
+
+    /// Constructs a new lexer from a named source.
+    pub fn from_source(source: Source<B>, ns: &'ns NameSpace) -> Self {
         Lexer {
-            reader: reader,
+            source: source,
+            included: Vec::new(),
             ns: ns,
             line: 0, // incremented on first line
             col: 1,
+            bytes: 0,
             skip_space: true,
+            strict_dot: true,
+            dot_operator: false,
+            normalize: true,
+            depth: 0,
+            raw: None,
+            index: None,
             buf_line: String::with_capacity(128),
             buf_norm: String::with_capacity(128),
         }
@@ -85,10 +174,85 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
 
     /// Toggles whether space and comment tokens are reported.
     pub fn report_space(mut self, yes: bool) -> Self {
-        self.skip_space = yes;
+        self.skip_space = !yes;
+        self
+    }
+
+    /// Toggles whether the end token must be followed by layout.
+    ///
+    /// By default, a period only ends a clause when followed by whitespace, a
+    /// comment, or the end of input, as required by ISO. Otherwise the period
+    /// is read as an atom. When disabled, a lone period outside of any parens,
+    /// brackets, or braces always ends the clause, even when glued to the next
+    /// token. This is useful for pasting several clauses onto one line.
+    pub fn strict_dot(mut self, yes: bool) -> Self {
+        self.strict_dot = yes;
+        self
+    }
+
+    /// Toggles whether a period glued between two tokens is an operator.
+    ///
+    /// When enabled, a lone period with no layout immediately before or after
+    /// it, as in `X.field`, is always read as the atom `.`, which the default
+    /// operators define as an infix operator. This holds even when
+    /// `strict_dot` is disabled. A period at the end of a line or before
+    /// layout still ends the clause, so `foo.` is unaffected.
+    ///
+    /// This is groundwork for dict access syntax and is disabled by default.
+    pub fn dot_operator(mut self, yes: bool) -> Self {
+        self.dot_operator = yes;
+        self
+    }
+
+    /// Toggles Unicode normalization of the input.
+    ///
+    /// By default, each line is converted to Unicode Normalization Form KC
+    /// before lexing, so that visually identical text lexes to identical
+    /// tokens. When disabled, tokens are lexed from the exact input text and
+    /// columns are byte offsets into the input lines. This is faster and
+    /// useful when the input is already normalized, but look-alike atoms
+    /// written with different code points will not be equal.
+    pub fn normalize(mut self, yes: bool) -> Self {
+        self.normalize = yes;
+        self
+    }
+
+    /// Toggles whether the raw text of tokens is recorded.
+    ///
+    /// When enabled, the text of each token, including space and comments, is
+    /// recorded until taken with `take_raw`. Leading space and comments are
+    /// not recorded. The text is recorded after Unicode normalization.
+    pub fn verbatim(mut self, yes: bool) -> Self {
+        self.raw = if yes { Some(String::new()) } else { None };
+        self
+    }
+
+    /// Toggles whether the lines of the input are indexed as they are read.
+    ///
+    /// When enabled, a `LineIndex` of the outermost source is available from
+    /// the `line_index` method, covering the text read so far. Offsets in the
+    /// index refer to the source before Unicode normalization.
+    pub fn index_lines(mut self, yes: bool) -> Self {
+        self.index = if yes { Some(LineIndex::new()) } else { None };
         self
     }
 
+    /// Returns the index of the lines read so far, if the lexer is
+    /// configured to index them.
+    pub fn line_index(&self) -> Option<&LineIndex> {
+        self.index.as_ref()
+    }
+
+    /// Takes the raw text recorded since the last call.
+    ///
+    /// Returns an empty string if the lexer is not configured to record text.
+    pub fn take_raw(&mut self) -> String {
+        match self.raw {
+            Some(ref mut raw) => mem::replace(raw, String::new()),
+            None => String::new(),
+        }
+    }
+
     /// Returns the line of the next token to be emitted by the lexer.
     pub fn line(&self) -> usize {
         self.line
@@ -98,6 +262,79 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
     pub fn col(&self) -> usize {
         self.col
     }
+
+    /// Returns the number of bytes read from the current source.
+    ///
+    /// The lexer reads a line at a time, so this may be ahead of the next
+    /// token by up to one line.
+    pub fn bytes_read(&self) -> u64 {
+        self.bytes
+    }
+
+    /// Returns the name of the source currently being read, if any.
+    pub fn source_name(&self) -> Option<&str> {
+        self.source.name()
+    }
+
+    /// Splices a new source into the input.
+    ///
+    /// The remainder of the current source is suspended until the new source
+    /// is exhausted. Line and column numbers are reported relative to the
+    /// source being read.
+    pub fn include(&mut self, source: Source<B>) {
+        let parent = mem::replace(&mut self.source, source);
+        let buf = mem::replace(&mut self.buf_norm, String::with_capacity(128));
+        self.included.push(Frame {
+            source: parent,
+            line: self.line,
+            col: self.col,
+            bytes: self.bytes,
+            buf: buf,
+        });
+        self.line = 0;
+        self.col = 1;
+        self.bytes = 0;
+    }
+
+    /// Splits the lexer into two iterators over the same tokens.
+    ///
+    /// The input is lexed once. Each token is given to both iterators, which
+    /// may be consumed at different speeds: tokens read by one iterator are
+    /// buffered until read by the other. Once an iterator is dropped, the
+    /// other continues alone without buffering.
+    pub fn tee(self) -> (Tee<'ns, B>, Tee<'ns, B>) {
+        let shared = Rc::new(RefCell::new(TeeState {
+            lexer: self,
+            bufs: [Some(VecDeque::new()), Some(VecDeque::new())],
+        }));
+        let a = Tee {
+            shared: shared.clone(),
+            side: 0,
+        };
+        let b = Tee {
+            shared: shared,
+            side: 1,
+        };
+        (a, b)
+    }
+
+    /// Resumes lexing a source suspended by an include.
+    fn resume(&mut self, frame: Frame<B>) {
+        self.source = frame.source;
+        self.line = frame.line;
+        self.col = frame.col;
+        self.bytes = frame.bytes;
+        self.buf_norm = frame.buf;
+    }
+}
+
+impl<'ns, R: Read> Lexer<'ns, Decoder<R>> {
+    /// Constructs a new lexer from a stream of text in the given encoding.
+    ///
+    /// The text is transcoded to UTF-8 before normalization.
+    pub fn encoded(reader: R, encoding: Encoding, ns: &'ns NameSpace) -> Self {
+        Lexer::new(Decoder::new(reader, encoding), ns)
+    }
 }
 
 impl<'ns, B: BufRead> Iterator for Lexer<'ns, B> {
@@ -106,30 +343,86 @@ impl<'ns, B: BufRead> Iterator for Lexer<'ns, B> {
     /// Extracts the next token from the underlying reader.
     fn next(&mut self) -> Option<Token<'ns>> {
         // Refill the buffers.
-        if self.buf_norm.len() <= self.col {
+        if self.buf_norm.len() < self.col {
             self.line += 1;
             self.col = 1;
             self.buf_line.clear();
-            match self.reader.read_line(&mut self.buf_line) {
-                Ok(0) => return None, // Nothing more to read
-                Ok(_) => (),          // The buffer is refilled successfully
-                Err(e) => return Some(Token::Err(SyntaxError::wrap(self.line, self.col, e))),
+            match self.source.read_line(&mut self.buf_line) {
+                Ok(0) => {
+                    // Nothing more to read from this source.
+                    // Resume the including source, if any.
+                    match self.included.pop() {
+                        Some(frame) => {
+                            self.resume(frame);
+                            return self.next();
+                        },
+                        None => {
+                            // Keep returning `None` if called again.
+                            self.buf_norm.clear();
+                            return None;
+                        },
+                    }
+                },
+                Ok(n) => {
+                    // The buffer is refilled successfully.
+                    self.bytes += n as u64;
+                    if let (Some(index), true) = (self.index.as_mut(), self.included.is_empty()) {
+                        index.push(&self.buf_line);
+                    }
+                    // Skip a byte order mark at the start of the source.
+                    if self.line == 1 && self.buf_line.starts_with('\u{feff}') {
+                        self.buf_line.drain(..'\u{feff}'.len_utf8());
+                    }
+                },
+                Err(e) => {
+                    let err = SyntaxError::wrap(self.line, self.col, e);
+                    return Some(Token::Err(err.in_source(self.source_name())));
+                },
             }
 
             // Perform Unicode normalization.
             // This has security, usability, and performance implications.
             self.buf_norm.clear();
-            self.buf_norm.extend(self.buf_line.nfkc());
+            if self.normalize {
+                self.buf_norm.extend(self.buf_line.nfkc());
+            } else {
+                self.buf_norm.push_str(&self.buf_line);
+            }
         }
 
         // Lex the next token.
-        let (tok, len) = self.lex(&self.buf_norm[self.col - 1..]);
+        let start = self.col - 1;
+        let (tok, len) = self.lex(&self.buf_norm[start..]);
         self.col += len;
 
+        // Track the nesting depth.
+        match tok {
+            Token::ParenOpen(..) | Token::BracketOpen(..) | Token::BraceOpen(..) => {
+                self.depth += 1;
+            },
+            Token::ParenClose(..) | Token::BracketClose(..) | Token::BraceClose(..) => {
+                self.depth = self.depth.saturating_sub(1);
+            },
+            Token::Dot(..) => self.depth = 0,
+            _ => (),
+        }
+
+        // Record the raw text.
+        if let Some(ref mut raw) = self.raw {
+            let layout = match tok {
+                Token::Space(..) | Token::Comment(..) => true,
+                _ => false,
+            };
+            if !layout || !raw.is_empty() {
+                raw.push_str(&self.buf_norm[start..start + len]);
+            }
+        }
+
         // Skip space and comment tokens.
         match tok {
             Token::Space(..) if self.skip_space => self.next(),
             Token::Comment(..) if self.skip_space => self.next(),
+            Token::Err(err) => Some(Token::Err(err.in_source(self.source_name()))),
             _ => Some(tok),
         }
     }
@@ -143,6 +436,7 @@ impl<'ns> Token<'ns> {
             Token::Err(ref err) => err.line(),
             Token::Funct(line, ..) => line,
             Token::Str(line, ..) => line,
+            Token::BackQuote(line, ..) => line,
             Token::Var(line, ..) => line,
             Token::Int(line, ..) => line,
             Token::Float(line, ..) => line,
@@ -167,6 +461,7 @@ impl<'ns> Token<'ns> {
             Token::Err(ref err) => err.col(),
             Token::Funct(_, col, ..) => col,
             Token::Str(_, col, ..) => col,
+            Token::BackQuote(_, col, ..) => col,
             Token::Var(_, col, ..) => col,
             Token::Int(_, col, ..) => col,
             Token::Float(_, col, ..) => col,
@@ -191,6 +486,7 @@ impl<'ns> fmt::Display for Token<'ns> {
             Token::Err(ref err) => write!(f, "{}", err),
             Token::Funct(.., val) => write!(f, "{}", val),
             Token::Str(.., val) => write!(f, "{}", val),
+            Token::BackQuote(.., val) => write!(f, "{}", val),
             Token::Var(.., val) => write!(f, "{}", val),
             Token::Int(.., val) => write!(f, "{}", val),
             Token::Float(.., val) => write!(f, "{}", val),
@@ -211,12 +507,56 @@ impl<'ns> fmt::Display for Token<'ns> {
     }
 }
 
+impl<'ns, B: BufRead> Iterator for Tee<'ns, B> {
+    type Item = Token<'ns>;
+
+    fn next(&mut self) -> Option<Token<'ns>> {
+        let mut state = self.shared.borrow_mut();
+        let state = &mut *state;
+        if let Some(tok) = state.bufs[self.side].as_mut().and_then(|buf| buf.pop_front()) {
+            return Some(tok);
+        }
+        let tok = state.lexer.next();
+        if let Some(ref tok) = tok {
+            if let Some(ref mut buf) = state.bufs[1 - self.side] {
+                buf.push_back(tok.clone());
+            }
+        }
+        tok
+    }
+}
+
+impl<'ns, B: BufRead> Drop for Tee<'ns, B> {
+    fn drop(&mut self) {
+        self.shared.borrow_mut().bufs[self.side] = None;
+    }
+}
+
 // Lexing Logic
 // --------------------------------------------------
 
 impl<'ns, B: BufRead> Lexer<'ns, B> {
     /// The main switch of the lexer.
     fn lex(&self, line: &str) -> (Token<'ns>, usize) {
+        // Most source text is ASCII. Switch on the first byte when we can,
+        // rather than decoding a char and consulting the Unicode tables.
+        let byte = line.as_bytes()[0];
+        if byte < 0x80 {
+            return match byte {
+                b'(' | b')' | b'[' | b']' | b'{' | b'}' | b',' | b'|' => self.lex_simple(line),
+                b'.' => self.lex_functor(line),
+                b'%' => self.lex_comment(line),
+                b'_' => self.lex_var(line),
+                b'\'' | b'\"' | b'`' => self.lex_quote(line),
+                b'-' => self.lex_minus(line),
+                b'0' => self.lex_zero(line),
+                b if b'1' <= b && b <= b'9' => self.lex_decimal(line),
+                b if b <= b' ' || b == 0x7f => self.lex_space(line),
+                b if b'A' <= b && b <= b'Z' => self.lex_var(line),
+                _ => self.lex_functor(line),
+            };
+        }
+
         match line.chars().nth(0).unwrap() {
             '(' => self.lex_simple(line),
             ')' => self.lex_simple(line),
@@ -226,11 +566,12 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
             '}' => self.lex_simple(line),
             ',' => self.lex_simple(line),
             '|' => self.lex_simple(line),
-            '.' => self.lex_simple(line),
+            '.' => self.lex_functor(line),
             '%' => self.lex_comment(line),
             '_' => self.lex_var(line),
             '\'' => self.lex_quote(line),
             '\"' => self.lex_quote(line),
+            '`' => self.lex_quote(line),
             '-' => self.lex_minus(line),
             '0' => self.lex_zero(line),
             ch if ch.is_digit(10) => self.lex_decimal(line),
@@ -247,9 +588,13 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
     /// and underscores or only symbols and punctuation. Function symbols may
     /// not start with a capital or underscore (though this is not checked).
     ///
-    /// Commas, periods, and pipes are not allowed within other function
+    /// The solo characters `!`, `,`, `;`, and `|` always form symbols on their
+    /// own, and quotes, back quotes, and the percent sign are never part of
     /// symbols.
     ///
+    /// A lone period may instead be the end token. See `strict_dot` and
+    /// `dot_operator`.
+    ///
     /// The token MUST be at the start of the line.
     fn lex_functor(&self, line: &str) -> (Token<'ns>, usize) {
         lazy_static! {
@@ -260,14 +605,45 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
         }
 
         let m = RE.find(line).unwrap();
-        let s = m.as_str()
-            .split(|ch| ch == ',' || ch == '.' || ch == '|')
-            .nth(0)
-            .unwrap();
-        let tok = Token::Funct(self.line(), self.col(), self.ns.name(s));
+        let mut s = m.as_str();
+        if let Some(i) = s.find(|ch| "!,;|%'\"`".contains(ch)) {
+            if i == 0 {
+                s = &s[..1];
+            } else {
+                s = &s[..i];
+            }
+        }
+
+        if s == "." && self.is_end(&line[1..]) {
+            return (Token::Dot(self.line(), self.col()), 1);
+        }
+
+        let tok = match s {
+            "," => Token::Comma(self.line(), self.col(), self.ns.name(s)),
+            "|" => Token::Bar(self.line(), self.col(), self.ns.name(s)),
+            _ => Token::Funct(self.line(), self.col(), self.ns.name(s)),
+        };
         (tok, s.len())
     }
 
+    /// Returns true if a period followed by the given text is an end token.
+    fn is_end(&self, rest: &str) -> bool {
+        match rest.chars().nth(0) {
+            None | Some('%') => true,
+            Some(ch) if ch.is_whitespace() => true,
+            _ if self.dot_operator && self.glued_before() => false,
+            _ => !self.strict_dot && self.depth == 0,
+        }
+    }
+
+    /// Returns true if the character before the current column is not layout.
+    fn glued_before(&self) -> bool {
+        match self.buf_norm[..self.col - 1].chars().next_back() {
+            Some(ch) => !ch.is_whitespace(),
+            None => false,
+        }
+    }
+
     /// Returns the token for a variable term.
     ///
     /// Variables start with a capital letter or underscore and are composed
@@ -374,6 +750,20 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
     ///
     /// The token MUST be at the start of the line.
     fn lex_decimal(&self, line: &str) -> (Token<'ns>, usize) {
+        // Most numbers are small integers. When the number is a short run of
+        // ASCII digits, compute its value directly rather than matching the
+        // regex and parsing the match. Eighteen digits always fit in an i64.
+        let bytes = line.as_bytes();
+        let n = bytes.iter().take_while(|&&b| b'0' <= b && b <= b'9').count();
+        let simple = match bytes.get(n) {
+            Some(&b) => b < 0x80 && b != b'.' && b != b'e' && b != b'_',
+            None => true,
+        };
+        if simple && n <= 18 {
+            let val = bytes[..n].iter().fold(0, |val, &b| val * 10 + (b - b'0') as i64);
+            return (Token::Int(self.line(), self.col(), val), n);
+        }
+
         lazy_static! {
             static ref RE: Regex = {
                 let pattern = r"^\d[\d_]*(\.[\d_]+)?(e-?[\d_]+)?";
@@ -383,32 +773,50 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
 
         let m = RE.find(line).unwrap();
         let s = m.as_str();
+        let digits = s.replace('_', "");
         let float = s.chars().any(|ch| ch == 'e' || ch == '.');
         let tok = match float {
-            true => Token::Float(self.line(), self.col(), s.parse().unwrap()),
-            false => Token::Int(self.line(), self.col(), s.parse().unwrap()),
+            true => Token::Float(self.line(), self.col(), digits.parse().unwrap()),
+            false => Token::Int(self.line(), self.col(), digits.parse().unwrap()),
         };
         (tok, s.len())
     }
 
     /// Returns a token for a function symbol or string enclosed in quotes.
     ///
+    /// Single quotes give function symbols, double quotes give strings, and
+    /// back quotes give `BackQuote` tokens. The parser interprets strings and
+    /// back quotes according to the `double_quotes` and `back_quotes` flags.
+    ///
     /// Escape sequences are replaced and the token will not include the
-    /// surrounding quotes. An error is returned if the quote is unclosed.
+    /// surrounding quotes. Besides the single character escapes, a code point
+    /// may be given in hexadecimal as `\xHH..\`, `\uHHHH`, or `\UHHHHHHHH`.
+    /// An error is returned if the quote is unclosed or if an escape does not
+    /// give a Unicode scalar value; surrogates and code points above
+    /// `0x10FFFF` are rejected.
     ///
     /// The token MUST be at the start of the line.
     fn lex_quote(&self, line: &str) -> (Token<'ns>, usize) {
         let quote = line.chars().nth(0).unwrap();
         let mut buf = String::with_capacity(32);
         let mut escape = false;
+        let mut len = line.len();
         let mut ok = false;
-        for ch in line.chars().skip(1) {
+        let mut bad_escape = false;
+        let mut chars = line.char_indices().skip(1).peekable();
+        while let Some((i, ch)) = chars.next() {
             if escape {
                 match ch {
                     'n' => buf.push('\n'),
                     'r' => buf.push('\r'),
                     't' => buf.push('\t'),
                     '\\' => buf.push('\\'),
+                    'x' | 'u' | 'U' => {
+                        match read_code_point(ch, &mut chars) {
+                            Some(ch) => buf.push(ch),
+                            None => bad_escape = true,
+                        }
+                    },
                     ch => buf.push(ch),
                 }
                 escape = false;
@@ -417,6 +825,7 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
                     '\\' => escape = true,
                     ch if ch == quote => {
                         ok = true;
+                        len = i + 1;
                         break;
                     },
                     ch => buf.push(ch),
@@ -424,9 +833,10 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
             }
         }
 
-        let len = buf.len() + 2;
         let tok = match ok {
+            true if bad_escape => Token::Err(SyntaxError::bad_escape(self.line(), self.col())),
             true if quote == '\"' => Token::Str(self.line(), self.col(), self.ns.name(buf)),
+            true if quote == '`' => Token::BackQuote(self.line(), self.col(), self.ns.name(buf)),
             true => Token::Funct(self.line(), self.col(), self.ns.name(buf)),
             false => Token::Err(SyntaxError::unbalanced(self.line(), self.col(), quote)),
         };
@@ -435,7 +845,7 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
 
     /// Returns the token for a single char symbol.
     ///
-    /// These include the various parens as well as the comma, bar, and period.
+    /// These include the various parens as well as the comma and bar.
     ///
     /// The token MUST be at the start of the line.
     fn lex_simple(&self, line: &str) -> (Token<'ns>, usize) {
@@ -448,7 +858,6 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
             '}' => Token::BraceClose(self.line(), self.col()),
             ',' => Token::Comma(self.line(), self.col(), self.ns.name(",")),
             '|' => Token::Bar(self.line(), self.col(), self.ns.name("|")),
-            '.' => Token::Dot(self.line(), self.col()),
             _ => unreachable!("lex_simple must be called with a simple character"),
         };
         (tok, 1)
@@ -476,7 +885,8 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
 
     /// Retuns a token for a comment.
     ///
-    /// Comments start with '%' and extend to the end of the line.
+    /// Comments start with '%' and extend to the end of the line. Comments
+    /// starting with `%!` are documentation.
     ///
     /// The token MUST be at the start of the line.
     fn lex_comment(&self, line: &str) -> (Token<'ns>, usize) {
@@ -489,11 +899,54 @@ impl<'ns, B: BufRead> Lexer<'ns, B> {
 
         let m = RE.find(line).unwrap();
         let s = m.as_str();
-        let tok = Token::Space(self.line(), self.col());
+        let kind = match s.starts_with("%!") {
+            true => CommentKind::Doc,
+            false => CommentKind::Line,
+        };
+        let tok = Token::Comment(self.line(), self.col(), kind);
         (tok, s.len())
     }
 }
 
+/// Reads the digits of a numeric escape sequence, following the `x`, `u`, or
+/// `U`, and returns the character they encode.
+///
+/// Returns `None` if the digits are malformed or do not encode a Unicode
+/// scalar value.
+fn read_code_point<I>(kind: char, chars: &mut Peekable<I>) -> Option<char>
+where
+    I: Iterator<Item = (usize, char)>,
+{
+    let max = match kind {
+        'u' => 4,
+        'U' => 8,
+        _ => usize::MAX,
+    };
+    let mut digits = String::with_capacity(8);
+    while digits.len() < max {
+        match chars.peek() {
+            Some(&(_, d)) if d.is_digit(16) => digits.push(d),
+            _ => break,
+        }
+        chars.next();
+    }
+
+    // ISO escapes are closed by a backslash. The others have a fixed length.
+    if kind == 'x' {
+        match chars.peek() {
+            Some(&(_, '\\')) => chars.next(),
+            _ => return None,
+        };
+    } else if digits.len() < max {
+        return None;
+    }
+
+    match u32::from_str_radix(&digits, 16) {
+        Ok(code) => char::from_u32(code),
+        Err(_) => None,
+    }
+}
+
 // Tests
 // --------------------------------------------------
 
@@ -538,6 +991,205 @@ mod test {
             assert_eq!(lexer.next().unwrap(), *tok);
         }
         assert!(lexer.next().is_none());
+        assert!(lexer.next().is_none());
+    }
+
+    #[test]
+    fn symbols() {
+        let ns = NameSpace::new();
+        let pl = "a=b a==b a=..b a=:=b a=\\=b";
+        let ops = ["=", "==", "=..", "=:=", "=\\="];
+
+        // Overlapping symbols are lexed to the longest match.
+        let mut lexer = Lexer::new(pl.as_bytes(), &ns);
+        for op in ops.iter() {
+            assert_eq!(lexer.next().unwrap().to_string(), "a");
+            assert_eq!(lexer.next().unwrap().to_string(), *op);
+            assert_eq!(lexer.next().unwrap().to_string(), "b");
+        }
+        assert!(lexer.next().is_none());
+    }
+
+    #[test]
+    fn quotes() {
+        let ns = NameSpace::new();
+        let pl = "`abc` `a\\`b\\nc` 'it\\'s' \"\\\"\" x";
+
+        let mut lexer = Lexer::new(pl.as_bytes(), &ns);
+        assert_eq!(lexer.next().unwrap(), Token::BackQuote(1, 1, ns.name("abc")));
+        assert_eq!(lexer.next().unwrap(), Token::BackQuote(1, 7, ns.name("a`b\nc")));
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 17, ns.name("it's")));
+        assert_eq!(lexer.next().unwrap(), Token::Str(1, 25, ns.name("\"")));
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 30, ns.name("x")));
+        assert!(lexer.next().is_none());
+    }
+
+    #[test]
+    fn escapes() {
+        let ns = NameSpace::new();
+        let pl = "'\\x41\\' '\\u00e9' \"\\U0001F600\" '\\uD800' '\\U00110000' '\\x41' x";
+
+        let mut lexer = Lexer::new(pl.as_bytes(), &ns).normalize(false);
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 1, ns.name("A")));
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 9, ns.name("\u{e9}")));
+        assert_eq!(lexer.next().unwrap(), Token::Str(1, 18, ns.name("\u{1F600}")));
+
+        // Lone surrogates, code points out of range, and unclosed ISO escapes
+        // are errors. Lexing resumes after the closing quote.
+        assert_eq!(lexer.next().unwrap().to_string(), "1:31: invalid escape sequence");
+        assert_eq!(lexer.next().unwrap().to_string(), "1:40: invalid escape sequence");
+        assert_eq!(lexer.next().unwrap().to_string(), "1:53: invalid escape sequence");
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 60, ns.name("x")));
+        assert!(lexer.next().is_none());
+    }
+
+    #[test]
+    fn tee() {
+        let ns = NameSpace::new();
+        let pl = "foo(X, 'bar').\nbaz.\n";
+        let toks: Vec<_> = Lexer::new(pl.as_bytes(), &ns).collect();
+
+        // Each side sees every token, however the reads are interleaved.
+        let (mut a, mut b) = Lexer::new(pl.as_bytes(), &ns).tee();
+        let mut xs = vec![a.next().unwrap(), a.next().unwrap(), a.next().unwrap()];
+        let mut ys = vec![b.next().unwrap()];
+        ys.extend(b.by_ref().take(5));
+        xs.extend(a.by_ref());
+        ys.extend(b.by_ref());
+        assert_eq!(xs, toks);
+        assert_eq!(ys, toks);
+
+        // Either side may be dropped without affecting the other.
+        let (a, mut b) = Lexer::new(pl.as_bytes(), &ns).tee();
+        let first = b.next().unwrap();
+        drop(a);
+        let mut ys = vec![first];
+        ys.extend(b);
+        assert_eq!(ys, toks);
+    }
+
+    #[test]
+    fn non_ascii() {
+        let ns = NameSpace::new();
+        let pl = "\u{C9}t\u{E9} \u{E9}t\u{E9} \u{3000}\u{2192}";
+
+        // Chars outside of ASCII are classified by their Unicode properties.
+        let mut lexer = Lexer::new(pl.as_bytes(), &ns).normalize(false);
+        assert_eq!(lexer.next().unwrap(), Token::Var(1, 1, ns.name("\u{C9}t\u{E9}")));
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 7, ns.name("\u{E9}t\u{E9}")));
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 16, ns.name("\u{2192}")));
+        assert!(lexer.next().is_none());
+    }
+
+    #[test]
+    fn comments() {
+        let ns = NameSpace::new();
+        let pl = "% ordinary\n%! doc(+Arg)\nfoo. %!\n";
+
+        let mut lexer = Lexer::new(pl.as_bytes(), &ns).report_space(true);
+        let toks: Vec<_> = lexer.by_ref().filter(|tok| !is_space(tok)).collect();
+        assert_eq!(toks, vec![
+            Token::Comment(1, 1, CommentKind::Line),
+            Token::Comment(2, 1, CommentKind::Doc),
+            Token::Funct(3, 1, ns.name("foo")),
+            Token::Dot(3, 4),
+            Token::Comment(3, 6, CommentKind::Doc),
+        ]);
+
+        // Comments are skipped by default.
+        let toks: Vec<_> = Lexer::new(pl.as_bytes(), &ns).collect();
+        assert_eq!(toks, vec![Token::Funct(3, 1, ns.name("foo")), Token::Dot(3, 4)]);
+    }
+
+    fn is_space(tok: &Token) -> bool {
+        match *tok {
+            Token::Space(..) => true,
+            _ => false,
+        }
+    }
+
+    #[test]
+    fn normalize() {
+        let ns = NameSpace::new();
+        let pl = "\u{FB01}x \u{FF46}\u{FF4F}\u{FF4F}";
+
+        let mut lexer = Lexer::new(pl.as_bytes(), &ns);
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 1, ns.name("fix")));
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 5, ns.name("foo")));
+
+        let mut lexer = Lexer::new(pl.as_bytes(), &ns).normalize(false);
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 1, ns.name("\u{FB01}x")));
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 6, ns.name("\u{FF46}\u{FF4F}\u{FF4F}")));
+    }
+
+    #[test]
+    fn integers() {
+        let ns = NameSpace::new();
+        let pl = "0 7 255 999999999999999999 9223372036854775807 12.5 3e2 1_000 42.";
+        let toks: Vec<_> = Lexer::new(pl.as_bytes(), &ns).collect();
+        assert_eq!(toks, vec![
+            Token::Int(1, 1, 0),
+            Token::Int(1, 3, 7),
+            Token::Int(1, 5, 255),
+            Token::Int(1, 9, 999999999999999999),
+            Token::Int(1, 28, 9223372036854775807),
+            Token::Float(1, 48, 12.5),
+            Token::Float(1, 53, 300.0),
+            Token::Int(1, 57, 1000),
+            Token::Int(1, 63, 42),
+            Token::Dot(1, 65),
+        ]);
+    }
+
+    #[test]
+    fn end_dot() {
+        let ns = NameSpace::new();
+        let pl = "foo.bar. X =.. Y.";
+
+        let mut lexer = Lexer::new(pl.as_bytes(), &ns);
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 1, ns.name("foo")));
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 4, ns.name(".")));
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 5, ns.name("bar")));
+        assert_eq!(lexer.next().unwrap(), Token::Dot(1, 8));
+        assert_eq!(lexer.next().unwrap(), Token::Var(1, 10, ns.name("X")));
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 12, ns.name("=..")));
+        assert_eq!(lexer.next().unwrap(), Token::Var(1, 16, ns.name("Y")));
+        assert_eq!(lexer.next().unwrap(), Token::Dot(1, 17));
+        assert!(lexer.next().is_none());
+
+        let mut lexer = Lexer::new(pl.as_bytes(), &ns).strict_dot(false);
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 1, ns.name("foo")));
+        assert_eq!(lexer.next().unwrap(), Token::Dot(1, 4));
+        assert_eq!(lexer.next().unwrap(), Token::Funct(1, 5, ns.name("bar")));
+        assert_eq!(lexer.next().unwrap(), Token::Dot(1, 8));
+
+        // Periods within brackets are never end tokens.
+        let mut lexer = Lexer::new("f(a.b).".as_bytes(), &ns).strict_dot(false);
+        assert_eq!(lexer.nth(3).unwrap(), Token::Funct(1, 4, ns.name(".")));
+    }
+
+    #[test]
+    fn dot_operator() {
+        let ns = NameSpace::new();
+        let pl = "X = a.b. a.\nb .c.";
+        let toks: Vec<_> = Lexer::new(pl.as_bytes(), &ns)
+            .strict_dot(false)
+            .dot_operator(true)
+            .collect();
+        assert_eq!(toks, vec![
+            Token::Var(1, 1, ns.name("X")),
+            Token::Funct(1, 3, ns.name("=")),
+            Token::Funct(1, 5, ns.name("a")),
+            Token::Funct(1, 6, ns.name(".")),
+            Token::Funct(1, 7, ns.name("b")),
+            Token::Dot(1, 8),
+            Token::Funct(1, 10, ns.name("a")),
+            Token::Dot(1, 11),
+            Token::Funct(2, 1, ns.name("b")),
+            Token::Dot(2, 3),
+            Token::Funct(2, 4, ns.name("c")),
+            Token::Dot(2, 5),
+        ]);
     }
 
     #[test]
@@ -586,4 +1238,38 @@ mod test {
         }
         assert!(lexer.next().is_none());
     }
+
+    #[test]
+    fn index_lines() {
+        let ns = NameSpace::new();
+        let pl = "a('ü').\nb.\n";
+        let mut lexer = Lexer::new(pl.as_bytes(), &ns).index_lines(true);
+        assert_eq!(lexer.by_ref().count(), 7);
+        let index = lexer.line_index().unwrap();
+        assert_eq!(index.len(), pl.len());
+        assert_eq!(index.position(7), Some((1, 7)));
+        assert_eq!(index.offset(2, 2), Some(10));
+    }
+
+    #[test]
+    fn encoded() {
+        let ns = NameSpace::new();
+
+        // A byte order mark at the start of a source is skipped.
+        let pl = "\u{feff}foo.";
+        let toks: Vec<_> = Lexer::new(pl.as_bytes(), &ns).collect();
+        assert_eq!(toks, vec![Token::Funct(1, 1, ns.name("foo")), Token::Dot(1, 4)]);
+        let pl = b"\xff\xfef\x00(\x00\xe9\x00)\x00";
+        let toks: Vec<_> = Lexer::encoded(&pl[..], Encoding::Utf16Le, &ns).collect();
+        assert_eq!(toks.len(), 4);
+        assert_eq!(toks[2], Token::Funct(1, 3, ns.name("é")));
+
+        let pl = b"caf\xe9 '\xe0 la'.";
+        let toks: Vec<_> = Lexer::encoded(&pl[..], Encoding::Latin1, &ns).collect();
+        assert_eq!(toks, vec![
+            Token::Funct(1, 1, ns.name("café")),
+            Token::Funct(1, 7, ns.name("à la")),
+            Token::Dot(1, 14),
+        ]);
+    }
 }
@@ -0,0 +1,177 @@
+/// An index for converting between byte offsets and line/column positions.
+///
+/// The index records the offset at which each line starts and the offset of
+/// each multi-byte character. Converting a position is then a binary search
+/// rather than a scan of the source, which suits editor integrations that
+/// convert many positions in the same text.
+///
+/// Lines and columns are numbered from 1. Columns count characters, not
+/// bytes. Offsets should fall on character boundaries.
+///
+/// The index may be built incrementally by pushing the text a chunk at a
+/// time, e.g. a line at a time while lexing.
+#[derive(Debug)]
+#[derive(Clone)]
+pub struct LineIndex {
+    len: usize,
+    lines: Vec<usize>,
+    wide: Vec<(usize, usize)>,
+}
+
+impl LineIndex {
+    /// Constructs an index of empty text.
+    pub fn new() -> LineIndex {
+        LineIndex {
+            len: 0,
+            lines: vec![0],
+            wide: Vec::new(),
+        }
+    }
+
+    /// Constructs an index of the given text.
+    pub fn build(text: &str) -> LineIndex {
+        let mut index = LineIndex::new();
+        index.push(text);
+        index
+    }
+
+    /// Appends text to the end of the index.
+    pub fn push(&mut self, text: &str) {
+        for (i, ch) in text.char_indices() {
+            let n = ch.len_utf8();
+            if 1 < n {
+                self.wide.push((self.len + i, n - 1));
+            }
+            if ch == '\n' {
+                self.lines.push(self.len + i + 1);
+            }
+        }
+        self.len += text.len();
+    }
+
+    /// Returns the length of the indexed text in bytes.
+    pub fn len(&self) -> usize {
+        self.len
+    }
+
+    /// Returns the number of lines in the indexed text.
+    ///
+    /// Text ending with a newline is followed by an empty line.
+    pub fn line_count(&self) -> usize {
+        self.lines.len()
+    }
+
+    /// Converts a byte offset to a line and column.
+    ///
+    /// Returns `None` if the offset is beyond the end of the text.
+    pub fn position(&self, offset: usize) -> Option<(usize, usize)> {
+        if self.len < offset {
+            return None;
+        }
+        let line = match self.lines.binary_search(&offset) {
+            Ok(i) => i,
+            Err(i) => i - 1,
+        };
+        let start = self.lines[line];
+        let extra: usize = self.wide[self.wide_from(start)..self.wide_from(offset)]
+            .iter()
+            .map(|&(_, n)| n)
+            .sum();
+        Some((line + 1, offset - start - extra + 1))
+    }
+
+    /// Converts a line and column to a byte offset.
+    ///
+    /// The column may be one past the last character of the line. Returns
+    /// `None` if the position is not in the text.
+    pub fn offset(&self, line: usize, col: usize) -> Option<usize> {
+        if line == 0 || col == 0 || self.lines.len() < line {
+            return None;
+        }
+        let start = self.lines[line - 1];
+        let end = self.lines.get(line).cloned().unwrap_or(self.len);
+        let mut offset = start + col - 1;
+        for &(at, n) in &self.wide[self.wide_from(start)..] {
+            if offset <= at {
+                break;
+            }
+            offset += n;
+        }
+        if offset <= end {
+            Some(offset)
+        } else {
+            None
+        }
+    }
+
+    /// Returns the index of the first multi-byte character at or after the
+    /// given offset.
+    fn wide_from(&self, offset: usize) -> usize {
+        match self.wide.binary_search_by_key(&offset, |&(at, _)| at) {
+            Ok(i) => i,
+            Err(i) => i,
+        }
+    }
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn conversions() {
+        let text = "foo(X) :-\n  bar(X, 'é').\n\n% ünïcödé\nbaz.\n";
+        let index = LineIndex::build(text);
+        assert_eq!(index.line_count(), 6);
+
+        let cases = vec![
+            (0, (1, 1)),
+            (4, (1, 5)),
+            (10, (2, 1)),
+            (12, (2, 3)),
+            (20, (2, 11)),
+            (22, (2, 12)),
+            (25, (2, 15)),
+            (26, (3, 1)),
+            (27, (4, 1)),
+            (29, (4, 3)),
+            (31, (4, 4)),
+            (34, (4, 6)),
+            (40, (4, 10)),
+            (41, (5, 1)),
+            (46, (6, 1)),
+        ];
+        for (offset, pos) in cases {
+            assert_eq!(index.position(offset), Some(pos));
+            assert_eq!(index.offset(pos.0, pos.1), Some(offset));
+        }
+
+        assert_eq!(index.position(47), None);
+        assert_eq!(index.offset(0, 1), None);
+        assert_eq!(index.offset(2, 17), None);
+        assert_eq!(index.offset(7, 1), None);
+    }
+
+    #[test]
+    fn incremental() {
+        let text = "a(ü).\nb.\r\nc.";
+        let mut index = LineIndex::new();
+        for line in text.split_terminator('\n') {
+            index.push(line);
+            index.push("\n");
+        }
+        let full = format!("{}\n", text);
+        let whole = LineIndex::build(&full);
+        assert_eq!(index.len(), whole.len());
+        for offset in 0..full.len() + 1 {
+            if full.is_char_boundary(offset) {
+                assert_eq!(index.position(offset), whole.position(offset));
+            }
+        }
+        assert_eq!(index.position(6), Some((1, 6)));
+        assert_eq!(index.position(11), Some((3, 1)));
+    }
+}
@@ -1,12 +1,28 @@
+pub mod flags;
 pub mod lexer;
 pub mod namespace;
 pub mod operators;
 pub mod parser;
+pub mod writer;
+mod cache;
+mod diff;
+mod encoding;
 mod error;
+mod incremental;
+mod indicator;
+mod lines;
 mod repr;
+mod source;
 
+pub use self::cache::Cache;
+pub use self::diff::{diff, Difference};
+pub use self::encoding::{Decoder, Encoding};
 pub use self::error::{Result, SyntaxError};
+pub use self::incremental::{reparse, Edit};
+pub use self::indicator::Indicator;
+pub use self::lines::LineIndex;
 pub use self::repr::{Structure, Symbol};
+pub use self::source::Source;
 use self::namespace::*;
 use self::operators::*;
 use self::parser::*;
@@ -57,14 +73,29 @@ impl<'a> Context<'a> {
         Parser::new(reader, &self.ns, &self.ops)
     }
 
+    /// Parse a byte slice in memory.
+    ///
+    /// Byte slices are read directly, without any intermediate buffering.
+    pub fn parse_bytes<'b>(&self, bytes: &'b [u8]) -> Parser<&'b [u8]> {
+        Parser::new(bytes, &self.ns, &self.ops)
+    }
+
+    /// Parse some named source.
+    ///
+    /// Syntax errors are attributed to the source in which they occur.
+    pub fn parse_source<B: BufRead>(&self, source: Source<B>) -> Parser<B> {
+        Parser::from_source(source, &self.ns, &self.ops)
+    }
+
     /// Parse a file at the given path.
     ///
-    /// See the `parse` method for more details.
+    /// The path is used as the name of the source. See the `parse` method for
+    /// more details.
     pub fn parse_file<P: AsRef<Path>>(&self, path: P) -> Parser<BufReader<File>> {
         let path = path.as_ref();
         let f = File::open(path).unwrap();
         let bf = BufReader::new(f);
-        self.parse(bf)
+        self.parse_source(Source::new(path.to_string_lossy(), bf))
     }
 }
 
@@ -102,4 +133,15 @@ mod test {
         assert_eq!(parser.next().unwrap().unwrap().as_slice(), second);
         assert_eq!(parser.next(), None);
     }
+
+    #[test]
+    fn parse_bytes() {
+        let ctx = Context::new();
+        let mut parser = ctx.parse_bytes(b"foo(X). bar.");
+        let foo = &[Var(0), Funct(1, ctx.ns.name("foo"))];
+        let bar = &[Funct(0, ctx.ns.name("bar"))];
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), foo);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), bar);
+        assert_eq!(parser.next(), None);
+    }
 }
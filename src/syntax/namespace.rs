@@ -19,7 +19,7 @@
 
 use std::cell::RefCell;
 use std::cmp::{Ordering, PartialOrd};
-use std::collections::HashSet;
+use std::collections::{HashMap, HashSet};
 use std::fmt;
 use std::hash::{Hash, Hasher};
 use std::marker::PhantomData;
@@ -81,6 +81,54 @@ impl NameSpace {
         Name::from(s)
     }
 
+    /// Issues a `Name` for every string in another `NameSpace`.
+    ///
+    /// Returns a translation from the names of the other namespace to the
+    /// names of this one, so that structures named by the other namespace
+    /// can be moved into this one.
+    pub fn import<'a, 'b>(&'a self, other: &'b NameSpace) -> HashMap<Name<'b>, Name<'a>> {
+        let names: Vec<Name<'b>> = {
+            let strings = other.strings.borrow();
+            strings
+                .iter()
+                .map(|s| Name::from(unsafe { mem::transmute::<&str, &'b str>(s) }))
+                .collect()
+        };
+        names.into_iter().map(|name| (name, self.name(name.as_str()))).collect()
+    }
+
+    /// Returns the names issued for strings starting with a prefix, in
+    /// lexicographic order.
+    ///
+    /// This is intended for completion in an interactive session. Operators
+    /// are named by the namespace, so their names are included, as are the
+    /// names of variables and the text of strings read by a parser.
+    pub fn complete<'ns>(&'ns self, prefix: &str) -> Vec<Name<'ns>> {
+        let strings = self.strings.borrow();
+        let mut names: Vec<Name<'ns>> = strings
+            .iter()
+            .map(|s| unsafe { mem::transmute::<&str, &'ns str>(s) })
+            .filter(|s| s.starts_with(prefix))
+            .map(Name::from)
+            .collect();
+        names.sort();
+        names
+    }
+
+    /// Returns the names issued for strings from `lo` up to, but not
+    /// including, `hi`, in lexicographic order.
+    pub fn range<'ns>(&'ns self, lo: &str, hi: &str) -> Vec<Name<'ns>> {
+        let strings = self.strings.borrow();
+        let mut names: Vec<Name<'ns>> = strings
+            .iter()
+            .map(|s| unsafe { mem::transmute::<&str, &'ns str>(s) })
+            .filter(|&s| lo <= s && s < hi)
+            .map(Name::from)
+            .collect();
+        names.sort();
+        names
+    }
+
     /// Returns the number of unique `Name`s issued.
     pub fn len(&self) -> usize {
         self.strings.borrow().len()
@@ -191,6 +239,52 @@ mod test {
         assert!(b < a);
     }
 
+    #[test]
+    fn import() {
+        let ns1 = NameSpace::new();
+        let a = ns1.name("foo");
+        let ns2 = NameSpace::new();
+        let b = ns2.name("foo");
+        let c = ns2.name("bar");
+
+        let names = ns1.import(&ns2);
+        assert_eq!(names.len(), 2);
+        assert_eq!(names[&b], a);
+        assert_eq!(names[&c], ns1.name("bar"));
+        assert_eq!(ns1.len(), 2);
+
+        // Importing a namespace into itself changes nothing.
+        let names = ns1.import(&ns1);
+        assert_eq!(names[&a], a);
+        assert_eq!(ns1.len(), 2);
+    }
+
+    #[test]
+    fn complete() {
+        let ns = NameSpace::new();
+        for name in ["append", "atom", "apply", "member", "app", "ap", "b"].iter() {
+            ns.name(*name);
+        }
+        let names: Vec<&str> = ns.complete("app").iter().map(|name| name.as_str()).collect();
+        assert_eq!(names, vec!["app", "append", "apply"]);
+        assert_eq!(ns.complete("x"), vec![]);
+        assert_eq!(ns.complete("").len(), ns.len());
+    }
+
+    #[test]
+    fn range() {
+        let ns = NameSpace::new();
+        for i in 0..100 {
+            ns.name(format!("f{:02}", i));
+        }
+        let names: Vec<&str> = ns.range("f10", "f13").iter().map(|name| name.as_str()).collect();
+        assert_eq!(names, vec!["f10", "f11", "f12"]);
+        assert_eq!(ns.range("f1", "f2").len(), 10);
+        assert_eq!(ns.range("f5", "f5"), vec![]);
+        assert_eq!(ns.range("g", "h"), vec![]);
+        assert_eq!(ns.range("", "g").len(), 100);
+    }
+
     #[test]
     fn eq() {
         let ns1 = NameSpace::new();
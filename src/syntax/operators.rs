@@ -4,6 +4,7 @@ use std::cmp::Ordering;
 use std::ops::Deref;
 
 use syntax::namespace::{Name, NameSpace};
+use syntax::repr::{Structure, Symbol};
 
 /// An entry in the `OpTable`.
 ///
@@ -53,7 +54,19 @@ pub enum OpType {
 ///
 /// The table is implemented as a sorted list of `Op`s. Operators are sorted
 /// first by name, then by type, and finally by precedence.
+///
+/// A table owns its operators, so a clone is an independent snapshot. To
+/// extend a table temporarily, e.g. while parsing an included file, clone it
+/// beforehand and restore it by assignment afterwards.
+///
+/// A table is `Send` and `Sync`. It has no internal locking: the borrow
+/// checker forbids modifying a table while it is borrowed for reading, e.g.
+/// by a parser. To share a table which other threads modify, wrap it in a
+/// `RwLock`. A parser only reads the table between clauses, and directives
+/// update the parser's own copy.
 #[derive(Debug)]
+#[derive(Clone)]
+#[derive(PartialEq, Eq)]
 pub struct OpTable<'ns>(Vec<Op<'ns>>);
 
 // OpTable
@@ -80,6 +93,52 @@ impl<'ns> OpTable<'ns> {
         }
     }
 
+    /// Returns the operators which conflict with a new operator.
+    ///
+    /// These are the operators of the same name and category, which
+    /// `insert` or `define` would replace, and operators which would make
+    /// the new operator ambiguous. Following the ISO standard, a name may not
+    /// be both an infix and a postfix operator. A name may be both a prefix
+    /// and an infix operator. An operator identical to the new one is not a
+    /// conflict.
+    pub fn conflicts(&self, op: Op<'ns>) -> Vec<Op<'ns>> {
+        let ty = op.op_type();
+        self.get(op.name())
+            .iter()
+            .cloned()
+            .filter(|&other| other != op)
+            .filter(|other| match (ty, other.op_type()) {
+                (OpType::Infix, OpType::Postfix) | (OpType::Postfix, OpType::Infix) => true,
+                (a, b) => a == b,
+            })
+            .collect()
+    }
+
+    /// Defines operators as done by the `op/3` directive.
+    ///
+    /// Each name is defined as an operator with the given precedence and type,
+    /// e.g. `"xfx"`, replacing any operator of the same name and category
+    /// (prefix, infix, or postfix). A precedence of 0 removes the operators.
+    ///
+    /// Returns false and leaves the table unchanged if the precedence is
+    /// greater than 1200 or the type is invalid.
+    pub fn define(&mut self, prec: u32, spec: &str, names: &[Name<'ns>]) -> bool {
+        if 1200 < prec {
+            return false;
+        }
+        for &name in names.iter() {
+            let op = match Op::new(prec, spec, name) {
+                Some(op) => op,
+                None => return false,
+            };
+            self.0.retain(|other| other.name() != name || other.op_type() != op.op_type());
+            if prec != 0 {
+                self.insert(op);
+            }
+        }
+        true
+    }
+
     /// Get a slice of all operators matching the given name.
     ///
     /// The resulting slice is in sorted order.
@@ -145,6 +204,32 @@ impl<'ns> OpTable<'ns> {
         }
         return None;
     }
+
+    /// Returns the priority of a term written in operator notation.
+    ///
+    /// The priority is the precedence of the operator at the root of the
+    /// structure, chosen by the arity of the root: binary terms use infix
+    /// operators, and unary terms use prefix operators, or else postfix. The
+    /// priority of atomic terms and terms which are not operator terms is 0.
+    pub fn priority(&self, st: &Structure<'ns>) -> u32 {
+        self.root_op(st).map(|op| op.prec()).unwrap_or(0)
+    }
+
+    /// Returns the operator at the root of a term written in operator
+    /// notation, or `None` if the term is not an operator term.
+    ///
+    /// When a name has several definitions, the operator is chosen by the
+    /// arity of the root as for `priority`. This tells refactoring tools the
+    /// type, and thus the associativity, with which the term is written.
+    pub fn root_op(&self, st: &Structure<'ns>) -> Option<Op<'ns>> {
+        match st.functor() {
+            Symbol::Funct(1, name) => {
+                self.get_prefix(name, 1200).or_else(|| self.get_postfix(name, 1200))
+            },
+            Symbol::Funct(2, name) => self.get_infix(name, 1200),
+            _ => None,
+        }
+    }
 }
 
 impl<'ns> From<Vec<Op<'ns>>> for OpTable<'ns> {
@@ -185,6 +270,23 @@ impl<'ns> AsRef<[Op<'ns>]> for OpTable<'ns> {
 // --------------------------------------------------
 
 impl<'ns> Op<'ns> {
+    /// Constructs an operator from its precedence, type, and name.
+    ///
+    /// The type is given as in the `op/3` directive, e.g. `"xfx"`. Returns
+    /// `None` if the type is invalid.
+    pub fn new(prec: u32, spec: &str, name: Name<'ns>) -> Option<Op<'ns>> {
+        match spec {
+            "xf" => Some(Op::XF(prec, name)),
+            "yf" => Some(Op::YF(prec, name)),
+            "xfx" => Some(Op::XFX(prec, name)),
+            "xfy" => Some(Op::XFY(prec, name)),
+            "yfx" => Some(Op::YFX(prec, name)),
+            "fy" => Some(Op::FY(prec, name)),
+            "fx" => Some(Op::FX(prec, name)),
+            _ => None,
+        }
+    }
+
     #[inline]
     pub fn op_type(&self) -> OpType {
         match *self {
@@ -261,9 +363,11 @@ impl<'ns> OpTable<'ns> {
             Op::FX(1150, ns.name("discontiguous")),
             Op::FX(1150, ns.name("initialization")),
             Op::FX(1150, ns.name("meta_predicate")),
+            Op::FX(1150, ns.name("module")),
             Op::FX(1150, ns.name("module_transparent")),
             Op::FX(1150, ns.name("multifile")),
             Op::FX(1150, ns.name("public")),
+            Op::FX(1150, ns.name("table")),
             Op::FX(1150, ns.name("thread_local")),
             Op::FX(1150, ns.name("thread_initialization")),
             Op::FX(1150, ns.name("volatile")),
@@ -312,6 +416,7 @@ impl<'ns> OpTable<'ns> {
             Op::YFX(400, ns.name("mod")),
             Op::YFX(400, ns.name("rem")),
             Op::XFX(200, ns.name("**")),
+            Op::XFX(200, ns.name("@")),
             Op::XFY(200, ns.name("^")),
             Op::FY(200, ns.name("+")),
             Op::FY(200, ns.name("-")),
@@ -327,7 +432,10 @@ impl<'ns> OpTable<'ns> {
 
 #[cfg(test)]
 mod test {
+    use std::sync::RwLock;
+
     use syntax::namespace::NameSpace;
+    use syntax::parser::Parser;
     use super::*;
 
     #[test]
@@ -350,6 +458,56 @@ mod test {
         assert_eq!(ops.get_postfix(foo, 0), None);
     }
 
+    #[test]
+    #[cfg_attr(rustfmt, rustfmt_skip)]
+    fn define() {
+        let ns = NameSpace::new();
+        let foo = ns.name("foo");
+        let bar = ns.name("bar");
+        let mut ops = OpTable::new();
+        assert!(ops.define(700, "xfx", &[foo, bar]));
+        assert!(ops.define(200, "fy", &[foo]));
+        assert!(ops.define(400, "yfx", &[foo]));
+        assert_eq!(ops.as_slice(), &[
+            Op::XFX(700, bar),
+            Op::FY(200, foo),
+            Op::YFX(400, foo),
+        ]);
+        assert!(ops.define(0, "xfx", &[bar]));
+        assert!(!ops.define(1201, "xfx", &[bar]));
+        assert!(!ops.define(100, "xyz", &[bar]));
+        assert_eq!(ops.as_slice(), &[
+            Op::FY(200, foo),
+            Op::YFX(400, foo),
+        ]);
+    }
+
+    #[test]
+    fn priority() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "a+b. foo(a,b). -a. a. a:-b. -(a,b,c).";
+        let expected = [500, 0, 200, 0, 1200, 0];
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).collect();
+        assert_eq!(clauses.len(), expected.len());
+        for (clause, &prec) in clauses.iter().zip(expected.iter()) {
+            assert_eq!(ops.priority(clause.as_ref().unwrap()), prec);
+        }
+    }
+
+    #[test]
+    fn root_op() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "a - b - c. - a. a = b. f(a, b).";
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).map(|c| c.unwrap()).collect();
+        assert_eq!(ops.root_op(&clauses[0]), Some(Op::YFX(500, ns.name("-"))));
+        assert_eq!(ops.root_op(clauses[0].args()[0]), Some(Op::YFX(500, ns.name("-"))));
+        assert_eq!(ops.root_op(&clauses[1]), Some(Op::FY(200, ns.name("-"))));
+        assert_eq!(ops.root_op(&clauses[2]), Some(Op::XFX(700, ns.name("="))));
+        assert_eq!(ops.root_op(&clauses[3]), None);
+    }
+
     #[test]
     #[cfg_attr(rustfmt, rustfmt_skip)]
     fn insert() {
@@ -369,4 +527,56 @@ mod test {
             Op::FX(3, zap),
         ]);
     }
+
+    #[test]
+    fn conflicts() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let minus = ns.name("-");
+        assert_eq!(ops.conflicts(Op::FX(200, minus)), vec![Op::FY(200, minus)]);
+        assert_eq!(ops.conflicts(Op::FY(200, minus)), vec![]);
+        assert_eq!(ops.conflicts(Op::XFX(700, minus)), vec![Op::YFX(500, minus)]);
+        assert_eq!(ops.conflicts(Op::XF(100, minus)), vec![Op::YFX(500, minus)]);
+        assert_eq!(ops.conflicts(Op::XFX(700, ns.name("foo"))), vec![]);
+    }
+
+    #[test]
+    fn send_sync() {
+        fn assert_send_sync<T: Send + Sync>(_: &T) {}
+        let ns = NameSpace::new();
+        let ops = RwLock::new(OpTable::default(&ns));
+        assert_send_sync(&ops);
+
+        let minus = ns.name("-");
+        let before = ops.read().unwrap().clone();
+        ops.write().unwrap().define(0, "yfx", &[minus]);
+        assert_eq!(ops.read().unwrap().get_infix(minus, 1200), None);
+        assert_eq!(before.get_infix(minus, 1200), Some(Op::YFX(500, minus)));
+    }
+
+    #[test]
+    fn snapshot() {
+        let ns = NameSpace::new();
+        let foo = ns.name("foo");
+        let mut ops = OpTable::default(&ns);
+        let saved = ops.clone();
+        assert!(ops.define(700, "xfx", &[foo]));
+        assert!(ops.define(0, "xfx", &[ns.name("=")]));
+        assert_eq!(saved.get(foo), &[]);
+        assert_eq!(saved.get_infix(ns.name("="), 1200), Some(Op::XFX(700, ns.name("="))));
+        ops = saved;
+        assert_eq!(ops, OpTable::default(&ns));
+    }
+
+    #[test]
+    fn default_is_fresh() {
+        let ns = NameSpace::new();
+        let foo = ns.name("foo");
+        let mut ops = OpTable::default(&ns);
+        ops.insert(Op::XFX(700, foo));
+        ops.insert(Op::XFX(100, ns.name("=")));
+        let fresh = OpTable::default(&ns);
+        assert_eq!(fresh.get(foo), &[]);
+        assert_eq!(fresh.get_infix(ns.name("="), 1200), Some(Op::XFX(700, ns.name("="))));
+    }
 }
@@ -17,16 +17,19 @@
 //!
 //! [1]: https://en.wikipedia.org/wiki/Prolog_syntax_and_semantics
 
+use std::borrow::Cow;
 use std::io::BufRead;
 use std::mem;
 
 use ordered_float::OrderedFloat;
 
 use syntax::error::{Result, SyntaxError};
+use syntax::flags::{Flags, Quotes};
 use syntax::lexer::{Lexer, Token};
 use syntax::namespace::{Name, NameSpace};
 use syntax::operators::{Op, OpTable};
 use syntax::repr::{Structure, Symbol};
+use syntax::source::Source;
 
 /// An iterator over [`Structure`]s in UTF-8 text.
 ///
@@ -42,14 +45,55 @@ use syntax::repr::{Structure, Symbol};
 /// [`NameSpace`]: ../namespace/struct.NameSpace.html
 /// [`OpTable`]: ../operators/struct.OpTable.html
 ///
+/// A parser can be cloned if its reader can, e.g. a parser of a byte slice.
+/// The clone resumes from the same position but is otherwise independent,
+/// which allows speculative parsing without disturbing the original. The
+/// namespace is shared, so names created by either parser are visible to
+/// both. The operator table given to the constructor is shared, but any
+/// operators defined by directives are copied and are not seen by the other
+/// parser.
+///
 /// [1]: https://en.wikipedia.
 /// org/wiki/Operator-precedence_parser#Precedence_climbing_method
+#[derive(Clone)]
 pub struct Parser<'ctx, B: BufRead> {
-    ops: &'ctx OpTable<'ctx>,
+    ns: &'ctx NameSpace,
+    ops: Cow<'ctx, OpTable<'ctx>>,
+    flags: Flags,
     lexer: Lexer<'ctx, B>,
     peeked: Option<Token<'ctx>>,
     vars: Vec<Name<'ctx>>,
     buf: Vec<Symbol<'ctx>>,
+    raw: String,
+    span: Span,
+    at_dot: bool,
+    max_arity: Option<u32>,
+    max_clauses: Option<usize>,
+    clauses: usize,
+}
+
+/// The region of source text spanned by a clause.
+///
+/// The start is the line and column of the first token of the clause. The end
+/// is the line and column immediately following the last token read for the
+/// clause, usually the end token.
+#[derive(Debug)]
+#[derive(Clone, Copy)]
+#[derive(PartialEq, Eq)]
+#[derive(Default)]
+pub struct Span {
+    pub start: (usize, usize),
+    pub end: (usize, usize),
+}
+
+/// A clause along with its span and any errors encountered while reading it.
+///
+/// The clause is `None` if it could not be read.
+#[derive(Debug)]
+pub struct ParsedClause<'ctx> {
+    pub clause: Option<Box<Structure<'ctx>>>,
+    pub span: Span,
+    pub errors: Vec<SyntaxError>,
 }
 
 // Public API
@@ -59,55 +103,411 @@ impl<'ctx, B: BufRead> Parser<'ctx, B> {
     /// Constructs a new `Parser` from the given reader, namespace, and
     /// operator table.
     pub fn new(reader: B, ns: &'ctx NameSpace, ops: &'ctx OpTable<'ctx>) -> Parser<'ctx, B> {
+        Parser::from_source(Source::anonymous(reader), ns, ops)
+    }
+
+    /// Constructs a new `Parser` from a named source.
+    ///
+    /// Syntax errors are attributed to the source in which they occur.
+    pub fn from_source(
+        source: Source<B>,
+        ns: &'ctx NameSpace,
+        ops: &'ctx OpTable<'ctx>,
+    ) -> Parser<'ctx, B> {
         Parser {
-            ops: ops,
-            lexer: Lexer::new(reader, ns),
+            ns: ns,
+            ops: Cow::Borrowed(ops),
+            flags: Flags::default(),
+            lexer: Lexer::from_source(source, ns),
             peeked: None,
             vars: Vec::with_capacity(32),
             buf: Vec::with_capacity(256),
+            raw: String::new(),
+            span: Span::default(),
+            at_dot: false,
+            max_arity: None,
+            max_clauses: None,
+            clauses: 0,
         }
     }
+
+    /// Sets the flags which affect parsing.
+    ///
+    /// The flags are updated by `set_prolog_flag/2` directives as they are
+    /// read, affecting the clauses which follow.
+    pub fn with_flags(mut self, flags: Flags) -> Self {
+        self.flags = flags;
+        self
+    }
+
+    /// Returns the operators currently in effect.
+    ///
+    /// The operators are updated by `op/3` directives as they are read,
+    /// affecting the clauses which follow. The table given to the
+    /// constructor is not modified; the parser updates its own copy.
+    pub fn ops(&self) -> &OpTable<'ctx> {
+        &self.ops
+    }
+
+    /// Returns the namespace in which the parser names symbols.
+    pub fn ns(&self) -> &'ctx NameSpace {
+        self.ns
+    }
+
+    /// Returns the flags currently in effect.
+    pub fn flags(&self) -> &Flags {
+        &self.flags
+    }
+
+    /// Limits the number of arguments of compound terms.
+    ///
+    /// A compound with more arguments is reported as a representation error
+    /// for `max_arity`. Lists are not limited. By default, arity is
+    /// unlimited.
+    pub fn max_arity(mut self, n: u32) -> Self {
+        self.max_arity = Some(n);
+        self
+    }
+
+    /// Limits the number of clauses read, e.g. when loading untrusted files.
+    ///
+    /// Once the limit is reached, the next clause is not returned. Instead a
+    /// resource error for `max_clauses` is returned if any input remains, and
+    /// the parser stops. Clauses which fail to parse count toward the limit.
+    pub fn max_clauses(mut self, n: usize) -> Self {
+        self.max_clauses = Some(n);
+        self
+    }
+
+    /// Toggles whether the end token must be followed by layout.
+    ///
+    /// See `Lexer::strict_dot` for details.
+    pub fn strict_dot(mut self, yes: bool) -> Self {
+        self.lexer = self.lexer.strict_dot(yes);
+        self
+    }
+
+    /// Toggles whether a period glued between two tokens is an operator.
+    ///
+    /// See `Lexer::dot_operator` for details.
+    pub fn dot_operator(mut self, yes: bool) -> Self {
+        self.lexer = self.lexer.dot_operator(yes);
+        self
+    }
+
+    /// Toggles Unicode normalization of the input.
+    ///
+    /// See `Lexer::normalize` for details.
+    pub fn normalize(mut self, yes: bool) -> Self {
+        self.lexer = self.lexer.normalize(yes);
+        self
+    }
+
+    /// Toggles whether the source text of each clause is recorded.
+    ///
+    /// When enabled, the text spanning each clause, from its first token to
+    /// its terminating period and including any comments, is available from
+    /// the `raw` method. This lets a formatter reproduce unchanged clauses
+    /// exactly.
+    pub fn verbatim(mut self, yes: bool) -> Self {
+        self.lexer = self.lexer.verbatim(yes);
+        self
+    }
+
+    /// Returns the source text of the clause most recently read.
+    ///
+    /// The text is empty unless the parser is configured to record it.
+    pub fn raw(&self) -> &str {
+        &self.raw
+    }
+
+    /// Returns the span of the clause most recently read.
+    pub fn span(&self) -> Span {
+        self.span
+    }
+
+    /// Returns true if the clause most recently read was terminated by an end
+    /// token, rather than by the end of the input.
+    pub fn terminated(&self) -> bool {
+        self.at_dot
+    }
+
+    /// Returns the approximate position of the parser in the current source.
+    ///
+    /// The position is given as the number of bytes read from the source and
+    /// the line on which the clause most recently read ends. This is intended
+    /// for reporting progress while loading large files.
+    pub fn position(&self) -> (u64, usize) {
+        (self.lexer.bytes_read(), self.span.end.0)
+    }
+
+    /// Splices a new source into the input, e.g. to implement `include/1`.
+    ///
+    /// Clauses are read from the new source until it is exhausted, then
+    /// parsing resumes in the current source. This should be called between
+    /// clauses.
+    pub fn include(&mut self, source: Source<B>) {
+        self.lexer.include(source);
+    }
+
+    /// Reads all remaining clauses.
+    ///
+    /// Clauses which fail to parse are skipped, and their errors are returned
+    /// alongside the clauses which parse successfully.
+    pub fn read_all(&mut self) -> (Vec<Box<Structure<'ctx>>>, Vec<SyntaxError>) {
+        let mut clauses = Vec::new();
+        let mut errs = Vec::new();
+        for res in self {
+            match res {
+                Ok(clause) => clauses.push(clause),
+                Err(err) => errs.push(err),
+            }
+        }
+        (clauses, errs)
+    }
+
+    /// Reads the next clause along with its span and errors.
+    ///
+    /// Unlike iterating over the parser, this attributes each error to the
+    /// clause in which it occurs, which is useful for per-clause diagnostics.
+    pub fn next_parsed(&mut self) -> Option<ParsedClause<'ctx>> {
+        let (clause, errors) = match self.next() {
+            Some(Ok(clause)) => (Some(clause), vec![]),
+            Some(Err(err)) => (None, vec![err]),
+            None => return None,
+        };
+        Some(ParsedClause {
+            clause: clause,
+            span: self.span,
+            errors: errors,
+        })
+    }
+
+    /// Reads the next clause without allocating.
+    ///
+    /// The clause is a view into a buffer owned by the parser which is reused
+    /// for each clause, so reading many small clauses does not allocate a new
+    /// structure for each. The clause borrows the parser and must be dropped,
+    /// or copied with `to_owned`, before reading the next clause.
+    pub fn next_ref(&mut self) -> Option<Result<&Structure<'ctx>>> {
+        match self.advance() {
+            Some(Ok(())) => Some(Ok(unsafe { Structure::from_slice(&self.buf) })),
+            Some(Err(e)) => Some(Err(e)),
+            None => None,
+        }
+    }
+
+    /// Reads all remaining clauses along with their spans and errors.
+    pub fn read_parsed(&mut self) -> Vec<ParsedClause<'ctx>> {
+        let mut clauses = Vec::new();
+        while let Some(parsed) = self.next_parsed() {
+            clauses.push(parsed);
+        }
+        clauses
+    }
+
+    /// Reads a single term spanning the rest of the input.
+    ///
+    /// Unlike a clause, the term need not end with a period, which suits
+    /// queries typed without one or terms embedded in other formats. A
+    /// trailing period is allowed. Directives are not applied.
+    pub fn read_term(&mut self) -> Result<Box<Structure<'ctx>>> {
+        self.vars.clear();
+        self.buf.clear();
+        let res = self.read(1200).and_then(|_| {
+            if self.buf.is_empty() {
+                return Err(SyntaxError::unexpected(self.lexer.line(), self.lexer.col(), "eof"));
+            }
+            if let Some(&Token::Dot(..)) = self.peek_tok() {
+                self.next_tok();
+            }
+            match self.next_tok() {
+                Some(tok) => Err(SyntaxError::priority_clash(tok.line(), tok.col())),
+                None => Ok(unsafe { struct_from_vec(self.buf.clone()) }),
+            }
+        });
+        res.map_err(|e| e.in_source(self.lexer.source_name()))
+    }
 }
 
 impl<'ctx, B: BufRead> Iterator for Parser<'ctx, B> {
     type Item = Result<Box<Structure<'ctx>>>;
 
     fn next(&mut self) -> Option<Result<Box<Structure<'ctx>>>> {
+        match self.advance() {
+            Some(Ok(())) => Some(Ok(unsafe { struct_from_vec(self.buf.clone()) })),
+            Some(Err(e)) => Some(Err(e)),
+            None => None,
+        }
+    }
+}
+
+// Parsing Logic
+// --------------------------------------------------
+
+/// Converts a vector of symbols into a structure.
+///
+/// This is unsafe because an arbitrary vector of symbols in not necessarily a
+/// valid structure. Assuming the correctness of the parsing algorithm, it is
+/// safe to call this function on the completed buffer.
+unsafe fn struct_from_vec<'ctx>(vec: Vec<Symbol<'ctx>>) -> Box<Structure<'ctx>> {
+    mem::transmute(vec.into_boxed_slice())
+}
+
+/// A directive which affects parsing.
+///
+/// Such directives are applied by the parser as they are read.
+enum Directive<'ctx> {
+    /// `:- set_prolog_flag(Flag, Value).`
+    SetFlag(Name<'ctx>, Name<'ctx>),
+
+    /// `:- op(Priority, Type, Names).`
+    Op(u32, Name<'ctx>, Vec<Name<'ctx>>),
+}
+
+/// Returns the directive which affects parsing, if the clause is one.
+///
+/// Directives with arguments of the wrong type are ignored by the parser.
+fn directive<'ctx>(clause: &Structure<'ctx>) -> Option<Directive<'ctx>> {
+    match clause.functor() {
+        Symbol::Funct(1, name) if name.as_str() == ":-" => (),
+        _ => return None,
+    }
+    let goal = clause.args()[0];
+    let args = goal.args();
+    match goal.functor() {
+        Symbol::Funct(2, name) if name.as_str() == "set_prolog_flag" => {
+            match (args[0].functor(), args[1].functor()) {
+                (Symbol::Funct(0, flag), Symbol::Funct(0, val)) => {
+                    Some(Directive::SetFlag(flag, val))
+                },
+                _ => None,
+            }
+        },
+        Symbol::Funct(3, name) if name.as_str() == "op" => {
+            let names = match args[2].functor() {
+                Symbol::Funct(0, name) => vec![name],
+                _ => {
+                    match atom_list(args[2]) {
+                        Some(names) => names,
+                        None => return None,
+                    }
+                },
+            };
+            match (args[0].functor(), args[1].functor()) {
+                (Symbol::Int(prec), Symbol::Funct(0, spec)) if 0 <= prec && prec <= 1200 => {
+                    Some(Directive::Op(prec as u32, spec, names))
+                },
+                _ => None,
+            }
+        },
+        _ => None,
+    }
+}
+
+/// Returns the names in a proper list of atoms.
+fn atom_list<'ctx>(list: &Structure<'ctx>) -> Option<Vec<Name<'ctx>>> {
+    let mut names = Vec::new();
+    let mut cell = list;
+    loop {
+        match cell.functor() {
+            Symbol::List(true, 0) => return Some(names),
+            Symbol::List(..) => {
+                let args = cell.args();
+                match args[0].functor() {
+                    Symbol::Funct(0, name) => names.push(name),
+                    _ => return None,
+                }
+                cell = args[1];
+            },
+            _ => return None,
+        }
+    }
+}
+
+impl<'ctx, B: BufRead> Parser<'ctx, B> {
+    /// Reads the next clause into the buffer, tracking its raw text and span.
+    fn advance(&mut self) -> Option<Result<()>> {
         self.vars.clear();
         self.buf.clear();
+        self.lexer.take_raw();
+        let start = match self.peek_tok() {
+            Some(tok) => (tok.line(), tok.col()),
+            None => (self.lexer.line(), self.lexer.col()),
+        };
+        let res = match self.max_clauses {
+            Some(max) if max < self.clauses => return None,
+            // The clause over the limit is not read, so that none of its
+            // directives are applied.
+            Some(max) if max == self.clauses => {
+                if self.peek_tok().is_some() {
+                    let err = SyntaxError::resource(start.0, start.1, "max_clauses");
+                    Some(Err(err.in_source(self.lexer.source_name())))
+                } else {
+                    None
+                }
+            },
+            _ => self.read_clause(),
+        };
+        if res.is_some() {
+            self.clauses += 1;
+        }
+        self.raw = self.lexer.take_raw();
+        self.span = Span {
+            start: start,
+            end: (self.lexer.line(), self.lexer.col()),
+        };
+        res
+    }
+
+    /// Reads the next clause into the buffer, including the trailing period.
+    fn read_clause(&mut self) -> Option<Result<()>> {
         match self.read(1200) {
-            Err(e) => Some(Err(e)),
+            Err(e) => {
+                let e = e.in_source(self.lexer.source_name());
+                self.recover();
+                Some(Err(e))
+            },
             Ok(_) => {
                 if self.buf.len() == 0 {
                     // `read` produced no results.
                     // Must be at end of input.
                     None
                 } else if let Some(Token::Dot(..)) = self.next_tok() {
-                    let structure = unsafe { struct_from_vec(self.buf.clone()) };
-                    Some(Ok(structure))
+                    match directive(unsafe { Structure::from_slice(&self.buf) }) {
+                        Some(Directive::SetFlag(flag, val)) => {
+                            self.flags.set(flag.as_str(), val.as_str());
+                        },
+                        Some(Directive::Op(prec, spec, names)) => {
+                            self.ops.to_mut().define(prec, spec.as_str(), &names);
+                        },
+                        None => (),
+                    }
+                    Some(Ok(()))
                 } else {
                     let line = self.lexer.line();
                     let col = self.lexer.col();
-                    Some(Err(SyntaxError::priority_clash(line, col)))
+                    let err = SyntaxError::priority_clash(line, col);
+                    let err = err.in_source(self.lexer.source_name());
+                    self.recover();
+                    Some(Err(err))
                 }
             },
         }
     }
-}
-
-// Parsing Logic
-// --------------------------------------------------
 
-/// Converts a vector of symbols into a structure.
-///
-/// This is unsafe because an arbitrary vector of symbols in not necessarily a
-/// valid structure. Assuming the correctness of the parsing algorithm, it is
-/// safe to call this function on the completed buffer.
-unsafe fn struct_from_vec<'ctx>(vec: Vec<Symbol<'ctx>>) -> Box<Structure<'ctx>> {
-    mem::transmute(vec.into_boxed_slice())
-}
+    /// Recovers from a syntax error by skipping the rest of the clause.
+    ///
+    /// Tokens are discarded through the next period, unless the error was
+    /// found at the period itself.
+    fn recover(&mut self) {
+        while !self.at_dot {
+            if self.next_tok().is_none() {
+                break;
+            }
+        }
+    }
 
-impl<'ctx, B: BufRead> Parser<'ctx, B> {
     /// Reads the next term up to, but not including, the trailing period.
     ///
     /// The return value is the precedence of the term upon success or
@@ -190,6 +590,10 @@ impl<'ctx, B: BufRead> Parser<'ctx, B> {
                     },
 
                     // Definitly an atom
+                    None |
+                    Some(&Token::Dot(..)) |
+                    Some(&Token::Comma(..)) |
+                    Some(&Token::Bar(..)) |
                     Some(&Token::ParenClose(..)) |
                     Some(&Token::BracketClose(..)) |
                     Some(&Token::BraceClose(..)) => {
@@ -197,9 +601,19 @@ impl<'ctx, B: BufRead> Parser<'ctx, B> {
                         Ok(0)
                     },
 
-                    // Possibly prefix operator
+                    // Possibly prefix operator. It is an atom if followed by
+                    // an infix or postfix operator which cannot start a term,
+                    // as in `- = X`.
                     _ => {
-                        match self.ops.get_prefix(name, max_prec) {
+                        let next = match self.peek_tok() {
+                            Some(&Token::Funct(_, _, next)) => Some(next),
+                            _ => None,
+                        };
+                        let prefix = match next {
+                            Some(next) if self.infix_only(next) => None,
+                            _ => self.ops.get_prefix(name, max_prec),
+                        };
+                        match prefix {
                             Some(Op::FX(p, _)) => {
                                 self.read(p - 1)?;
                                 self.buf.push(Symbol::Funct(1, name));
@@ -221,7 +635,13 @@ impl<'ctx, B: BufRead> Parser<'ctx, B> {
 
             // Strings.
             Some(Token::Str(.., val)) => {
-                self.buf.push(Symbol::Str(val.as_str()));
+                let quotes = self.flags.double_quotes;
+                self.push_text(val.as_str(), quotes);
+                Ok(0)
+            },
+            Some(Token::BackQuote(.., val)) => {
+                let quotes = self.flags.back_quotes;
+                self.push_text(val.as_str(), quotes);
                 Ok(0)
             },
 
@@ -260,27 +680,59 @@ impl<'ctx, B: BufRead> Parser<'ctx, B> {
                 }
             },
 
+            // Lists are stored as a chain of cons cells. The elements are read
+            // first, followed by the tail, and finally a cell for each element.
             Some(Token::BracketOpen(line, col)) => {
+                if let Some(&Token::BracketClose(..)) = self.peek_tok() {
+                    self.next_tok();
+                    self.buf.push(Symbol::List(true, 0));
+                    return Ok(0);
+                }
                 let len = self.read_args(true)?;
                 match self.next_tok() {
                     Some(Token::BracketClose(..)) => {
-                        self.buf.push(Symbol::List(true, len));
-                        Ok(0)
+                        self.buf.push(Symbol::List(true, 0));
                     },
                     Some(Token::Bar(..)) => {
-                        self.read_primary(1200)?;
-                        self.buf.push(Symbol::List(false, len + 1));
+                        self.read(999)?;
                         match self.next_tok() {
-                            Some(Token::BracketClose(..)) => Ok(0),
-                            _ => Err(SyntaxError::unbalanced(line, col, '[')),
+                            Some(Token::BracketClose(..)) => (),
+                            _ => return Err(SyntaxError::unbalanced(line, col, '[')),
                         }
                     },
-                    _ => Err(SyntaxError::unbalanced(line, col, '[')),
+                    _ => return Err(SyntaxError::unbalanced(line, col, '[')),
                 }
+                for _ in 0..len {
+                    self.buf.push(Symbol::List(false, 2));
+                }
+                Ok(0)
             },
 
-            // TODO: Braces.
-            Some(Token::BraceOpen(line, col)) => Err(SyntaxError::todo(line, col)),
+            // Braces. The term `{T}` is the compound `'{}'(T)`, and `{}` alone
+            // is an atom, which may be the name of a compound, as in `{}(a, b)`.
+            Some(Token::BraceOpen(line, col)) => {
+                let curly = self.ns.name("{}");
+                if let Some(&Token::BraceClose(..)) = self.peek_tok() {
+                    self.next_tok();
+                    if let Some(&Token::ParenOpen(line, col)) = self.peek_tok() {
+                        self.next_tok();
+                        let arity = self.read_args(false)?;
+                        self.buf.push(Symbol::Funct(arity, curly));
+                        return match self.next_tok() {
+                            Some(Token::ParenClose(..)) => Ok(0),
+                            _ => Err(SyntaxError::unbalanced(line, col, '(')),
+                        };
+                    }
+                    self.buf.push(Symbol::Funct(0, curly));
+                    return Ok(0);
+                }
+                self.read(1200)?;
+                self.buf.push(Symbol::Funct(1, curly));
+                match self.next_tok() {
+                    Some(Token::BraceClose(..)) => Ok(0),
+                    _ => Err(SyntaxError::unbalanced(line, col, '{')),
+                }
+            },
 
             // Syntax errors.
             Some(Token::ParenClose(line, col)) => Err(SyntaxError::unbalanced(line, col, ')')),
@@ -304,9 +756,14 @@ impl<'ctx, B: BufRead> Parser<'ctx, B> {
             let line = self.lexer.line();
             let col = self.lexer.col();
             match self.peek_tok() {
-                Some(&Token::Comma(..)) => arity += 1,
+                Some(&Token::Comma(line, col, _)) => {
+                    arity += 1;
+                    if !is_list && self.max_arity.map(|max| max < arity).unwrap_or(false) {
+                        return Err(SyntaxError::representation(line, col, "max_arity"));
+                    }
+                },
                 Some(&Token::ParenClose(..)) if !is_list => return Ok(arity),
-                Some(&Token::BraceClose(..)) if is_list => return Ok(arity),
+                Some(&Token::BracketClose(..)) if is_list => return Ok(arity),
                 Some(&Token::Bar(..)) if is_list => return Ok(arity),
                 Some(ref tok) => return Err(SyntaxError::priority_clash(tok.line(), tok.col())),
                 None => return Err(SyntaxError::unexpected(line, col, "eof")),
@@ -315,6 +772,38 @@ impl<'ctx, B: BufRead> Parser<'ctx, B> {
         }
     }
 
+    /// Pushes quoted text onto the buffer in the given representation.
+    fn push_text(&mut self, text: &'ctx str, quotes: Quotes) {
+        match quotes {
+            Quotes::String => self.buf.push(Symbol::Str(text)),
+            Quotes::Atom => self.buf.push(Symbol::Funct(0, self.ns.name(text))),
+            Quotes::Codes | Quotes::Chars => {
+                let mut len = 0;
+                for ch in text.chars() {
+                    let sym = match quotes {
+                        Quotes::Codes => Symbol::Int(ch as i64),
+                        _ => Symbol::Funct(0, self.ns.name(ch.to_string())),
+                    };
+                    self.buf.push(sym);
+                    len += 1;
+                }
+                self.buf.push(Symbol::List(true, 0));
+                for _ in 0..len {
+                    self.buf.push(Symbol::List(false, 2));
+                }
+            },
+        }
+    }
+
+    /// Returns true if the name is an infix or postfix operator but not a
+    /// prefix operator, so that it cannot start the operand of a prefix
+    /// operator.
+    fn infix_only(&self, name: Name<'ctx>) -> bool {
+        let ops = &self.ops;
+        ops.get_prefix(name, 1200).is_none() &&
+            (ops.get_infix(name, 1200).is_some() || ops.get_postfix(name, 1200).is_some())
+    }
+
     /// Implement token peeking.
     ///
     /// We implement peeking manually instead of using `std::iter::Peekable`.
@@ -323,7 +812,7 @@ impl<'ctx, B: BufRead> Parser<'ctx, B> {
         match self.peeked {
             Some(ref tok) => Some(tok),
             None => {
-                self.peeked = self.next_tok();
+                self.peeked = self.lexer.next();
                 match self.peeked {
                     Some(ref tok) => Some(tok),
                     None => None,
@@ -335,17 +824,18 @@ impl<'ctx, B: BufRead> Parser<'ctx, B> {
     /// Get the next token from the lexer.
     ///
     /// Calling `self.lexer.next()` directly outside of this or `peek_tok`
-    /// will poison the peek cache.
+    /// will poison the peek cache. This also tracks whether the token most
+    /// recently consumed was the end token.
     fn next_tok(&mut self) -> Option<Token<'ctx>> {
-        match self.peeked.take() {
+        let tok = match self.peeked.take() {
             Some(tok) => Some(tok),
-            None => {
-                match self.lexer.next() {
-                    None => None,
-                    Some(tok) => Some(tok),
-                }
-            },
-        }
+            None => self.lexer.next(),
+        };
+        self.at_dot = match tok {
+            Some(Token::Dot(..)) => true,
+            _ => false,
+        };
+        tok
     }
 }
 
@@ -399,6 +889,218 @@ mod test {
         assert_eq!(parser.next(), None);
     }
 
+    #[test]
+    fn lists() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "[].\n[a, b].\n[a|T].\n[a|[b]].\n[[]].\n";
+        let nil = &[List(true, 0)];
+        let proper = &[
+            Funct(0, ns.name("a")),
+            Funct(0, ns.name("b")),
+            List(true, 0),
+            List(false, 2),
+            List(false, 2),
+        ];
+        let partial = &[Funct(0, ns.name("a")), Var(0), List(false, 2)];
+
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), nil);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), proper);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), partial);
+
+        // An explicit tail is the same term as the equivalent proper list.
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), proper);
+        let nested = &[List(true, 0), List(true, 0), List(false, 2)];
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), nested);
+        assert_eq!(parser.next(), None);
+    }
+
+    #[test]
+    fn strings() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        // Strings are distinct from atoms with the same text.
+        let pl = "\"hello\\nworld\".\n'hello\\nworld'.\n";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        let string = parser.next().unwrap().unwrap();
+        let atom = parser.next().unwrap().unwrap();
+        assert_eq!(string.as_slice(), &[Str("hello\nworld")]);
+        assert_eq!(atom.as_slice(), &[Funct(0, ns.name("hello\nworld"))]);
+        assert_ne!(string, atom);
+    }
+
+    #[test]
+    fn directive_operators() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let directives = [
+            "dynamic",
+            "discontiguous",
+            "initialization",
+            "module",
+            "multifile",
+            "table",
+        ];
+        for &name in directives.iter() {
+            let pl = format!("?- {} foo/1.", name);
+            let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+            assert_eq!(
+                parser.next().unwrap().unwrap().as_slice(),
+                &[
+                    Funct(0, ns.name("foo")),
+                    Int(1),
+                    Funct(2, ns.name("/")),
+                    Funct(1, ns.name(name)),
+                    Funct(1, ns.name("?-")),
+                ]
+            );
+        }
+
+        let pl = ":- dynamic foo/1, bar/2.";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        assert_eq!(
+            parser.next().unwrap().unwrap().as_slice(),
+            &[
+                Funct(0, ns.name("foo")),
+                Int(1),
+                Funct(2, ns.name("/")),
+                Funct(0, ns.name("bar")),
+                Int(2),
+                Funct(2, ns.name("/")),
+                Funct(2, ns.name(",")),
+                Funct(1, ns.name("dynamic")),
+                Funct(1, ns.name(":-")),
+            ]
+        );
+
+        let pl = "X = m:g@c.";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        assert_eq!(
+            parser.next().unwrap().unwrap().as_slice(),
+            &[
+                Var(0),
+                Funct(0, ns.name("m")),
+                Funct(0, ns.name("g")),
+                Funct(0, ns.name("c")),
+                Funct(2, ns.name("@")),
+                Funct(2, ns.name(":")),
+                Funct(2, ns.name("=")),
+            ]
+        );
+    }
+
+    #[test]
+    fn set_prolog_flag() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "X = \"ab\".\n\
+                  :- set_prolog_flag(double_quotes, codes).\n\
+                  X = \"ab\".\n\
+                  :- set_prolog_flag(double_quotes, chars).\n\
+                  X = \"ab\".\n";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        let eq = Funct(2, ns.name("="));
+        let nil = List(true, 0);
+        let cons = List(false, 2);
+
+        let a = Funct(0, ns.name("a"));
+        let b = Funct(0, ns.name("b"));
+        let codes = &[Var(0), Int(97), Int(98), nil, cons, cons, eq];
+        let chars = &[Var(0), a, b, nil, cons, cons, eq];
+
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[Var(0), Str("ab"), eq]);
+        parser.next().unwrap().unwrap();
+        assert_eq!(parser.flags().double_quotes, Quotes::Codes);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), codes);
+        parser.next().unwrap().unwrap();
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), chars);
+
+        // Back quotes are read as codes by default.
+        let mut parser = Parser::new("X = `ab`.".as_bytes(), &ns, &ops);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), codes);
+    }
+
+    #[test]
+    fn op_directive() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = ":- op(700, xfx, [likes, hates]).\n\
+                  :- op(200, xfy, owns).\n\
+                  alice likes bob.\n\
+                  bob hates carol owns dave.\n";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        parser.next().unwrap().unwrap();
+        parser.next().unwrap().unwrap();
+        assert_eq!(
+            parser.next().unwrap().unwrap().as_slice(),
+            &[Funct(0, ns.name("alice")), Funct(0, ns.name("bob")), Funct(2, ns.name("likes"))]
+        );
+        assert_eq!(
+            parser.next().unwrap().unwrap().as_slice(),
+            &[
+                Funct(0, ns.name("bob")),
+                Funct(0, ns.name("carol")),
+                Funct(0, ns.name("dave")),
+                Funct(2, ns.name("owns")),
+                Funct(2, ns.name("hates")),
+            ]
+        );
+        assert!(parser.ops().get_infix(ns.name("likes"), 1200).is_some());
+        assert!(ops.get_infix(ns.name("likes"), 1200).is_none());
+    }
+
+    #[test]
+    fn verbatim() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "% leading comment\n\
+                  foo(a, % first argument\n    \
+                  b). % trailing comment\n\
+                  bar.";
+
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops).verbatim(true);
+        parser.next().unwrap().unwrap();
+        assert_eq!(parser.raw(), "foo(a, % first argument\n    b).");
+        parser.next().unwrap().unwrap();
+        assert_eq!(parser.raw(), "bar.");
+        assert_eq!(parser.next(), None);
+    }
+
+    #[test]
+    fn braces() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let curly = |n| Funct(n, ns.name("{}"));
+
+        let pl = "{}.\n{a}.\n{a, b}.\n{}(a, b).\n{a.\n";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[curly(0)]);
+        assert_eq!(
+            parser.next().unwrap().unwrap().as_slice(),
+            &[Funct(0, ns.name("a")), curly(1)]
+        );
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[
+            Funct(0, ns.name("a")),
+            Funct(0, ns.name("b")),
+            Funct(2, ns.name(",")),
+            curly(1),
+        ]);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[
+            Funct(0, ns.name("a")),
+            Funct(0, ns.name("b")),
+            curly(2),
+        ]);
+        assert!(parser.next().unwrap().is_err());
+        assert_eq!(parser.next(), None);
+    }
+
     #[test]
     fn realistic() {
         let ns = NameSpace::new();
@@ -433,4 +1135,294 @@ mod test {
         assert_eq!(parser.next().unwrap().unwrap().as_slice(), second);
         assert_eq!(parser.next(), None);
     }
+
+    #[test]
+    fn strict_dot() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        // In strict mode, the first period is the infix operator.
+        let pl = "foo.bar.\n";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        let foo = Funct(0, ns.name("foo"));
+        let bar = Funct(0, ns.name("bar"));
+        let dot = Funct(2, ns.name("."));
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[foo, bar, dot]);
+        assert_eq!(parser.next(), None);
+
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops).strict_dot(false);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[Funct(0, ns.name("foo"))]);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[Funct(0, ns.name("bar"))]);
+        assert_eq!(parser.next(), None);
+    }
+
+    #[test]
+    fn prefix_op_atoms() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let minus = Funct(0, ns.name("-"));
+        let f = Funct(2, ns.name("f"));
+        let eq = Funct(2, ns.name("="));
+        let a = Funct(0, ns.name("a"));
+
+        // A prefix operator followed by a comma, bar, end token, or an infix
+        // operator is an atom.
+        let pl = "f(-, a).\n[-|-].\n- = - .\n";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[minus, a, f]);
+        let list = [minus, minus, List(false, 2)];
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &list);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[minus, minus, eq]);
+        assert_eq!(parser.next(), None);
+    }
+
+    #[test]
+    fn dot_operator() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let a = Funct(0, ns.name("a"));
+        let b = Funct(0, ns.name("b"));
+        let dot = Funct(2, ns.name("."));
+        let eq = Funct(2, ns.name("="));
+
+        let pl = "X = a.b.\na.\n";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops)
+            .strict_dot(false)
+            .dot_operator(true);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[Var(0), a, b, dot, eq]);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[a]);
+        assert_eq!(parser.next(), None);
+    }
+
+    #[test]
+    fn read_term() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let a = Funct(0, ns.name("a"));
+        let b = Funct(0, ns.name("b"));
+        let plus = Funct(2, ns.name("+"));
+
+        let mut parser = Parser::new("a + b".as_bytes(), &ns, &ops);
+        assert_eq!(parser.read_term().unwrap().as_slice(), &[a, b, plus]);
+        let mut parser = Parser::new("a + b.\n".as_bytes(), &ns, &ops);
+        assert_eq!(parser.read_term().unwrap().as_slice(), &[a, b, plus]);
+        let mut parser = Parser::new(":- X".as_bytes(), &ns, &ops);
+        assert_eq!(parser.read_term().unwrap().as_slice(), &[Var(0), Funct(1, ns.name(":-"))]);
+
+        let mut parser = Parser::new("a + b. c".as_bytes(), &ns, &ops);
+        let err = parser.read_term().unwrap_err();
+        assert_eq!((err.line(), err.col()), (1, 8));
+        let mut parser = Parser::new("  ".as_bytes(), &ns, &ops);
+        assert!(parser.read_term().is_err());
+    }
+
+    #[test]
+    fn read_all() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "a.\nb(c, .\nd :- e f.\ng.\n";
+        let (clauses, errs) = Parser::new(pl.as_bytes(), &ns, &ops).read_all();
+        assert_eq!(clauses.len(), 2);
+        assert_eq!(clauses[0].as_slice(), &[Funct(0, ns.name("a"))]);
+        assert_eq!(clauses[1].as_slice(), &[Funct(0, ns.name("g"))]);
+        assert_eq!(errs.len(), 2);
+        assert_eq!((errs[0].line(), errs[0].col()), (2, 6));
+        assert_eq!(errs[1].line(), 3);
+    }
+
+    #[test]
+    fn read_parsed() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "a.\nb(.\nc :-\n  d.\ne :- .\nf.\n";
+        let parsed = Parser::new(pl.as_bytes(), &ns, &ops).read_parsed();
+        assert_eq!(parsed.len(), 5);
+
+        let spans: Vec<_> = parsed.iter().map(|p| (p.span.start, p.span.end)).collect();
+        assert_eq!(spans[0], ((1, 1), (1, 3)));
+        assert_eq!(spans[1], ((2, 1), (2, 4)));
+        assert_eq!(spans[2], ((3, 1), (4, 5)));
+        assert_eq!(spans[3], ((5, 1), (5, 7)));
+        assert_eq!(spans[4], ((6, 1), (6, 3)));
+
+        let oks: Vec<_> = parsed.iter().map(|p| p.clause.is_some()).collect();
+        assert_eq!(oks, vec![true, false, true, false, true]);
+
+        let errs: Vec<_> = parsed.iter().map(|p| p.errors.len()).collect();
+        assert_eq!(errs, vec![0, 1, 0, 1, 0]);
+        assert_eq!((parsed[1].errors[0].line(), parsed[1].errors[0].col()), (2, 3));
+        assert_eq!(parsed[3].errors[0].line(), 5);
+    }
+
+    #[test]
+    fn next_ref() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "foo(a, b). bar. baz(c).";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        let first = parser.next_ref().unwrap().unwrap().to_vec();
+        assert_eq!(parser.next_ref().unwrap().unwrap().as_slice(), &[Funct(0, ns.name("bar"))]);
+        assert_eq!(
+            first,
+            vec![Funct(0, ns.name("a")), Funct(0, ns.name("b")), Funct(2, ns.name("foo"))]
+        );
+        assert_eq!(
+            parser.next_ref().unwrap().unwrap().as_slice(),
+            &[Funct(0, ns.name("c")), Funct(1, ns.name("baz"))]
+        );
+        assert!(parser.next_ref().is_none());
+    }
+
+    #[test]
+    fn position() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "a.\nb :-\n  c.\n\nd.\n";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        assert_eq!(parser.position(), (0, 0));
+        parser.next().unwrap().unwrap();
+        assert_eq!(parser.position(), (3, 1));
+        parser.next().unwrap().unwrap();
+        assert_eq!(parser.position(), (13, 3));
+        parser.next().unwrap().unwrap();
+        assert_eq!(parser.position(), (17, 5));
+    }
+
+    #[test]
+    fn include() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let main = Source::new("main.pl", "a.\nb(.\n".as_bytes());
+        let inc = Source::new("inc.pl", "c.\n).\nd.\n".as_bytes());
+
+        let mut parser = Parser::from_source(main, &ns, &ops);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[Funct(0, ns.name("a"))]);
+        parser.include(inc);
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[Funct(0, ns.name("c"))]);
+
+        let err = parser.next().unwrap().unwrap_err();
+        assert_eq!(err.source_name(), Some("inc.pl"));
+        assert_eq!((err.line(), err.col()), (2, 1));
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[Funct(0, ns.name("d"))]);
+
+        let err = parser.next().unwrap().unwrap_err();
+        assert_eq!(err.source_name(), Some("main.pl"));
+        assert_eq!((err.line(), err.col()), (2, 3));
+        assert_eq!(parser.next(), None);
+    }
+
+    #[test]
+    fn max_arity() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "f(a, b, c). g(a, b, c, d). [a, b, c, d]. h.";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops).max_arity(3);
+        assert_eq!(parser.next().unwrap().unwrap().arity(), 3);
+        let err = parser.next().unwrap().unwrap_err();
+        assert_eq!(err.to_string(), "1:22: representation_error(max_arity)");
+        parser.next().unwrap().unwrap();
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[Funct(0, ns.name("h"))]);
+        assert_eq!(parser.next(), None);
+    }
+
+    #[test]
+    fn max_clauses() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "a. b(. c. d.";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops).max_clauses(3);
+        let (clauses, errs) = parser.read_all();
+        assert_eq!(clauses.len(), 2);
+        assert_eq!(errs.len(), 2);
+        assert_eq!(errs[1].to_string(), "1:11: resource_error(max_clauses)");
+        assert_eq!(parser.next(), None);
+
+        // Reaching the limit at the end of input is not an error.
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops).max_clauses(4);
+        let (clauses, errs) = parser.read_all();
+        assert_eq!((clauses.len(), errs.len()), (3, 1));
+
+        // Directives over the limit are not applied.
+        let pl = "a. :- op(700, xfx, likes).";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops).max_clauses(1);
+        let (clauses, errs) = parser.read_all();
+        assert_eq!((clauses.len(), errs.len()), (1, 1));
+        assert!(parser.ops().get_infix(ns.name("likes"), 1200).is_none());
+    }
+
+    #[test]
+    fn clone() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "a. :- op(700, xfx, ===). b === c. d.";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        parser.next().unwrap().unwrap();
+        let mut clone = parser.clone();
+        parser.next().unwrap().unwrap();
+        parser.next().unwrap().unwrap();
+        assert_eq!(parser.next().unwrap().unwrap().as_slice(), &[Funct(0, ns.name("d"))]);
+
+        // The clone is unaffected by the original.
+        clone.next().unwrap().unwrap();
+        assert_eq!(clone.next().unwrap().unwrap().arity(), 2);
+        assert_eq!(clone.next().unwrap().unwrap().as_slice(), &[Funct(0, ns.name("d"))]);
+        assert_eq!(clone.next(), None);
+        assert_eq!(ops.get_infix(ns.name("==="), 1200), None);
+    }
+
+    #[test]
+    fn empty_input() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        for pl in vec!["", "   ", "\n\t\n", "% just a comment\n", "%% doc\n% line"] {
+            let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+            assert_eq!(parser.next(), None);
+            assert_eq!(parser.next(), None);
+            assert_eq!(parser.next_ref(), None);
+            assert_eq!(parser.next_parsed().map(|p| p.clause), None);
+            let (clauses, errs) = Parser::new(pl.as_bytes(), &ns, &ops).read_all();
+            assert_eq!((clauses.len(), errs.len()), (0, 0));
+        }
+
+        // A lone end token is an error rather than an empty clause.
+        for pl in vec![".", " . % comment\n"] {
+            let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+            let err = parser.next().unwrap().unwrap_err();
+            assert_eq!(err.to_string().ends_with("unexpected token: period"), true);
+            assert_eq!(parser.next(), None);
+        }
+    }
+
+    #[test]
+    fn special_atoms() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "X = '.'. X = ','. X = '[]'. X = []. '.'. (',').";
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).map(|c| c.unwrap()).collect();
+        let rhs: Vec<_> = clauses[..4].iter().map(|c| c.args()[1].functor()).collect();
+        assert_eq!(rhs, vec![
+            Funct(0, ns.name(".")),
+            Funct(0, ns.name(",")),
+            Funct(0, ns.name("[]")),
+            List(true, 0),
+        ]);
+        assert_eq!(clauses[4].as_slice(), &[Funct(0, ns.name("."))]);
+        assert_eq!(clauses[5].as_slice(), &[Funct(0, ns.name(","))]);
+
+        // Unquoted, they keep their structural roles.
+        let pl = "a, b. c.";
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).map(|c| c.unwrap()).collect();
+        assert_eq!(clauses.len(), 2);
+        assert_eq!(clauses[0].functor(), Funct(2, ns.name(",")));
+    }
 }
@@ -14,15 +14,25 @@
 //! [`Symbol`]: ./enum.Symbol.html
 //! [`Structure`]: ./struct.Structure.html
 
-use std::ops::Deref;
+use std::borrow::ToOwned;
+use std::collections::HashMap;
+use std::fmt;
+use std::mem;
+use std::ops::{Deref, Range};
 
 use ordered_float::OrderedFloat;
 
-use syntax::namespace::Name;
+use syntax::namespace::{Name, NameSpace};
+use syntax::operators::OpTable;
+use syntax::writer::Writer;
 
 /// An atomic symbol of a logic program.
 ///
 /// Symbols are guaranteed to fit within two words on 64bit architectures.
+///
+/// Lists are represented as chains of cons cells, `List(false, 2)`, whose
+/// arguments are the head and tail of the list. Proper lists are terminated by
+/// the empty list, `List(true, 0)`.
 #[derive(Debug)]
 #[derive(Clone, Copy)]
 #[derive(PartialEq, Eq)]
@@ -62,6 +72,148 @@ impl<'ns> Structure<'ns> {
     pub fn arity(&self) -> usize {
         self.functor().arity()
     }
+
+    /// Views a slice of symbols as a `Structure`.
+    ///
+    /// This is unsafe because an arbitrary slice of symbols is not necessarily
+    /// a valid structure. The slice must be a tree in postfix order.
+    pub unsafe fn from_slice<'a>(slice: &'a [Symbol<'ns>]) -> &'a Structure<'ns> {
+        mem::transmute(slice)
+    }
+
+    /// Converts a vector of symbols into a `Structure`.
+    ///
+    /// This is unsafe because an arbitrary vector of symbols is not
+    /// necessarily a valid structure. The vector must be a tree in postfix
+    /// order.
+    pub unsafe fn from_vec(vec: Vec<Symbol<'ns>>) -> Box<Structure<'ns>> {
+        mem::transmute(vec.into_boxed_slice())
+    }
+
+    /// Returns true if the symbols form a single tree in postfix order.
+    ///
+    /// Every `Structure` must be such a tree, and those from the parser always
+    /// are. This checks a structure built from symbols with `from_vec` or
+    /// `from_slice`, where a mistake would otherwise surface later as a panic
+    /// or a wrong argument.
+    pub fn is_valid(&self) -> bool {
+        let mut depth = 0usize;
+        for sym in self.0.iter() {
+            let n = sym.arity();
+            if depth < n {
+                return false;
+            }
+            depth = depth - n + 1;
+        }
+        depth == 1
+    }
+
+    /// Gets the arguments of the root of the tree, from left to right.
+    pub fn args(&self) -> Vec<&Structure<'ns>> {
+        self.arg_ranges()
+            .into_iter()
+            .map(|r| unsafe { Structure::from_slice(&self.0[r]) })
+            .collect()
+    }
+
+    /// Gets the range of indices spanned by each argument of the root, from
+    /// left to right.
+    pub fn arg_ranges(&self) -> Vec<Range<usize>> {
+        let n = self.arity();
+        let mut ranges = Vec::with_capacity(n);
+        let mut end = self.0.len() - 1;
+        for _ in 0..n {
+            let start = start_of(&self.0, end - 1);
+            ranges.push(start..end);
+            end = start;
+        }
+        ranges.reverse();
+        ranges
+    }
+
+    /// Gets the atomic subterms, i.e. the atoms, numbers, strings, and
+    /// variables, from left to right.
+    ///
+    /// The empty list which terminates a proper list is included.
+    pub fn leaves(&self) -> Vec<&Structure<'ns>> {
+        (0..self.0.len())
+            .filter(|&i| self.0[i].arity() == 0)
+            .map(|i| unsafe { Structure::from_slice(&self.0[i..i + 1]) })
+            .collect()
+    }
+
+    /// Gets the elements of a list, from left to right, and its tail.
+    ///
+    /// The tail is the empty list if the list is proper, a variable if the
+    /// list is partial, or any other term if the list is improper. A structure
+    /// which is not a list cell has no elements and is its own tail.
+    pub fn list_elements(&self) -> (Vec<&Structure<'ns>>, &Structure<'ns>) {
+        let mut elems = Vec::new();
+        let mut cell = self;
+        while cell.functor() == Symbol::List(false, 2) {
+            let args = cell.args();
+            elems.push(args[0]);
+            cell = args[1];
+        }
+        (elems, cell)
+    }
+
+    /// Returns true if the structure is a proper list, i.e. a chain of list
+    /// cells ending with the empty list.
+    pub fn is_proper_list(&self) -> bool {
+        self.list_elements().1.functor() == Symbol::List(true, 0)
+    }
+
+    /// Copies the structure into another `NameSpace`.
+    ///
+    /// Names are translated by `names`, as returned by `NameSpace::import`.
+    /// Names missing from the translation, and the text of strings, are
+    /// issued by `ns`.
+    pub fn rekey<'b>(
+        &self,
+        names: &HashMap<Name<'ns>, Name<'b>>,
+        ns: &'b NameSpace,
+    ) -> Box<Structure<'b>> {
+        let syms = self.iter()
+            .map(|sym| match *sym {
+                Symbol::Funct(n, name) => {
+                    match names.get(&name) {
+                        Some(&name) => Symbol::Funct(n, name),
+                        None => Symbol::Funct(n, ns.name(name.as_str())),
+                    }
+                },
+                Symbol::Str(s) => Symbol::Str(ns.name(s).as_str()),
+                Symbol::Var(n) => Symbol::Var(n),
+                Symbol::Int(i) => Symbol::Int(i),
+                Symbol::Float(f) => Symbol::Float(f),
+                Symbol::List(nil, n) => Symbol::List(nil, n),
+            })
+            .collect();
+        unsafe { Structure::from_vec(syms) }
+    }
+}
+
+/// Returns the index of the first symbol of the subterm rooted at `idx`.
+///
+/// This is computed iteratively so that deep structures, like long lists, do
+/// not overflow the stack.
+fn start_of(syms: &[Symbol], idx: usize) -> usize {
+    let mut need = 1;
+    let mut i = idx + 1;
+    while need > 0 {
+        i -= 1;
+        need = need - 1 + syms[i].arity();
+    }
+    i
+}
+
+impl<'ns> ToOwned for Structure<'ns> {
+    type Owned = Box<Structure<'ns>>;
+
+    fn to_owned(&self) -> Box<Structure<'ns>> {
+        let boxed = self.0.to_vec().into_boxed_slice();
+        unsafe { mem::transmute(boxed) }
+    }
 }
 
 impl<'ns> Deref for Structure<'ns> {
@@ -71,6 +223,15 @@ impl<'ns> Deref for Structure<'ns> {
     }
 }
 
+/// Structures are displayed in canonical form, e.g. `-(a,f(_0))`, which is
+/// useful when debugging. Use a `Writer` to display operators.
+impl<'ns> fmt::Display for Structure<'ns> {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        let ops = OpTable::new();
+        f.write_str(&Writer::new(&ops).quoted(true).to_string(self))
+    }
+}
+
 // Symbol
 // --------------------------------------------------
 
@@ -89,3 +250,118 @@ impl<'ns> Symbol<'ns> {
         }
     }
 }
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::operators::OpTable;
+    use syntax::parser::Parser;
+    use syntax::writer::Writer;
+    use super::*;
+
+    #[test]
+    fn lists() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "[]. [a, b]. [a|T]. [a|b]. foo.";
+        let sts: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).map(|st| st.unwrap()).collect();
+        let a = Symbol::Funct(0, ns.name("a"));
+
+        let (elems, tail) = sts[0].list_elements();
+        assert!(elems.is_empty());
+        assert_eq!(tail.functor(), Symbol::List(true, 0));
+        assert!(sts[0].is_proper_list());
+
+        let (elems, tail) = sts[1].list_elements();
+        let elems: Vec<_> = elems.iter().map(|elem| elem.functor()).collect();
+        assert_eq!(elems, vec![a, Symbol::Funct(0, ns.name("b"))]);
+        assert_eq!(tail.functor(), Symbol::List(true, 0));
+        assert!(sts[1].is_proper_list());
+
+        let (elems, tail) = sts[2].list_elements();
+        assert_eq!(elems.len(), 1);
+        assert_eq!(tail.functor(), Symbol::Var(0));
+        assert!(!sts[2].is_proper_list());
+
+        let (elems, tail) = sts[3].list_elements();
+        assert_eq!(elems.len(), 1);
+        assert_eq!(tail.functor(), Symbol::Funct(0, ns.name("b")));
+        assert!(!sts[3].is_proper_list());
+
+        let (elems, tail) = sts[4].list_elements();
+        assert!(elems.is_empty());
+        assert_eq!(tail, &*sts[4]);
+        assert!(!sts[4].is_proper_list());
+    }
+
+    #[test]
+    fn is_valid() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "foo(X, [a, b|T], bar(1, \"s\")) :- baz(X).";
+        let clause = Parser::new(pl.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+        assert!(clause.is_valid());
+
+        let a = Symbol::Funct(0, ns.name("a"));
+        let f = Symbol::Funct(2, ns.name("f"));
+        let cons = Symbol::List(false, 2);
+        let bad = vec![
+            vec![],
+            vec![a, f],
+            vec![a, a],
+            vec![a, a, cons, a],
+            vec![f, a, a],
+        ];
+        for syms in bad {
+            assert!(!unsafe { Structure::from_vec(syms) }.is_valid());
+        }
+        assert!(unsafe { Structure::from_vec(vec![a, a, f]) }.is_valid());
+    }
+
+    #[test]
+    fn leaves() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "f(a, g(1, X), b). [x, \"y\"]. foo.";
+        let sts: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).map(|st| st.unwrap()).collect();
+        let leaves: Vec<_> = sts.iter()
+            .map(|st| st.leaves().iter().map(|leaf| leaf.to_string()).collect::<Vec<_>>())
+            .collect();
+        assert_eq!(leaves[0], vec!["a", "1", "_0", "b"]);
+        assert_eq!(leaves[1], vec!["x", "\"y\"", "[]"]);
+        assert_eq!(leaves[2], vec!["foo"]);
+    }
+
+    #[test]
+    fn display() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "f(g(X, 'A b'), [1, 2.5 | T], - a, \"s\").";
+        let st = Parser::new(pl.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+        assert_eq!(st.to_string(), "f(g(_0,'A b'),[1,2.5|_1],-(a),\"s\")");
+        assert_eq!(st.args()[0].to_string(), "g(_0,'A b')");
+        assert_eq!(st.args()[1].args()[1].to_string(), "[2.5|_1]");
+    }
+
+    #[test]
+    fn rekey() {
+        let ns1 = NameSpace::new();
+        let ops1 = OpTable::default(&ns1);
+        let mut parser = Parser::new("foo(a, 1, X, \"s\", [b]).".as_bytes(), &ns1, &ops1);
+        let st = parser.next().unwrap().unwrap();
+
+        let ns2 = NameSpace::new();
+        let ops2 = OpTable::default(&ns2);
+        let names = ns2.import(&ns1);
+        let moved = st.rekey(&names, &ns2);
+        assert_eq!(moved.functor(), Symbol::Funct(5, ns2.name("foo")));
+        assert_eq!(Writer::new(&ops2).to_string(&moved), Writer::new(&ops1).to_string(&st));
+
+        // Names missing from the translation are issued by the namespace.
+        let ns3 = NameSpace::new();
+        let moved = st.rekey(&HashMap::new(), &ns3);
+        assert_eq!(moved.args()[0].functor(), Symbol::Funct(0, ns3.name("a")));
+    }
+}
@@ -0,0 +1,53 @@
+use std::io::{self, BufRead, Read};
+
+/// A named input to the lexer.
+///
+/// A `Source` bundles a buffered reader with the name used to identify it in
+/// error messages, typically the path of the file being read. Anonymous
+/// sources, e.g. strings typed at a REPL, have no name.
+///
+/// `Source` is itself a `BufRead`, delegating to the underlying reader.
+#[derive(Clone)]
+pub struct Source<B: BufRead> {
+    name: Option<String>,
+    reader: B,
+}
+
+impl<B: BufRead> Source<B> {
+    /// Constructs a new `Source` with the given name.
+    pub fn new<S: Into<String>>(name: S, reader: B) -> Source<B> {
+        Source {
+            name: Some(name.into()),
+            reader: reader,
+        }
+    }
+
+    /// Constructs a new `Source` without a name.
+    pub fn anonymous(reader: B) -> Source<B> {
+        Source {
+            name: None,
+            reader: reader,
+        }
+    }
+
+    /// Returns the name of the source, if any.
+    pub fn name(&self) -> Option<&str> {
+        self.name.as_ref().map(|s| s.as_str())
+    }
+}
+
+impl<B: BufRead> Read for Source<B> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        self.reader.read(buf)
+    }
+}
+
+impl<B: BufRead> BufRead for Source<B> {
+    fn fill_buf(&mut self) -> io::Result<&[u8]> {
+        self.reader.fill_buf()
+    }
+
+    fn consume(&mut self, amt: usize) {
+        self.reader.consume(amt)
+    }
+}
@@ -0,0 +1,818 @@
+//! A writer for logic programs.
+//!
+//! A [`Writer`] is the inverse of a [`Parser`]. It renders [`Structure`]s as
+//! text using the operators of an [`OpTable`], inserting parentheses and spaces
+//! where they are needed for the text to be read back as the same structure.
+//!
+//! Variables have no names once parsed, so they are written as `_` followed by
+//! their index within the structure, e.g. `_0`.
+//!
+//! [`Writer`]: ./struct.Writer.html
+//! [`Parser`]: ../parser/struct.Parser.html
+//! [`Structure`]: ../struct.Structure.html
+//! [`OpTable`]: ../operators/struct.OpTable.html
+
+use std::borrow::Cow;
+use std::io::{self, Write};
+
+use syntax::namespace::Name;
+use syntax::operators::{Op, OpTable};
+use syntax::repr::{Structure, Symbol};
+
+/// Renders `Structure`s as text.
+///
+/// By default, atoms and strings are quoted when necessary for the output to
+/// be read back by a `Parser`.
+pub struct Writer<'a, 'ns: 'a> {
+    ops: &'a OpTable<'ns>,
+    quoted: bool,
+    ignore_ops: bool,
+    spacing: Spacing,
+
+    // Whether variables are written as letters, e.g. `A`, rather than `_0`.
+    letter_vars: bool,
+}
+
+/// The rules for inserting spaces between tokens.
+#[derive(Debug)]
+#[derive(Clone, Copy)]
+#[derive(PartialEq, Eq)]
+pub enum Spacing {
+    /// Spaces are only inserted where required for the output to be read
+    /// back as the same term, e.g. `f(a,b)` and `1- -2`.
+    Minimal,
+
+    /// Spaces are also inserted after commas and around infix operators other
+    /// than the comma, e.g. `f(a, b)` and `X = 1 - -2`.
+    Pretty,
+}
+
+/// Tracks the last character written so that adjacent tokens are separated
+/// when they would otherwise be read as one.
+struct Emitter<'w, W: Write + 'w> {
+    w: &'w mut W,
+    last: Option<char>,
+    prefix_op: bool,
+}
+
+// Public API
+// --------------------------------------------------
+
+impl<'a, 'ns> Writer<'a, 'ns> {
+    /// Constructs a new `Writer` using the given operators.
+    pub fn new(ops: &'a OpTable<'ns>) -> Writer<'a, 'ns> {
+        Writer {
+            ops: ops,
+            quoted: true,
+            ignore_ops: false,
+            spacing: Spacing::Minimal,
+            letter_vars: false,
+        }
+    }
+
+    /// Toggles whether atoms and strings are quoted when necessary.
+    pub fn quoted(mut self, yes: bool) -> Self {
+        self.quoted = yes;
+        self
+    }
+
+    /// Toggles whether operators are ignored.
+    ///
+    /// When operators are ignored, every compound term is written in
+    /// functional notation, e.g. `+(a,b)` rather than `a+b`. Together with
+    /// quoting, this matches the ISO `write_canonical/1`, whose output can be
+    /// read back regardless of the operators in effect.
+    pub fn ignore_ops(mut self, yes: bool) -> Self {
+        self.ignore_ops = yes;
+        self
+    }
+
+    /// Sets the rules for inserting spaces between tokens.
+    ///
+    /// The default is `Spacing::Minimal`.
+    pub fn spacing(mut self, spacing: Spacing) -> Self {
+        self.spacing = spacing;
+        self
+    }
+
+    /// Writes a single term.
+    pub fn write<W: Write>(&self, w: &mut W, st: &Structure<'ns>) -> io::Result<()> {
+        let mut out = Emitter::new(w);
+        self.write_term(&mut out, st, 1200)
+    }
+
+    /// Renders a single term as a `String`.
+    pub fn to_string(&self, st: &Structure<'ns>) -> String {
+        let mut buf = Vec::new();
+        self.write(&mut buf, st).unwrap();
+        String::from_utf8(buf).unwrap()
+    }
+
+    /// Writes a sequence of clauses as a program listing.
+    ///
+    /// Rules are written as `Head :- Body.`, directives as `:- Goal.`, and
+    /// facts as `Head.`, each on its own line. Consecutive clauses for the
+    /// same predicate are grouped together, and groups are separated by a
+    /// blank line.
+    pub fn write_program<'b, W, I>(&self, w: &mut W, clauses: I) -> io::Result<()>
+    where
+        W: Write,
+        I: IntoIterator<Item = &'b Structure<'ns>>,
+        'ns: 'b,
+    {
+        let mut first = true;
+        let mut group = None;
+        for clause in clauses {
+            let pred = predicate(clause);
+            if !first && (pred.is_none() || pred != group) {
+                w.write_all(b"\n")?;
+            }
+            first = false;
+            group = pred;
+
+            {
+                let mut out = Emitter::new(w);
+                match clause.functor() {
+                    Symbol::Funct(2, name) if name.as_str() == ":-" => {
+                        let args = clause.args();
+                        self.write_term(&mut out, args[0], 1199)?;
+                        out.w.write_all(b" :- ")?;
+                        out.last = None;
+                        self.write_term(&mut out, args[1], 1199)?;
+                    },
+                    Symbol::Funct(1, name) if name.as_str() == ":-" => {
+                        out.w.write_all(b":- ")?;
+                        self.write_term(&mut out, clause.args()[0], 1199)?;
+                    },
+                    _ => self.write_term(&mut out, clause, 1199)?,
+                }
+            }
+            w.write_all(b".\n")?;
+        }
+        Ok(())
+    }
+
+    /// Writes a clause in the style of `portray_clause/1`.
+    ///
+    /// Variables are named `A`, `B`, ..., `Z`, `A1`, ... in order of first
+    /// appearance. The body of a rule starts on the line after `:-`, with
+    /// each goal of the conjunction on its own line, indented by four spaces.
+    /// The clause ends with a period and a newline. Quoting and spacing are
+    /// as configured for the writer.
+    pub fn portray_clause<W: Write>(&self, w: &mut W, clause: &Structure<'ns>) -> io::Result<()> {
+        let clause = number_vars(clause);
+        let writer = Writer {
+            letter_vars: true,
+            ..*self
+        };
+        {
+            let mut out = Emitter::new(w);
+            match clause.functor() {
+                Symbol::Funct(2, name) if name.as_str() == ":-" => {
+                    let args = clause.args();
+                    writer.write_term(&mut out, args[0], 1199)?;
+                    out.w.write_all(b" :-")?;
+                    let mut body = args[1];
+                    loop {
+                        out.w.write_all(b"\n    ")?;
+                        out.last = None;
+                        match body.functor() {
+                            Symbol::Funct(2, name) if name.as_str() == "," => {
+                                let args = body.args();
+                                writer.write_term(&mut out, args[0], 999)?;
+                                out.w.write_all(b",")?;
+                                body = args[1];
+                            },
+                            _ => {
+                                writer.write_term(&mut out, body, 999)?;
+                                break;
+                            },
+                        }
+                    }
+                },
+                Symbol::Funct(1, name) if name.as_str() == ":-" => {
+                    out.w.write_all(b":- ")?;
+                    writer.write_term(&mut out, clause.args()[0], 1199)?;
+                },
+                _ => writer.write_term(&mut out, &clause, 1199)?,
+            }
+        }
+        w.write_all(b".\n")
+    }
+}
+
+/// Renumbers the variables of a structure in order of first appearance.
+fn number_vars<'ns>(st: &Structure<'ns>) -> Box<Structure<'ns>> {
+    let mut seen = Vec::new();
+    let syms = st.iter()
+        .map(|sym| match *sym {
+            Symbol::Var(n) => {
+                match seen.iter().position(|&m| m == n) {
+                    Some(i) => Symbol::Var(i),
+                    None => {
+                        seen.push(n);
+                        Symbol::Var(seen.len() - 1)
+                    },
+                }
+            },
+            sym => sym,
+        })
+        .collect();
+    unsafe { Structure::from_vec(syms) }
+}
+
+/// Returns the letter name of a variable, as `numbervars` would assign.
+fn var_letters(n: usize) -> String {
+    let letter = (b'A' + (n % 26) as u8) as char;
+    match n / 26 {
+        0 => letter.to_string(),
+        i => format!("{}{}", letter, i),
+    }
+}
+
+/// Returns the predicate symbol of a clause, or `None` for directives.
+fn predicate<'ns>(clause: &Structure<'ns>) -> Option<Symbol<'ns>> {
+    match clause.functor() {
+        Symbol::Funct(2, name) if name.as_str() == ":-" => Some(clause.args()[0].functor()),
+        Symbol::Funct(1, name) if name.as_str() == ":-" => None,
+        sym => Some(sym),
+    }
+}
+
+// Writing Logic
+// --------------------------------------------------
+
+impl<'a, 'ns> Writer<'a, 'ns> {
+    /// Writes a term whose precedence must not exceed `max_prec`.
+    fn write_term<W: Write>(
+        &self,
+        out: &mut Emitter<W>,
+        st: &Structure<'ns>,
+        max_prec: u32,
+    ) -> io::Result<()> {
+        match st.functor() {
+            Symbol::Var(n) if self.letter_vars => out.token(&var_letters(n)),
+            Symbol::Var(n) => out.token(&format!("_{}", n)),
+            Symbol::Int(val) => out.token(&val.to_string()),
+            Symbol::Float(val) => out.token(&format_float(val.0)),
+            Symbol::Str(val) => {
+                match self.quoted {
+                    true => out.token(&quote(val, '"')),
+                    false => out.token(val),
+                }
+            },
+            Symbol::List(true, 0) => out.token("[]"),
+            Symbol::List(..) => self.write_list(out, st),
+            Symbol::Funct(0, name) => self.write_atom(out, name, max_prec),
+            Symbol::Funct(_, name) => self.write_compound(out, st, name, max_prec),
+        }
+    }
+
+    /// Writes an atom, wrapped in parens if it is an operator whose
+    /// precedence exceeds `max_prec`.
+    fn write_atom<W: Write>(
+        &self,
+        out: &mut Emitter<W>,
+        name: Name<'ns>,
+        max_prec: u32,
+    ) -> io::Result<()> {
+        let prec = self.ops.get(name).iter().map(|op| op.prec()).max().unwrap_or(0);
+        if max_prec < prec && !self.ignore_ops {
+            out.token("(")?;
+            out.token(&self.atom_text(name))?;
+            out.token(")")
+        } else {
+            out.token(&self.atom_text(name))
+        }
+    }
+
+    /// Writes a compound term, using operator notation when possible.
+    fn write_compound<W: Write>(
+        &self,
+        out: &mut Emitter<W>,
+        st: &Structure<'ns>,
+        name: Name<'ns>,
+        max_prec: u32,
+    ) -> io::Result<()> {
+        let args = st.args();
+
+        // Curly terms are written in braces, e.g. `{a,b}`.
+        if args.len() == 1 && name.as_str() == "{}" {
+            out.token("{")?;
+            self.write_term(out, args[0], 1200)?;
+            return out.token("}");
+        }
+
+        if self.ignore_ops {
+            return self.write_functional(out, name, &args);
+        }
+
+        if args.len() == 2 {
+            if let Some(op) = self.ops.get_infix(name, 1200) {
+                return self.write_infix(out, op, args[0], args[1], max_prec);
+            }
+        }
+
+        if args.len() == 1 {
+            if let Some(op) = self.ops.get_prefix(name, 1200) {
+                // A sign applied to a number must be written in functional
+                // notation, otherwise it would be read as a negative number.
+                let signed = match (name.as_str(), args[0].functor()) {
+                    ("-", Symbol::Int(_)) | ("-", Symbol::Float(_)) => true,
+                    ("+", Symbol::Int(_)) | ("+", Symbol::Float(_)) => true,
+                    _ => false,
+                };
+                if !signed {
+                    return self.write_prefix(out, op, args[0], max_prec);
+                }
+            }
+            if let Some(op) = self.ops.get_postfix(name, 1200) {
+                return self.write_postfix(out, op, args[0], max_prec);
+            }
+        }
+
+        self.write_functional(out, name, &args)
+    }
+
+    /// Writes a compound term in functional notation, e.g. `f(a,b)`.
+    fn write_functional<W: Write>(
+        &self,
+        out: &mut Emitter<W>,
+        name: Name<'ns>,
+        args: &[&Structure<'ns>],
+    ) -> io::Result<()> {
+        out.token(&self.atom_text(name))?;
+        out.token("(")?;
+        for (i, arg) in args.iter().enumerate() {
+            if i != 0 {
+                self.write_comma(out)?;
+            }
+            self.write_term(out, arg, 999)?;
+        }
+        out.token(")")
+    }
+
+    /// Writes a binary operator term.
+    fn write_infix<W: Write>(
+        &self,
+        out: &mut Emitter<W>,
+        op: Op<'ns>,
+        lhs: &Structure<'ns>,
+        rhs: &Structure<'ns>,
+        max_prec: u32,
+    ) -> io::Result<()> {
+        let prec = op.prec();
+        let (lhs_prec, rhs_prec) = match op {
+            Op::XFY(..) => (prec - 1, prec),
+            Op::YFX(..) => (prec, prec - 1),
+            _ => (prec - 1, prec - 1),
+        };
+        let open = max_prec < prec;
+        if open {
+            out.token("(")?;
+        }
+        self.write_term(out, lhs, lhs_prec)?;
+        let pretty = self.spacing == Spacing::Pretty;
+        match op.name().as_str() {
+            "," => self.write_comma(out)?,
+            "|" if !pretty => out.token("|")?,
+            _ if !pretty => out.token(&self.atom_text(op.name()))?,
+            name => {
+                out.space()?;
+                match name {
+                    "|" => out.token("|")?,
+                    _ => out.token(&self.atom_text(op.name()))?,
+                }
+                out.space()?;
+            },
+        }
+        self.write_term(out, rhs, rhs_prec)?;
+        if open {
+            out.token(")")?;
+        }
+        Ok(())
+    }
+
+    /// Writes a prefix operator term.
+    fn write_prefix<W: Write>(
+        &self,
+        out: &mut Emitter<W>,
+        op: Op<'ns>,
+        arg: &Structure<'ns>,
+        max_prec: u32,
+    ) -> io::Result<()> {
+        let prec = op.prec();
+        let arg_prec = match op {
+            Op::FY(..) => prec,
+            _ => prec - 1,
+        };
+        let open = max_prec < prec;
+        if open {
+            out.token("(")?;
+        }
+        out.token(&self.atom_text(op.name()))?;
+        out.prefix_op = true;
+        self.write_term(out, arg, arg_prec)?;
+        if open {
+            out.token(")")?;
+        }
+        Ok(())
+    }
+
+    /// Writes a postfix operator term.
+    fn write_postfix<W: Write>(
+        &self,
+        out: &mut Emitter<W>,
+        op: Op<'ns>,
+        arg: &Structure<'ns>,
+        max_prec: u32,
+    ) -> io::Result<()> {
+        let prec = op.prec();
+        let arg_prec = match op {
+            Op::YF(..) => prec,
+            _ => prec - 1,
+        };
+        let open = max_prec < prec;
+        if open {
+            out.token("(")?;
+        }
+        self.write_term(out, arg, arg_prec)?;
+        out.token(&self.atom_text(op.name()))?;
+        if open {
+            out.token(")")?;
+        }
+        Ok(())
+    }
+
+    /// Writes a list in bracket notation.
+    fn write_list<W: Write>(&self, out: &mut Emitter<W>, st: &Structure<'ns>) -> io::Result<()> {
+        out.token("[")?;
+        let (elems, tail) = st.list_elements();
+        for (i, elem) in elems.into_iter().enumerate() {
+            if i != 0 {
+                self.write_comma(out)?;
+            }
+            self.write_term(out, elem, 999)?;
+        }
+        if tail.functor() != Symbol::List(true, 0) {
+            out.token("|")?;
+            self.write_term(out, tail, 999)?;
+        }
+        out.token("]")
+    }
+
+    /// Writes a comma separating arguments, elements, or conjuncts.
+    fn write_comma<W: Write>(&self, out: &mut Emitter<W>) -> io::Result<()> {
+        out.token(",")?;
+        match self.spacing {
+            Spacing::Pretty => out.space(),
+            Spacing::Minimal => Ok(()),
+        }
+    }
+
+    /// Returns the text of an atom, quoted if necessary.
+    fn atom_text(&self, name: Name<'ns>) -> Cow<'ns, str> {
+        if self.quoted {
+            quote_atom(name.as_str())
+        } else {
+            Cow::Borrowed(name.as_str())
+        }
+    }
+}
+
+// Emitter
+// --------------------------------------------------
+
+impl<'w, W: Write> Emitter<'w, W> {
+    fn new(w: &'w mut W) -> Emitter<'w, W> {
+        Emitter {
+            w: w,
+            last: None,
+            prefix_op: false,
+        }
+    }
+
+    /// Writes a token, preceded by a space if it would otherwise be glued to
+    /// the previous token.
+    ///
+    /// An open paren directly following a prefix operator is also separated,
+    /// otherwise it would be read as the start of a compound term.
+    fn token(&mut self, tok: &str) -> io::Result<()> {
+        if let (Some(a), Some(b)) = (self.last, tok.chars().next()) {
+            if glues(a, b) || (self.prefix_op && b == '(') {
+                self.w.write_all(b" ")?;
+            }
+        }
+        self.w.write_all(tok.as_bytes())?;
+        self.last = tok.chars().last().or(self.last);
+        self.prefix_op = false;
+        Ok(())
+    }
+
+    /// Writes a single space.
+    fn space(&mut self) -> io::Result<()> {
+        self.w.write_all(b" ")?;
+        self.last = Some(' ');
+        self.prefix_op = false;
+        Ok(())
+    }
+}
+
+/// Returns the text of an atom, quoted if necessary for it to be read back as
+/// the same atom.
+pub fn quote_atom(s: &str) -> Cow<str> {
+    if needs_quotes(s) {
+        Cow::Owned(quote(s, '\''))
+    } else {
+        Cow::Borrowed(s)
+    }
+}
+
+/// Returns the text of a float in the form of ISO `write/1`.
+///
+/// The text is the shortest which reads back as the same float, and always
+/// has a fractional part, e.g. `3.0` and `1.0e-10`, so that it is not read
+/// as an integer.
+pub fn format_float(f: f64) -> String {
+    let text = format!("{:?}", f);
+    match text.find('e') {
+        Some(i) if !text[..i].contains('.') => format!("{}.0{}", &text[..i], &text[i..]),
+        _ => text,
+    }
+}
+
+/// Returns true if the characters `a` and `b` would be read as part of the same
+/// token when written adjacently.
+fn glues(a: char, b: char) -> bool {
+    (is_alnum(a) && is_alnum(b)) || (is_symbol_char(a) && is_symbol_char(b)) ||
+        (is_symbol_char(a) && b == '_') || (a == '-' && b.is_digit(10)) ||
+        (a == '\'' && b == '\'') || (a == '"' && b == '"')
+}
+
+fn is_alnum(ch: char) -> bool {
+    ch.is_alphanumeric() || ch == '_'
+}
+
+fn is_symbol_char(ch: char) -> bool {
+    "#$&*+-./:<=>?@^~\\".contains(ch)
+}
+
+/// Returns true if an atom must be quoted to be read back as the same atom.
+///
+/// The atom `'[]'` is quoted to distinguish it from the empty list, and symbol
+/// atoms starting with `/*` are quoted so they are not read as a comment.
+fn needs_quotes(s: &str) -> bool {
+    match s {
+        "{}" | "!" | ";" => false,
+        "" | "." => true,
+        _ if s.starts_with("/*") => true,
+        _ => {
+            let first = s.chars().next().unwrap();
+            if first.is_lowercase() {
+                !s.chars().all(is_alnum)
+            } else {
+                !s.chars().all(is_symbol_char)
+            }
+        },
+    }
+}
+
+/// Wraps a string in the given quote character, escaping as necessary.
+fn quote(s: &str, q: char) -> String {
+    let mut buf = String::with_capacity(s.len() + 2);
+    buf.push(q);
+    for ch in s.chars() {
+        match ch {
+            '\n' => buf.push_str("\\n"),
+            '\r' => buf.push_str("\\r"),
+            '\t' => buf.push_str("\\t"),
+            '\\' => buf.push_str("\\\\"),
+            ch if ch == q => {
+                buf.push('\\');
+                buf.push(ch);
+            },
+            ch => buf.push(ch),
+        }
+    }
+    buf.push(q);
+    buf
+}
+
+// Tests
+// --------------------------------------------------
+
+#[cfg(test)]
+mod test {
+    use syntax::namespace::NameSpace;
+    use syntax::parser::Parser;
+    use super::*;
+
+    #[test]
+    fn basic() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+
+        let pl = "foo(X, 'hello world', \"str\", [a, b|T], -(1), - a).\n\
+                  a * (b + c) - d.\n";
+        let mut parser = Parser::new(pl.as_bytes(), &ns, &ops);
+        let first = parser.next().unwrap().unwrap();
+        let second = parser.next().unwrap().unwrap();
+
+        assert_eq!(writer.to_string(&first), "foo(_0,'hello world',\"str\",[a,b|_1],-(1),-a)");
+        assert_eq!(writer.to_string(&second), "a*(b+c)-d");
+    }
+
+    #[test]
+    fn floats() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+
+        assert_eq!(format_float(3.0), "3.0");
+        assert_eq!(format_float(0.1), "0.1");
+        assert_eq!(format_float(-2.5), "-2.5");
+        assert_eq!(format_float(1.0e-10), "1.0e-10");
+        assert_eq!(format_float(1.5e20), "1.5e20");
+
+        let pl = "f(3.0, 0.1, 1.0e-10, 1.0e20).";
+        let clause = Parser::new(pl.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+        let text = writer.to_string(&clause);
+        assert_eq!(text, "f(3.0,0.1,1.0e-10,1.0e20)");
+        let text = format!("{}.", text);
+        let again = Parser::new(text.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+        assert_eq!(again, clause);
+    }
+
+    #[test]
+    fn lists() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+
+        let pl = "[]. [1, 2, 3]. [[a], []|b]. [a|[b|[]]].";
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).map(|c| c.unwrap()).collect();
+        let text: Vec<_> = clauses.iter().map(|c| writer.to_string(c)).collect();
+        assert_eq!(text, vec!["[]", "[1,2,3]", "[[a],[]|b]", "[a,b]"]);
+    }
+
+    #[test]
+    fn special_atoms() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+
+        let pl = "f('.', ',', '[]', [], '|', '/*', '/**/').";
+        let clause = Parser::new(pl.as_bytes(), &ns, &ops).next().unwrap().unwrap();
+        let text = writer.to_string(&clause);
+        assert_eq!(text, "f('.',(','),'[]',[],('|'),'/*','/**/')");
+        let src = format!("{}.", text);
+        let mut parser = Parser::new(src.as_bytes(), &ns, &ops);
+        assert_eq!(parser.next().unwrap().unwrap(), clause);
+    }
+
+    #[test]
+    fn curly_terms() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+
+        let pl = "{a, b}. '{}'(x). {}. {}(a, b). - {a}. f({(p :- q)}).";
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).map(|c| c.unwrap()).collect();
+        for (writer, expected) in vec![
+            (Writer::new(&ops), vec!["{a,b}", "{x}", "{}", "{}(a,b)", "-{a}", "f({p:-q})"]),
+            (
+                Writer::new(&ops).ignore_ops(true),
+                vec!["{','(a,b)}", "{x}", "{}", "{}(a,b)", "-({a})", "f({:-(p,q)})"],
+            ),
+        ] {
+            let text: Vec<_> = clauses.iter().map(|c| writer.to_string(c)).collect();
+            assert_eq!(text, expected);
+            let src: String = text.iter().map(|t| format!("{}. ", t)).collect();
+            let again: Vec<_> = Parser::new(src.as_bytes(), &ns, &ops)
+                .map(|c| c.unwrap())
+                .collect();
+            assert_eq!(again, clauses);
+        }
+    }
+
+    #[test]
+    fn canonical() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops).ignore_ops(true);
+
+        let pl = "a+b. 'hello world'. (a :- b, c). - (1). f(a, -b).";
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).map(|c| c.unwrap()).collect();
+        let text: Vec<_> = clauses.iter().map(|c| writer.to_string(c)).collect();
+        assert_eq!(
+            text,
+            vec!["+(a,b)", "'hello world'", ":-(a,','(b,c))", "-(1)", "f(a,-(b))"]
+        );
+
+        // The output is read back as the same terms, even without operators.
+        let empty = OpTable::new();
+        for (clause, text) in clauses.iter().zip(text.iter()) {
+            let src = format!("{}.", text);
+            let mut parser = Parser::new(src.as_bytes(), &ns, &empty);
+            assert_eq!(&parser.next().unwrap().unwrap(), clause);
+        }
+    }
+
+    #[test]
+    fn spacing() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let minimal = Writer::new(&ops);
+        let pretty = Writer::new(&ops).spacing(Spacing::Pretty);
+
+        let pl = "1 - -2. - - a. f(a, b). X = [a, b|T]. (a :- b, c ; d).";
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).map(|c| c.unwrap()).collect();
+        let minimal: Vec<_> = clauses.iter().map(|c| minimal.to_string(c)).collect();
+        let pretty: Vec<_> = clauses.iter().map(|c| pretty.to_string(c)).collect();
+
+        assert_eq!(minimal, vec!["1- -2", "- -a", "f(a,b)", "_0=[a,b|_1]", "a:-b,c;d"]);
+        assert_eq!(
+            pretty,
+            vec!["1 - -2", "- -a", "f(a, b)", "_0 = [a, b|_1]", "a :- b, c ; d"]
+        );
+    }
+
+    #[test]
+    fn program() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops);
+
+        let pl = ":- dynamic foo/1.\n\
+                  foo(a).\n\
+                  foo([b, c]).\n\
+                  bar(X) :- foo(X), X \\= a.\n\
+                  bar(z).\n";
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops).map(|c| c.unwrap()).collect();
+
+        let mut buf = Vec::new();
+        writer.write_program(&mut buf, clauses.iter().map(|c| &**c)).unwrap();
+        assert_eq!(
+            String::from_utf8(buf).unwrap(),
+            ":- dynamic foo/1.\n\
+             \n\
+             foo(a).\n\
+             foo([b,c]).\n\
+             \n\
+             bar(_0) :- foo(_0),_0\\=a.\n\
+             bar(z).\n"
+        );
+    }
+
+    #[test]
+    fn round_trip() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let pl = "p(X) :- ( X > 0 -> q(X) ; X < 0 -> r ; s, t ), (u ; v).\n\
+                  :- op(700, xfx, ===>).\n\
+                  f(+, -, (:-), (','), [-|-], - (1), - (-), - = - , a- (-1)).\n\
+                  g((a, b ; c), (a -> b), \\+ (a, b), (dynamic), [(:-)|(;)], '/*').\n\
+                  h(X) :- X =.. [-, _|_], -X = Y - _.\n";
+        let clauses: Vec<_> = Parser::new(pl.as_bytes(), &ns, &ops)
+            .map(|c| c.unwrap())
+            .collect();
+        assert_eq!(clauses.len(), 5);
+
+        for writer in vec![Writer::new(&ops), Writer::new(&ops).spacing(Spacing::Pretty)] {
+            let mut buf = Vec::new();
+            writer.write_program(&mut buf, clauses.iter().map(|c| &**c)).unwrap();
+            let again: Vec<_> = Parser::new(&buf[..], &ns, &ops).map(|c| c.unwrap()).collect();
+            assert_eq!(again, clauses);
+        }
+    }
+
+    #[test]
+    fn portray_clause() {
+        let ns = NameSpace::new();
+        let ops = OpTable::default(&ns);
+        let writer = Writer::new(&ops).spacing(Spacing::Pretty);
+
+        let pl = "append([X|Xs], Ys, [X|Zs]) :- length(Xs, N), N >= 0, append(Xs, Ys, Zs).\n\
+                  'hello world'(_, [], \"str\").\n\
+                  :- initialization(main).\n\
+                  p :- (a ; b), \\+ c.\n";
+        let mut buf = Vec::new();
+        for clause in Parser::new(pl.as_bytes(), &ns, &ops) {
+            writer.portray_clause(&mut buf, &clause.unwrap()).unwrap();
+        }
+        assert_eq!(
+            String::from_utf8(buf).unwrap(),
+            "append([A|B], C, [A|D]) :-\n    \
+                 length(B, E),\n    \
+                 E >= 0,\n    \
+                 append(B, C, D).\n\
+             'hello world'(A, [], \"str\").\n\
+             :- initialization main.\n\
+             p :-\n    \
+                 (a ; b),\n    \
+                 \\+c.\n"
+        );
+        assert_eq!(var_letters(25), "Z");
+        assert_eq!(var_letters(27), "B1");
+    }
+}